@@ -0,0 +1,334 @@
+// Package cache caches the results of calls to upstream APIs. Entries live for
+// a TTL, after which they can still be served for a stale period while they
+// are refreshed in the background. Each cache holds a limited number of
+// entries, dropping the least recently used, and concurrent loads of the same
+// key are made once and shared.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/metrics"
+)
+
+// Results of a get, as counted in statistics and metrics
+const (
+	ResultHit    = "hit"    // fresh entry
+	ResultStale  = "stale"  // stale entry, refreshed in the background
+	ResultMiss   = "miss"   // loaded by this caller
+	ResultShared = "shared" // waited for a load by another caller
+	ResultError  = "error"  // load failed
+)
+
+// loadTimeout longest a load can run. Loads are shared by every caller
+// wanting the key, so they do not use any one caller's context, but they are
+// cancelled once no caller is waiting.
+const loadTimeout = 30 * time.Second
+
+// Loader load the value for a key. The context is not a caller's, as the
+// result is shared. It has the cache's load timeout and is cancelled if every
+// caller waiting for the value gives up.
+type Loader func(ctx context.Context) (interface{}, error)
+
+// Stats counts of how gets on a cache were answered
+type Stats struct {
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Stale     uint64 `json:"stale"`
+	Misses    uint64 `json:"misses"`
+	Shared    uint64 `json:"shared"`
+	Errors    uint64 `json:"errors"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// HitRatio fraction of gets answered from the cache, fresh or stale
+func (s Stats) HitRatio() float64 {
+	total := s.Hits + s.Stale + s.Misses + s.Shared
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.Stale) / float64(total)
+}
+
+// entry a cached value
+type entry struct {
+	key        string
+	value      interface{}
+	loaded     time.Time
+	refreshing bool
+}
+
+// call a load in progress, waited on by callers wanting the same key. The
+// load is cancelled if all of them give up.
+type call struct {
+	done    chan struct{}
+	value   interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Cache a size-bounded, least recently used cache of values by key. It is safe
+// for concurrent use.
+type Cache struct {
+	name    string
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	stale   time.Duration
+	lru     *list.List // most recently used first
+	items   map[string]*list.Element
+	calls   map[string]*call
+	stats   Stats
+	now     func() time.Time
+	timeout time.Duration // for loads
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Cache)
+)
+
+// New get an empty cache registered under name, replacing any registered
+// with the same name. A size of zero or less disables caching.
+func New(name string, size int, ttl, stale time.Duration) *Cache {
+	c := Cache{}
+	c.name = name
+	c.size = size
+	c.ttl = ttl
+	c.stale = stale
+	c.lru = list.New()
+	c.items = make(map[string]*list.Element)
+	c.calls = make(map[string]*call)
+	c.now = time.Now
+	c.timeout = loadTimeout
+
+	registryMu.Lock()
+	registry[name] = &c
+	registryMu.Unlock()
+
+	return &c
+}
+
+// FromConfig get an empty cache registered under name with the cache
+// settings in c
+func FromConfig(name string, c *config.Config) *Cache {
+	return New(name, c.Cache.Size, c.Cache.TTL.Duration, c.Cache.Stale.Duration)
+}
+
+// Configure apply the cache settings to every registered cache, dropping
+// their entries
+func Configure(c *config.Config) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, cache := range registry {
+		cache.mu.Lock()
+		cache.size = c.Cache.Size
+		cache.ttl = c.Cache.TTL.Duration
+		cache.stale = c.Cache.Stale.Duration
+		cache.lru.Init()
+		cache.items = make(map[string]*list.Element)
+		cache.mu.Unlock()
+	}
+}
+
+// All get the statistics of every registered cache by name
+func All() []Stats {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	all := make([]Stats, 0, len(registry))
+	for _, c := range registry {
+		all = append(all, c.Stats())
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
+	return all
+}
+
+// Stats get the statistics for the cache
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Name = c.name
+	s.Entries = c.lru.Len()
+
+	return s
+}
+
+// Purge drop all entries
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// Get get the value for a key, calling load if it is missing or expired.
+// Stale values are returned while load refreshes them in the background.
+// Errors from load are returned and not cached. A caller stops waiting for a
+// load when its context is done, leaving the load to finish for others.
+func (c *Cache) Get(ctx context.Context, key string, load Loader) (interface{}, error) {
+	c.mu.Lock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		age := c.now().Sub(e.loaded)
+		if age < c.ttl {
+			c.lru.MoveToFront(el)
+			c.count(ResultHit)
+			c.mu.Unlock()
+			return e.value, nil
+		}
+		if age < c.ttl+c.stale {
+			c.lru.MoveToFront(el)
+			c.count(ResultStale)
+			if e.refreshing == false {
+				e.refreshing = true
+				go c.refresh(key, load)
+			}
+			c.mu.Unlock()
+			return e.value, nil
+		}
+		c.remove(el)
+	}
+
+	cl, ok := c.calls[key]
+	if ok {
+		c.count(ResultShared)
+		cl.waiters++
+		c.mu.Unlock()
+	} else {
+		c.count(ResultMiss)
+		cl = c.load(key, load, 1)
+	}
+
+	select {
+	case <-cl.done:
+		return cl.value, cl.err
+	case <-ctx.Done():
+		c.leave(key, cl)
+		return nil, ctx.Err()
+	}
+}
+
+// leave stop waiting for a load, cancelling it if no one else is waiting.
+// Later gets start a new load.
+func (c *Cache) leave(key string, cl *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl.waiters--
+	if cl.waiters == 0 {
+		cl.cancel()
+		if c.calls[key] == cl {
+			delete(c.calls, key)
+		}
+	}
+}
+
+// refresh reload a stale entry
+func (c *Cache) refresh(key string, load Loader) {
+	c.mu.Lock()
+	if _, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		return
+	}
+	// The refresh waits until the load is done, so it is never cancelled
+	cl := c.load(key, load, 1)
+
+	<-cl.done
+	if cl.err != nil {
+		c.mu.Lock()
+		// Let a later get try again
+		if el, ok := c.items[key]; ok {
+			el.Value.(*entry).refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// load start calling load for a key in the background, sharing the result
+// with callers that arrive while it runs, and store the value. It is called
+// with the lock held and returns with it released.
+func (c *Cache) load(key string, load Loader, waiters int) *call {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	cl := &call{done: make(chan struct{}), waiters: waiters, cancel: cancel}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		cl.value, cl.err = load(ctx)
+
+		c.mu.Lock()
+		if c.calls[key] == cl {
+			delete(c.calls, key)
+		}
+		switch {
+		case cl.waiters == 0:
+			// Given up by every caller, so it neither failed nor counts
+		case cl.err != nil:
+			c.count(ResultError)
+		default:
+			c.set(key, cl.value)
+		}
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+
+	return cl
+}
+
+// set store a value, evicting the least recently used entries if the cache
+// is full, with the lock held
+func (c *Cache) set(key string, value interface{}) {
+	if c.size <= 0 {
+		return
+	}
+
+	if el, ok := c.items[key]; ok {
+		el.Value = &entry{key: key, value: value, loaded: c.now()}
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&entry{key: key, value: value, loaded: c.now()})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drop an entry, with the lock held
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
+
+// count count a get result, with the lock held
+func (c *Cache) count(result string) {
+	switch result {
+	case ResultHit:
+		c.stats.Hits++
+	case ResultStale:
+		c.stats.Stale++
+	case ResultMiss:
+		c.stats.Misses++
+	case ResultShared:
+		c.stats.Shared++
+	case ResultError:
+		c.stats.Errors++
+	}
+	metrics.CacheResult(c.name, result)
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// counter a loader returning the number of times it has been called
+func counter(calls *int32) Loader {
+	return func(ctx context.Context) (interface{}, error) {
+		return int(atomic.AddInt32(calls, 1)), nil
+	}
+}
+
+// TestExpiry test fresh, stale and expired entries
+func TestExpiry(t *testing.T) {
+	is := is.New(t)
+
+	c := New("expiry", 10, time.Minute, time.Hour)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	var calls int32
+	v, err := c.Get(context.Background(), "a", counter(&calls))
+	is.NoErr(err)
+	is.Equal(v, 1)
+
+	v, _ = c.Get(context.Background(), "a", counter(&calls))
+	is.Equal(v, 1)
+
+	// Stale values are served while a refresh runs
+	now = now.Add(2 * time.Minute)
+	v, _ = c.Get(context.Background(), "a", counter(&calls))
+	is.Equal(v, 1)
+	for i := 0; i < 100; i++ {
+		if v, _ = c.Get(context.Background(), "a", counter(&calls)); v == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(v, 2)
+
+	now = now.Add(2 * time.Hour)
+	v, _ = c.Get(context.Background(), "a", counter(&calls))
+	is.Equal(v, 3)
+
+	s := c.Stats()
+	is.Equal(s.Misses, uint64(2))
+	is.True(s.Hits >= 1)
+	is.True(s.Stale >= 1)
+
+	_, err = c.Get(context.Background(), "b", func(ctx context.Context) (interface{}, error) { return nil, errors.New("upstream down") })
+	is.True(err != nil)
+	is.Equal(c.Stats().Errors, uint64(1))
+	is.Equal(c.Stats().Entries, 1) // errors are not cached
+}
+
+// TestEviction test that the least recently used entries are dropped
+func TestEviction(t *testing.T) {
+	is := is.New(t)
+
+	c := New("eviction", 2, time.Minute, 0)
+	var calls int32
+	c.Get(context.Background(), "a", counter(&calls))
+	c.Get(context.Background(), "b", counter(&calls))
+	c.Get(context.Background(), "a", counter(&calls))
+	c.Get(context.Background(), "c", counter(&calls))
+
+	is.Equal(c.Stats().Entries, 2)
+	is.Equal(c.Stats().Evictions, uint64(1))
+
+	v, _ := c.Get(context.Background(), "a", counter(&calls))
+	is.Equal(v, 1)
+	v, _ = c.Get(context.Background(), "b", counter(&calls))
+	is.Equal(v, 4)
+
+	// A size of 0 caches nothing
+	off := New("off", 0, time.Minute, 0)
+	off.Get(context.Background(), "a", counter(&calls))
+	v, _ = off.Get(context.Background(), "a", counter(&calls))
+	is.Equal(v, 6)
+}
+
+// TestShared test that concurrent gets of a key share one load
+func TestShared(t *testing.T) {
+	is := is.New(t)
+
+	c := New("shared", 10, time.Minute, 0)
+	release := make(chan struct{})
+	var calls int32
+	load := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get(context.Background(), "key", load)
+			is.NoErr(err)
+			is.Equal(v, "value")
+		}()
+	}
+	for c.Stats().Misses+c.Stats().Shared < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	is.Equal(atomic.LoadInt32(&calls), int32(1))
+	is.Equal(c.Stats().Shared, uint64(9))
+
+	// A caller giving up does not fail the load for others
+	release = make(chan struct{})
+	first, cancel := context.WithCancel(context.Background())
+	load = func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return "again", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	done := make(chan error)
+	go func() {
+		_, err := c.Get(first, "other", load)
+		done <- err
+	}()
+	for c.Stats().Misses < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		v, err := c.Get(context.Background(), "other", load)
+		is.NoErr(err)
+		is.Equal(v, "again")
+		done <- nil
+	}()
+	for c.Stats().Shared < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	is.True(errors.Is(<-done, context.Canceled))
+	close(release)
+	is.NoErr(<-done)
+	is.Equal(c.Stats().Errors, uint64(0))
+
+	found := false
+	for _, s := range All() {
+		found = found || s.Name == "shared"
+	}
+	is.True(found)
+}
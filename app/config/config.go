@@ -0,0 +1,707 @@
+// Package config holds the runtime configuration for the app. Settings are
+// resolved with the following precedence, lowest to highest:
+//
+//  1. built in defaults (see Default)
+//  2. a YAML or JSON file named by -config or NANOVMS_CONFIG
+//  3. environment variables named NANOVMS_<FLAG>, e.g. NANOVMS_HTTP_PORT
+//  4. command line flags, e.g. -http-port 8000
+//
+// This lets the same binary be built once and then be deployed locally, in a
+// nanovms unikernel, or anywhere else by changing only its environment.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefix for all environment variables read by the app
+const envPrefix = "NANOVMS_"
+
+// Config runtime configuration for the app
+type Config struct {
+	Cloud           bool           `json:"cloud" yaml:"cloud"`                     // running in nanovms unikernel in the cloud
+	ShutdownTimeout Duration       `json:"shutdownTimeout" yaml:"shutdownTimeout"` // time allowed for servers to stop
+	HTTP            HTTPConfig     `json:"http" yaml:"http"`
+	GRPC            GRPCConfig     `json:"grpc" yaml:"grpc"`
+	NATS            NATSConfig     `json:"nats" yaml:"nats"`
+	Upstream        UpstreamConfig `json:"upstream" yaml:"upstream"`
+	Store           StoreConfig    `json:"store" yaml:"store"`
+	Masking         MaskingConfig  `json:"masking" yaml:"masking"`
+	Search          SearchConfig   `json:"search" yaml:"search"`
+	Cache           CacheConfig    `json:"cache" yaml:"cache"`
+	Outbound        OutboundConfig `json:"outbound" yaml:"outbound"`
+	Ledger          LedgerConfig   `json:"ledger" yaml:"ledger"`
+}
+
+// Duration a time.Duration that reads as a string such as "10s" from files and
+// flags
+type Duration struct {
+	time.Duration
+}
+
+// Set set from a string, for use as a flag.Value
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+
+	return nil
+}
+
+// UnmarshalJSON read from a JSON string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	return d.Set(s)
+}
+
+// MarshalJSON write as a JSON string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalYAML read from a YAML string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.Set(s)
+}
+
+// HTTPConfig settings for the HTTP server
+type HTTPConfig struct {
+	Port int `json:"port" yaml:"port"`
+}
+
+// GRPCConfig settings for the GRPC server and the client used by the HTTP
+// handlers to call it
+type GRPCConfig struct {
+	Port             int       `json:"port" yaml:"port"`
+	Address          string    `json:"address" yaml:"address"`                   // address dialed by the HTTP handler client
+	Backends         Addresses `json:"backends" yaml:"backends"`                 // addresses the client balances calls across, Address if empty
+	Keepalive        Duration  `json:"keepalive" yaml:"keepalive"`               // idle time before the client pings a backend
+	KeepaliveTimeout Duration  `json:"keepaliveTimeout" yaml:"keepaliveTimeout"` // wait for a ping reply before dropping the connection
+	CallTimeout      Duration  `json:"callTimeout" yaml:"callTimeout"`           // wait for a call from an HTTP handler
+	Tokens           Tokens    `json:"tokens" yaml:"tokens"`                     // bearer tokens identifying clients, by client name
+	RateLimit        float64   `json:"rateLimit" yaml:"rateLimit"`               // calls per second per client, 0 for no limit
+	RateBurst        int       `json:"rateBurst" yaml:"rateBurst"`               // calls a client can make at once
+}
+
+// Tokens bearer tokens by client name, read from flags as a comma separated
+// list of name=token pairs such as "web=s3cret,batch=0ther"
+type Tokens map[string]string
+
+// Set set from a string, for use as a flag.Value
+func (t *Tokens) Set(s string) error {
+	tokens := make(Tokens)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("%q is not name=token", pair)
+		}
+		tokens[parts[0]] = parts[1]
+	}
+	*t = tokens
+
+	return nil
+}
+
+// String list the names only, so tokens are not shown in usage or logs
+func (t *Tokens) String() string {
+	if t == nil {
+		return ""
+	}
+	names := make([]string, 0, len(*t))
+	for name := range *t {
+		names = append(names, name+"=...")
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+// MinKeepalive shortest client keepalive time, which servers allow
+const MinKeepalive = 10 * time.Second
+
+// Addresses network addresses, read from flags as a comma separated list
+type Addresses []string
+
+// Set set from a string, for use as a flag.Value
+func (a *Addresses) Set(s string) error {
+	addresses := Addresses{}
+	for _, address := range strings.Split(s, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	*a = addresses
+
+	return nil
+}
+
+func (a *Addresses) String() string {
+	if a == nil {
+		return ""
+	}
+	return strings.Join(*a, ",")
+}
+
+// ParseNetwork get the network for a CIDR network or a single IP address
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR network", s)
+	}
+
+	return network, nil
+}
+
+// NATSConfig settings for the embedded NATS server and for the client
+// connection to it
+type NATSConfig struct {
+	Port          int    `json:"port" yaml:"port"`
+	HTTPPort      int    `json:"httpPort" yaml:"httpPort"`           // monitoring port
+	URL           string `json:"url" yaml:"url"`                     // used when running locally
+	RemoteURL     string `json:"remoteURL" yaml:"remoteURL"`         // used when running in the cloud
+	RemoteCreds   string `json:"remoteCreds" yaml:"remoteCreds"`     // credentials file for RemoteURL
+	SubjectPrefix string `json:"subjectPrefix" yaml:"subjectPrefix"` // before search subjects, unique to the deployment
+	UsersFile     string `json:"usersFile" yaml:"usersFile"`         // YAML or JSON NKey users, built in user if empty
+	TLS           bool   `json:"tls" yaml:"tls"`                     // serve and connect with the creds certificate
+	ClusterID     string `json:"clusterID" yaml:"clusterID"`         // NATS Streaming cluster
+	StoreDir      string `json:"storeDir" yaml:"storeDir"`           // NATS Streaming file store directory
+}
+
+// UpstreamConfig base URLs for the remote APIs called by the app
+type UpstreamConfig struct {
+	PLOS     string `json:"plos" yaml:"plos"`
+	XKCD     string `json:"xkcd" yaml:"xkcd"`
+	Twitter  string `json:"twitter" yaml:"twitter"`
+	Crossref string `json:"crossref" yaml:"crossref"`
+}
+
+// Store types
+const (
+	StoreMemory = "memory" // in-memory, lost on restart
+	StoreFile   = "file"   // append-only JSON log file
+)
+
+// StoreConfig settings for transaction storage
+type StoreConfig struct {
+	Type string `json:"type" yaml:"type"`
+	Path string `json:"path" yaml:"path"` // log file for the file store
+}
+
+// MaskingConfig settings for masking of transaction fields in responses
+type MaskingConfig struct {
+	PolicyFile string `json:"policyFile" yaml:"policyFile"` // YAML or JSON policy, built in policy if empty
+	HashKey    string `json:"hashKey" yaml:"hashKey"`       // key for hashed fields, random if empty
+	// The caller's role is only read from the X-Role header when RoleHeader
+	// is set and the request comes from one of the trusted proxies
+	RoleHeader     bool      `json:"roleHeader" yaml:"roleHeader"`
+	TrustedProxies Addresses `json:"trustedProxies" yaml:"trustedProxies"` // IP addresses or CIDR networks
+}
+
+// Search backends
+const (
+	SearchPLOS     = "plos"     // PLOS search API
+	SearchLocal    = "local"    // full-text search of an article corpus in the process
+	SearchCrossref = "crossref" // DOI lookups with the Crossref API
+)
+
+// SearchConfig settings for article searches
+type SearchConfig struct {
+	Backend string `json:"backend" yaml:"backend"`
+	Corpus  string `json:"corpus" yaml:"corpus"`   // JSON articles for the local backend, built in sample if empty
+	Learned int    `json:"learned" yaml:"learned"` // PLOS results kept in the local index, 0 to keep none
+	// Concurrency NATS search requests each worker answers at once
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+}
+
+// CacheConfig settings for caches of upstream API responses
+type CacheConfig struct {
+	Size  int      `json:"size" yaml:"size"`   // entries per cache, 0 to disable caching
+	TTL   Duration `json:"ttl" yaml:"ttl"`     // time entries are fresh
+	Stale Duration `json:"stale" yaml:"stale"` // time after the TTL entries are served while being refreshed
+}
+
+// HostDurations durations by host name, read from flags as a comma separated
+// list of host=duration pairs such as "api.plos.org=20s,xkcd.com=5s"
+type HostDurations map[string]Duration
+
+// Set set from a string, for use as a flag.Value
+func (h *HostDurations) Set(s string) error {
+	durations := make(HostDurations)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("%q is not host=duration", pair)
+		}
+		d := Duration{}
+		if err := d.Set(parts[1]); err != nil {
+			return err
+		}
+		durations[parts[0]] = d
+	}
+	*h = durations
+
+	return nil
+}
+
+func (h *HostDurations) String() string {
+	if h == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*h))
+	for host, d := range *h {
+		pairs = append(pairs, host+"="+d.String())
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// OutboundConfig settings for calls to upstream APIs
+type OutboundConfig struct {
+	Timeout         Duration      `json:"timeout" yaml:"timeout"`                 // per attempt, including reading the body
+	HostTimeouts    HostDurations `json:"hostTimeouts" yaml:"hostTimeouts"`       // overrides of timeout by host
+	Retries         int           `json:"retries" yaml:"retries"`                 // further attempts for idempotent requests
+	BreakerFailures int           `json:"breakerFailures" yaml:"breakerFailures"` // consecutive failures opening a host's breaker, 0 never opens
+	BreakerCooldown Duration      `json:"breakerCooldown" yaml:"breakerCooldown"` // time a breaker stays open before a trial request
+}
+
+// AccountBalances balances by account number, read from flags as a comma
+// separated list of account=balance pairs such as "1234=5000,3877=0"
+type AccountBalances map[int]int
+
+// Set set from a string, for use as a flag.Value
+func (a *AccountBalances) Set(s string) error {
+	balances := make(AccountBalances)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%q is not account=balance", pair)
+		}
+		account, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return fmt.Errorf("%q is not an account number", parts[0])
+		}
+		balance, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("%q is not a balance", parts[1])
+		}
+		balances[account] = balance
+	}
+	*a = balances
+
+	return nil
+}
+
+func (a *AccountBalances) String() string {
+	if a == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*a))
+	for account, balance := range *a {
+		pairs = append(pairs, fmt.Sprintf("%d=%d", account, balance))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// LedgerConfig settings for the ledger replayed from transactions
+type LedgerConfig struct {
+	// Opening balances of the known accounts. Transactions with other
+	// accounts and balances going below zero are only flagged when set.
+	Accounts AccountBalances `json:"accounts" yaml:"accounts"`
+}
+
+// Default get a configuration with the built in defaults
+func Default() *Config {
+	c := Config{}
+	c.ShutdownTimeout.Duration = 15 * time.Second
+	c.HTTP.Port = 8000
+	c.GRPC.Port = 5222
+	c.GRPC.Address = "[::1]:5222"
+	c.GRPC.Keepalive.Duration = 30 * time.Second
+	c.GRPC.KeepaliveTimeout.Duration = 10 * time.Second
+	c.GRPC.CallTimeout.Duration = 10 * time.Second
+	c.GRPC.Tokens = Tokens{}
+	c.GRPC.RateLimit = 20
+	c.GRPC.RateBurst = 40
+	c.NATS.Port = 4222
+	c.NATS.HTTPPort = 8223
+	c.NATS.URL = "nats://0.0.0.0:4222"
+	c.NATS.ClusterID = "nanovms"
+	c.NATS.StoreDir = "nats-store"
+	c.Masking.TrustedProxies = Addresses{"127.0.0.1/32", "::1/128"}
+	c.Upstream.PLOS = "http://api.plos.org/search"
+	c.Upstream.XKCD = "http://xkcd.com"
+	c.Upstream.Twitter = "https://api.twitter.com"
+	c.Upstream.Crossref = "https://api.crossref.org"
+	c.Store.Type = StoreMemory
+	c.Store.Path = "transactions.log"
+	c.Search.Backend = SearchPLOS
+	c.Search.Learned = 5000
+	c.Search.Concurrency = 8
+	c.Cache.Size = 500
+	c.Cache.TTL.Duration = 10 * time.Minute
+	c.Cache.Stale.Duration = time.Hour
+	c.Outbound.Timeout.Duration = 10 * time.Second
+	c.Outbound.HostTimeouts = HostDurations{}
+	c.Outbound.Retries = 2
+	c.Outbound.BreakerFailures = 5
+	c.Outbound.BreakerCooldown.Duration = 30 * time.Second
+	c.Ledger.Accounts = AccountBalances{}
+
+	return &c
+}
+
+// newFlagSet get a flag set whose flags write to the fields of c. The flag
+// names are also used to derive environment variable names.
+func newFlagSet(c *Config, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("nanovms", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+
+	fs.StringVar(path, "config", *path, "path to a YAML or JSON configuration file")
+	fs.BoolVar(&c.Cloud, "cloud", c.Cloud, "run in cloud mode")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "time allowed for servers to stop on SIGINT or SIGTERM")
+	fs.IntVar(&c.HTTP.Port, "http-port", c.HTTP.Port, "HTTP server port")
+	fs.IntVar(&c.GRPC.Port, "grpc-port", c.GRPC.Port, "GRPC server port")
+	fs.StringVar(&c.GRPC.Address, "grpc-address", c.GRPC.Address, "GRPC server address dialed by HTTP handlers")
+	fs.Var(&c.GRPC.Backends, "grpc-backends", "GRPC servers HTTP handlers balance calls across, e.g. 10.0.0.2:5222,10.0.0.3:5222 (grpc-address if empty)")
+	fs.Var(&c.GRPC.Keepalive, "grpc-keepalive", "idle time before the GRPC client pings a server")
+	fs.Var(&c.GRPC.KeepaliveTimeout, "grpc-keepalive-timeout", "time the GRPC client waits for a ping reply")
+	fs.Var(&c.GRPC.CallTimeout, "grpc-call-timeout", "time HTTP handlers wait for a GRPC call")
+	fs.Var(&c.GRPC.Tokens, "grpc-tokens", "GRPC bearer tokens by client name, e.g. web=s3cret,batch=0ther")
+	fs.Float64Var(&c.GRPC.RateLimit, "grpc-rate-limit", c.GRPC.RateLimit, "GRPC calls per second per client (0 for no limit)")
+	fs.IntVar(&c.GRPC.RateBurst, "grpc-rate-burst", c.GRPC.RateBurst, "GRPC calls a client can make at once")
+	fs.IntVar(&c.NATS.Port, "nats-port", c.NATS.Port, "NATS server port")
+	fs.IntVar(&c.NATS.HTTPPort, "nats-http-port", c.NATS.HTTPPort, "NATS monitoring port")
+	fs.StringVar(&c.NATS.URL, "nats-url", c.NATS.URL, "NATS URL used when running locally")
+	fs.StringVar(&c.NATS.RemoteURL, "nats-remote-url", c.NATS.RemoteURL, "NATS URL used when running in the cloud")
+	fs.StringVar(&c.NATS.RemoteCreds, "nats-remote-creds", c.NATS.RemoteCreds, "NATS credentials file used when running in the cloud")
+	fs.StringVar(&c.NATS.SubjectPrefix, "nats-subject-prefix", c.NATS.SubjectPrefix, "prefix for the NATS search subjects, unique to the deployment")
+	fs.StringVar(&c.NATS.UsersFile, "nats-users", c.NATS.UsersFile, "YAML or JSON file of NATS NKey users and permissions")
+	fs.BoolVar(&c.NATS.TLS, "nats-tls", c.NATS.TLS, "use TLS between the NATS server and clients")
+	fs.StringVar(&c.NATS.ClusterID, "nats-cluster-id", c.NATS.ClusterID, "NATS Streaming cluster ID")
+	fs.StringVar(&c.NATS.StoreDir, "nats-store-dir", c.NATS.StoreDir, "directory for the NATS Streaming file store")
+	fs.StringVar(&c.Upstream.PLOS, "plos-url", c.Upstream.PLOS, "PLOS search API URL")
+	fs.StringVar(&c.Upstream.XKCD, "xkcd-url", c.Upstream.XKCD, "xkcd API base URL")
+	fs.StringVar(&c.Upstream.Twitter, "twitter-url", c.Upstream.Twitter, "Twitter API base URL")
+	fs.StringVar(&c.Upstream.Crossref, "crossref-url", c.Upstream.Crossref, "Crossref API base URL")
+	fs.StringVar(&c.Store.Type, "store", c.Store.Type, "transaction store type (memory or file)")
+	fs.StringVar(&c.Store.Path, "store-path", c.Store.Path, "transaction log file for the file store")
+	fs.StringVar(&c.Masking.PolicyFile, "masking-policy", c.Masking.PolicyFile, "YAML or JSON field masking policy file")
+	fs.StringVar(&c.Masking.HashKey, "masking-hash-key", c.Masking.HashKey, "key for hashed fields (random if not set)")
+	fs.BoolVar(&c.Masking.RoleHeader, "masking-role-header", c.Masking.RoleHeader, "read the caller's role from the X-Role header set by a trusted proxy")
+	fs.Var(&c.Masking.TrustedProxies, "masking-trusted-proxies", "addresses or CIDR networks of proxies trusted to set X-Role")
+	fs.StringVar(&c.Search.Backend, "search-backend", c.Search.Backend, "article search backend (plos, local or crossref)")
+	fs.StringVar(&c.Search.Corpus, "search-corpus", c.Search.Corpus, "JSON file of articles for the local search backend")
+	fs.IntVar(&c.Search.Learned, "search-learned", c.Search.Learned, "PLOS results kept in the local index, oldest dropped first")
+	fs.IntVar(&c.Search.Concurrency, "search-concurrency", c.Search.Concurrency, "NATS search requests each worker answers at once")
+	fs.IntVar(&c.Cache.Size, "cache-size", c.Cache.Size, "upstream responses kept per cache (0 disables caching)")
+	fs.Var(&c.Cache.TTL, "cache-ttl", "time cached upstream responses are fresh")
+	fs.Var(&c.Cache.Stale, "cache-stale", "time after the TTL stale responses are served while being refreshed")
+	fs.Var(&c.Outbound.Timeout, "outbound-timeout", "timeout for each attempt at a call to an upstream API")
+	fs.Var(&c.Outbound.HostTimeouts, "outbound-host-timeouts", "upstream timeouts by host, e.g. api.plos.org=20s,xkcd.com=5s")
+	fs.IntVar(&c.Outbound.Retries, "outbound-retries", c.Outbound.Retries, "retries of failed idempotent calls to upstream APIs")
+	fs.IntVar(&c.Outbound.BreakerFailures, "outbound-breaker-failures", c.Outbound.BreakerFailures, "consecutive failures opening an upstream host's circuit breaker (0 never opens)")
+	fs.Var(&c.Outbound.BreakerCooldown, "outbound-breaker-cooldown", "time an upstream host's circuit breaker stays open")
+	fs.Var(&c.Ledger.Accounts, "ledger-accounts", "opening balances of the known ledger accounts, e.g. 1234=5000,3877=0")
+
+	return fs
+}
+
+// envName get the environment variable name for a flag name
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load resolve configuration from defaults, file, environment and args, in
+// that order, then validate it. Args should not include the program name.
+func Load(args []string) (*Config, error) {
+	// A first pass over the args to find the configuration file path and to
+	// surface any flag errors before doing other work.
+	path := os.Getenv(envName("config"))
+	if err := newFlagSet(Default(), &path).Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := newFlagSet(c, &path)
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Second pass over the args so that flags override the environment
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Usage get a description of the flags and their environment variables
+func Usage() string {
+	var sb strings.Builder
+	path := ""
+	newFlagSet(Default(), &path).VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&sb, "  -%s (%s)\n    \t%s", f.Name, envName(f.Name), f.Usage)
+		if f.DefValue != "" && f.DefValue != "false" {
+			fmt.Fprintf(&sb, " (default %s)", f.DefValue)
+		}
+		sb.WriteString("\n")
+	})
+
+	return sb.String()
+}
+
+// loadFile read settings from a YAML or JSON file over top of those in c. The
+// format is chosen using the file extension.
+func (c *Config) loadFile(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(bytes, c)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(bytes, c)
+	default:
+		return fmt.Errorf("unsupported config file type %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// clusterID characters allowed in a NATS Streaming cluster ID
+var clusterID = regexp.MustCompile(`^[\w-]+$`)
+
+// subjectPrefix NATS subject tokens separated by dots, without wildcards
+var subjectPrefix = regexp.MustCompile(`^[\w-]+(\.[\w-]+)*$`)
+
+// Validate check that the settings are usable
+func (c *Config) Validate() error {
+	var problems []string
+
+	ports := []struct {
+		name  string
+		value int
+	}{
+		{"http port", c.HTTP.Port},
+		{"grpc port", c.GRPC.Port},
+		{"nats port", c.NATS.Port},
+		{"nats monitoring port", c.NATS.HTTPPort},
+	}
+	used := make(map[int]string)
+	for _, p := range ports {
+		if p.value < 1 || p.value > 65535 {
+			problems = append(problems, fmt.Sprintf("%s %d out of range", p.name, p.value))
+			continue
+		}
+		if other, ok := used[p.value]; ok {
+			problems = append(problems, fmt.Sprintf("%s %d already used by %s", p.name, p.value, other))
+			continue
+		}
+		used[p.value] = p.name
+	}
+
+	if c.ShutdownTimeout.Duration <= 0 {
+		problems = append(problems, "shutdown timeout must be positive")
+	}
+
+	if c.GRPC.Address == "" {
+		problems = append(problems, "grpc address is empty")
+	}
+	if c.GRPC.Keepalive.Duration < MinKeepalive {
+		problems = append(problems, fmt.Sprintf("grpc keepalive must be at least %v", MinKeepalive))
+	}
+	if c.GRPC.KeepaliveTimeout.Duration <= 0 || c.GRPC.CallTimeout.Duration <= 0 {
+		problems = append(problems, "grpc keepalive and call timeouts must be positive")
+	}
+	names := make(map[string]string)
+	for name, token := range c.GRPC.Tokens {
+		if token == "" {
+			problems = append(problems, fmt.Sprintf("grpc token for %s is empty", name))
+			continue
+		}
+		if other, ok := names[token]; ok {
+			problems = append(problems, fmt.Sprintf("grpc clients %s and %s have the same token", other, name))
+		}
+		names[token] = name
+	}
+	if c.GRPC.RateLimit < 0 {
+		problems = append(problems, "grpc rate limit must not be negative")
+	}
+	if c.GRPC.RateLimit > 0 && c.GRPC.RateBurst < 1 {
+		problems = append(problems, "grpc rate burst must be at least 1")
+	}
+
+	if clusterID.MatchString(c.NATS.ClusterID) == false {
+		problems = append(problems, fmt.Sprintf("nats cluster id %q must be letters, digits, - and _", c.NATS.ClusterID))
+	}
+	if c.NATS.SubjectPrefix != "" && subjectPrefix.MatchString(c.NATS.SubjectPrefix) == false {
+		problems = append(problems, fmt.Sprintf("nats subject prefix %q must be letters, digits, - and _ separated by dots", c.NATS.SubjectPrefix))
+	}
+	// Searches must not be open to anyone on a shared server such as the
+	// public demo one
+	if c.Cloud && (c.NATS.RemoteURL == "" || c.NATS.RemoteCreds == "" || c.NATS.SubjectPrefix == "") {
+		problems = append(problems, "cloud mode needs a nats remote url, remote creds and subject prefix for the deployment")
+	}
+	if c.NATS.StoreDir == "" {
+		problems = append(problems, "nats store directory is empty")
+	}
+
+	switch c.Store.Type {
+	case StoreMemory:
+	case StoreFile:
+		if c.Store.Path == "" {
+			problems = append(problems, "file store needs a path")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown store type %q", c.Store.Type))
+	}
+
+	for _, proxy := range c.Masking.TrustedProxies {
+		if _, err := ParseNetwork(proxy); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	switch c.Search.Backend {
+	case SearchPLOS, SearchLocal, SearchCrossref:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown search backend %q", c.Search.Backend))
+	}
+	if c.Search.Learned < 0 {
+		problems = append(problems, fmt.Sprintf("search learned %d is negative", c.Search.Learned))
+	}
+	if c.Search.Concurrency < 1 {
+		problems = append(problems, fmt.Sprintf("search concurrency %d must be at least 1", c.Search.Concurrency))
+	}
+
+	if c.Cache.Size < 0 {
+		problems = append(problems, fmt.Sprintf("cache size %d is negative", c.Cache.Size))
+	}
+	if c.Cache.TTL.Duration < 0 || c.Cache.Stale.Duration < 0 {
+		problems = append(problems, "cache ttl and stale times must not be negative")
+	}
+
+	if c.Outbound.Timeout.Duration <= 0 {
+		problems = append(problems, "outbound timeout must be positive")
+	}
+	for host, d := range c.Outbound.HostTimeouts {
+		if d.Duration <= 0 {
+			problems = append(problems, fmt.Sprintf("outbound timeout for %s must be positive", host))
+		}
+	}
+	if c.Outbound.Retries < 0 || c.Outbound.BreakerFailures < 0 {
+		problems = append(problems, "outbound retries and breaker failures must not be negative")
+	}
+	if c.Outbound.BreakerCooldown.Duration <= 0 {
+		problems = append(problems, "outbound breaker cooldown must be positive")
+	}
+
+	for account, balance := range c.Ledger.Accounts {
+		if account <= 0 || balance < 0 {
+			problems = append(problems, fmt.Sprintf("ledger account %d must be positive with a balance that is not negative", account))
+		}
+	}
+
+	urls := []struct {
+		name     string
+		value    string
+		optional bool
+	}{
+		{"nats url", c.NATS.URL, false},
+		{"nats remote url", c.NATS.RemoteURL, true}, // only needed in the cloud
+		{"plos url", c.Upstream.PLOS, false},
+		{"xkcd url", c.Upstream.XKCD, false},
+		{"twitter url", c.Upstream.Twitter, false},
+		{"crossref url", c.Upstream.Crossref, false},
+	}
+	for _, u := range urls {
+		if u.optional && u.value == "" {
+			continue
+		}
+		parsed, err := url.Parse(u.value)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s %q is not an absolute URL", u.name, u.value))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// writeFile write a config file to a temporary directory
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// TestDefault test that defaults are valid
+func TestDefault(t *testing.T) {
+	is := is.New(t)
+
+	c, err := Load([]string{})
+	is.NoErr(err)
+	is.Equal(c.HTTP.Port, 8000)
+	is.Equal(c.GRPC.Port, 5222)
+	is.Equal(c.NATS.Port, 4222)
+	is.Equal(c.NATS.HTTPPort, 8223)
+	is.True(c.Cloud == false)
+}
+
+// TestPrecedence test that flags override environment which overrides file
+func TestPrecedence(t *testing.T) {
+	is := is.New(t)
+
+	path := writeFile(t, "app.yaml", "shutdownTimeout: 20s\nhttp:\n  port: 9001\ngrpc:\n  port: 9002\nnats:\n  port: 9003\n")
+
+	c, err := Load([]string{"-config", path})
+	is.NoErr(err)
+	is.Equal(c.HTTP.Port, 9001)
+	is.Equal(c.GRPC.Port, 9002)
+	is.Equal(c.NATS.Port, 9003)
+	is.Equal(c.ShutdownTimeout.Duration, 20*time.Second)
+
+	os.Setenv("NANOVMS_GRPC_PORT", "9012")
+	os.Setenv("NANOVMS_NATS_PORT", "9013")
+	defer os.Unsetenv("NANOVMS_GRPC_PORT")
+	defer os.Unsetenv("NANOVMS_NATS_PORT")
+
+	c, err = Load([]string{"-config", path, "-nats-port", "9023"})
+	is.NoErr(err)
+	is.Equal(c.HTTP.Port, 9001) // file
+	is.Equal(c.GRPC.Port, 9012) // environment
+	is.Equal(c.NATS.Port, 9023) // flag
+
+	c, err = Load([]string{"-config", path, "-grpc-backends", "10.0.0.2:5222, 10.0.0.3:5222"})
+	is.NoErr(err)
+	is.Equal(c.GRPC.Backends, Addresses{"10.0.0.2:5222", "10.0.0.3:5222"})
+
+	c, err = Load([]string{"-config", path, "-ledger-accounts", "1234=5000, 3877=0"})
+	is.NoErr(err)
+	is.Equal(c.Ledger.Accounts, AccountBalances{1234: 5000, 3877: 0})
+}
+
+// TestSampleFile test that the sample configuration loads
+func TestSampleFile(t *testing.T) {
+	is := is.New(t)
+
+	c, err := Load([]string{"-config", "../../build/config/app_sample.yaml"})
+	is.NoErr(err)
+	is.Equal(c.Masking.TrustedProxies, Addresses{"127.0.0.1/32", "::1/128"})
+}
+
+// TestJSONFile test loading a JSON file named in the environment
+func TestJSONFile(t *testing.T) {
+	is := is.New(t)
+
+	path := writeFile(t, "app.json", `{"cloud": true, "shutdownTimeout": "3s", "upstream": {"plos": "http://localhost:9999/search"},
+		"nats": {"remoteURL": "nats://nats.example.com:4222", "remoteCreds": "nanovms.creds", "subjectPrefix": "nanovms-test"}}`)
+	os.Setenv("NANOVMS_CONFIG", path)
+	defer os.Unsetenv("NANOVMS_CONFIG")
+
+	c, err := Load([]string{})
+	is.NoErr(err)
+	is.True(c.Cloud)
+	is.Equal(c.ShutdownTimeout.Duration, 3*time.Second)
+	is.Equal(c.Upstream.PLOS, "http://localhost:9999/search")
+	is.Equal(c.Upstream.XKCD, Default().Upstream.XKCD)
+}
+
+// TestValidate test that bad settings are rejected
+func TestValidate(t *testing.T) {
+	is := is.New(t)
+
+	_, err := Load([]string{"-http-port", "70000"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-grpc-port", "8000"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-shutdown-timeout", "0s"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-store", "postgres"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-xkcd-url", "xkcd.com"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-nats-cluster-id", "nano vms"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-nats-subject-prefix", "app.>"})
+	is.True(err != nil)
+	t.Log(err)
+
+	// The cloud needs a server of the deployment's own
+	_, err = Load([]string{"-cloud"})
+	is.True(err != nil)
+	t.Log(err)
+	_, err = Load([]string{"-cloud", "-nats-remote-url", "nats://nats.example.com:4222", "-nats-remote-creds", "nanovms.creds"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-search-backend", "google"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-search-learned", "-1"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-search-concurrency", "0"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-masking-trusted-proxies", "10.0.0.0/33"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-cache-ttl", "-1m"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-outbound-host-timeouts", "xkcd.com"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-outbound-host-timeouts", "xkcd.com=0s"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-ledger-accounts", "1234=lots"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-ledger-accounts", "1234=-5"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-grpc-keepalive", "1s"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-grpc-tokens", "web=s3cret,batch=s3cret"})
+	is.True(err != nil)
+	t.Log(err)
+
+	_, err = Load([]string{"-grpc-rate-burst", "0"})
+	is.True(err != nil)
+	t.Log(err)
+
+	os.Setenv("NANOVMS_HTTP_PORT", "eighty")
+	_, err = Load([]string{})
+	os.Unsetenv("NANOVMS_HTTP_PORT")
+	is.True(err != nil)
+	t.Log(err)
+
+	path := writeFile(t, "app.yaml", "htp:\n  port: 9001\n")
+	_, err = Load([]string{"-config", path})
+	is.True(err != nil)
+	t.Log(err)
+}
@@ -17,8 +17,13 @@ var servercert []byte
 //go:embed secrets/serverkey.pem
 var serverkey []byte
 
+// ServerName name the certificate is issued for
+const ServerName = "grpc.com"
+
 var transportCredentials *credentials.TransportCredentials
 var clientCredentials *credentials.TransportCredentials
+var serverTLSConfig *tls.Config
+var clientTLSConfig *tls.Config
 
 // TransportCredentials credentials for HTTP transport
 func TransportCredentials() *credentials.TransportCredentials {
@@ -30,6 +35,18 @@ func ClientCredentials() *credentials.TransportCredentials {
 	return clientCredentials
 }
 
+// ServerTLSConfig TLS configuration for other servers, such as NATS, serving
+// the certificate
+func ServerTLSConfig() *tls.Config {
+	return serverTLSConfig.Clone()
+}
+
+// ClientTLSConfig TLS configuration for clients of servers using
+// ServerTLSConfig
+func ClientTLSConfig() *tls.Config {
+	return clientTLSConfig.Clone()
+}
+
 func init() {
 	// Set up certificate that client and server can use
 	cert, err := tls.X509KeyPair(servercert, serverkey)
@@ -43,15 +60,25 @@ func init() {
 
 	// Create the TLS credentials for GRPC server
 	tc := credentials.NewTLS(&tls.Config{
-		ClientAuth: tls.NoClientCert,
-		// Don't ask for a client certificate for now
-		// tls.RequireAndVerifyClientCert,
+		// Clients need not have a certificate, but one they give is verified
+		// and identifies them
+		ClientAuth:         tls.VerifyClientCertIfGiven,
 		Certificates:       []tls.Certificate{cert},
 		ClientCAs:          pool,
 		InsecureSkipVerify: true,
 	})
 	transportCredentials = &tc
 
-	cc := credentials.NewClientTLSFromCert(pool, "grpc.com")
+	cc := credentials.NewClientTLSFromCert(pool, ServerName)
 	clientCredentials = &cc
+
+	serverTLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	clientTLSConfig = &tls.Config{
+		RootCAs:    pool,
+		ServerName: ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
 }
@@ -0,0 +1,577 @@
+// Package gateway serves GRPC services as REST with JSON, in the style of
+// grpc-gateway. Routes come from the google.api.http rules on each method,
+// read from the service descriptor at run time, so an RPC given a rule in its
+// proto is served without more code. Calls are made over a GRPC client
+// connection and so go through the server like those of any other client.
+//
+// Path variables and query parameters set request fields by name, with dots
+// for nested fields (?range.from=1). Unary responses are JSON. Streamed
+// responses are newline delimited JSON, one {"result": ...} per message, and
+// client streams are read from a body of newline delimited JSON messages.
+// Errors are the GRPC status mapped to an HTTP status, with a JSON body.
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/imarsman/nanovms/app/grpcerr"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	jsonContentType   = "application/json; charset=utf-8"
+	ndjsonContentType = "application/x-ndjson; charset=utf-8"
+)
+
+// metadataPrefix prefix of request headers passed to the GRPC server as
+// metadata without the prefix, as with grpc-gateway
+const metadataPrefix = "Grpc-Metadata-"
+
+// forwardedPrefix prefix of metadata naming the caller, which is not passed
+// through from request headers
+const forwardedPrefix = "X-Forwarded-"
+
+// maxBody largest request body accepted, including all the messages sent to
+// a client stream
+const maxBody = 1 << 20
+
+// forwardHeaders request headers passed to the GRPC server as metadata as is
+var forwardHeaders = []string{"Authorization", "X-Request-Id"}
+
+var marshal = protojson.MarshalOptions{EmitUnpopulated: true}
+var unmarshal = protojson.UnmarshalOptions{}
+
+// pathVar a variable in a path template, {field} or {field=segments}
+var pathVar = regexp.MustCompile(`\{([^}=]+)(?:=([^}]*))?\}`)
+
+// binding one HTTP rule for a method
+type binding struct {
+	method     protoreflect.MethodDescriptor
+	fullMethod string   // GRPC method name, /package.Service/Method
+	fields     []string // fields set by path variables v0, v1 and so on
+	body       string   // field set by the body, * for the whole request
+	response   string   // field of the response sent, all of it if empty
+	conn       grpc.ClientConnInterface
+}
+
+// Register add routes to router for the HTTP rules of the methods of a
+// service, calling the methods over conn. Methods without a rule are not
+// served.
+func Register(router *mux.Router, conn grpc.ClientConnInterface, service protoreflect.ServiceDescriptor) error {
+	methods := service.Methods()
+	for i := 0; i < methods.Len(); i++ {
+		method := methods.Get(i)
+		rule, ok := proto.GetExtension(method.Options(), annotations.E_Http).(*annotations.HttpRule)
+		if ok == false || rule == nil {
+			continue
+		}
+
+		for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+			verb, path := pattern(r)
+			if path == "" {
+				return fmt.Errorf("%s: HTTP rule has no pattern", method.FullName())
+			}
+
+			b := binding{}
+			b.method = method
+			b.fullMethod = "/" + string(service.FullName()) + "/" + string(method.Name())
+			b.body = r.GetBody()
+			b.response = r.GetResponseBody()
+			b.conn = conn
+			if err := b.check(); err != nil {
+				return fmt.Errorf("%s: %w", method.FullName(), err)
+			}
+
+			template, fields := muxTemplate(path)
+			b.fields = fields
+			router.HandleFunc(template, b.serve).Methods(verb).Name("GRPC gateway " + string(method.Name()))
+		}
+	}
+
+	return nil
+}
+
+// pattern get the HTTP method and path template of a rule
+func pattern(r *annotations.HttpRule) (string, string) {
+	switch p := r.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		return http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		return http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		return http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		return http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		return http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		return p.Custom.GetKind(), p.Custom.GetPath()
+	}
+
+	return "", ""
+}
+
+// check check that the body and response fields of a binding exist
+func (b *binding) check() error {
+	if b.method.IsStreamingClient() && b.body != "*" {
+		return errors.New("client streams need the whole body")
+	}
+	if b.body != "" && b.body != "*" {
+		fd := field(b.method.Input(), b.body)
+		if fd == nil || fd.Kind() != protoreflect.MessageKind || fd.IsList() {
+			return fmt.Errorf("body %q is not a message field", b.body)
+		}
+	}
+	if b.response != "" && field(b.method.Output(), b.response) == nil {
+		return fmt.Errorf("response body %q is not a field", b.response)
+	}
+
+	return nil
+}
+
+// muxTemplate get the mux path template for a rule path and the fields set by
+// its variables. Variables are named v0, v1 and so on in the template since
+// field names can have dots.
+func muxTemplate(path string) (string, []string) {
+	var fields []string
+	template := pathVar.ReplaceAllStringFunc(path, func(v string) string {
+		m := pathVar.FindStringSubmatch(v)
+		pattern := "[^/]+"
+		if m[2] != "" {
+			segments := strings.Split(m[2], "/")
+			for i, s := range segments {
+				switch s {
+				case "*":
+					segments[i] = "[^/]+"
+				case "**":
+					segments[i] = ".+"
+				default:
+					segments[i] = regexp.QuoteMeta(s)
+				}
+			}
+			pattern = strings.Join(segments, "/")
+		}
+		name := fmt.Sprintf("v%d", len(fields))
+		fields = append(fields, m[1])
+
+		return "{" + name + ":" + pattern + "}"
+	})
+
+	return template, fields
+}
+
+// serve call the method for a request
+func (b *binding) serve(w http.ResponseWriter, r *http.Request) {
+	ctx := metadata.NewOutgoingContext(r.Context(), outgoingMetadata(r))
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+
+	if b.method.IsStreamingClient() {
+		b.serveClientStream(w, r, ctx)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		grpcerr.Write(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	in := newMessage(b.method.Input())
+	if err := b.fill(in, r, body); err != nil {
+		grpcerr.Write(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	if b.method.IsStreamingServer() == false {
+		out := newMessage(b.method.Output())
+		if err := b.conn.Invoke(ctx, b.fullMethod, in.Interface(), out.Interface()); err != nil {
+			grpcerr.Write(w, err)
+			return
+		}
+		b.write(w, out)
+		return
+	}
+
+	stream, err := b.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, b.fullMethod)
+	if err != nil {
+		grpcerr.Write(w, err)
+		return
+	}
+	// io.EOF means the server has ended the stream, with a status to receive
+	if err := stream.SendMsg(in.Interface()); err != nil && err != io.EOF {
+		grpcerr.Write(w, err)
+		return
+	}
+	if err := stream.CloseSend(); err != nil {
+		grpcerr.Write(w, err)
+		return
+	}
+	b.writeStream(w, stream)
+}
+
+// serveClientStream call a client streaming method, sending each message in
+// the body as it is read. The HTTP/1 server discards the unread body once a
+// response is written, so HTTP/1 bodies are read in full before the call and
+// only HTTP/2 clients can send messages while receiving them. A message that
+// can not be read ends the call with codes.InvalidArgument.
+func (b *binding) serveClientStream(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	var body io.Reader = r.Body
+	if r.ProtoMajor < 2 {
+		all, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			grpcerr.Write(w, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+		body = bytes.NewReader(all)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cs, err := b.conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: b.method.IsStreamingServer()}, b.fullMethod)
+	if err != nil {
+		grpcerr.Write(w, err)
+		return
+	}
+	stream := &sendingStream{ClientStream: cs, invalid: make(chan error, 1)}
+
+	// Send while receiving so bidirectional streams can go back and forth
+	go func() {
+		if err := b.send(stream, r, body); err != nil {
+			stream.invalid <- status.Error(codes.InvalidArgument, err.Error())
+			cancel()
+			return
+		}
+		stream.CloseSend()
+	}()
+
+	if b.method.IsStreamingServer() {
+		b.writeStream(w, stream)
+		return
+	}
+
+	out := newMessage(b.method.Output())
+	if err := stream.RecvMsg(out.Interface()); err != nil {
+		grpcerr.Write(w, err)
+		return
+	}
+	b.write(w, out)
+}
+
+// send send each message in a body to a stream until the body or the call
+// ends, returning an error for a message that can not be read
+func (b *binding) send(stream grpc.ClientStream, r *http.Request, body io.Reader) error {
+	dec := json.NewDecoder(body)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		in := newMessage(b.method.Input())
+		if err := b.fill(in, r, raw); err != nil {
+			return err
+		}
+		// The call has ended, with a status to receive
+		if err := stream.SendMsg(in.Interface()); err != nil {
+			return nil
+		}
+	}
+}
+
+// sendingStream a client stream sent to from a request body. The call is
+// cancelled if a message in the body can not be read, and receiving gets
+// that error in place of the cancellation.
+type sendingStream struct {
+	grpc.ClientStream
+	invalid chan error
+}
+
+func (s *sendingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		select {
+		case invalid := <-s.invalid:
+			return invalid
+		default:
+		}
+	}
+
+	return err
+}
+
+// fill set the fields of a request from a body and the path variables and
+// query parameters of r. Query parameters are only used when the body is not
+// the whole request.
+func (b *binding) fill(in protoreflect.Message, r *http.Request, body []byte) error {
+	switch {
+	case b.body == "*":
+		if len(strings.TrimSpace(string(body))) > 0 {
+			if err := unmarshal.Unmarshal(body, in.Interface()); err != nil {
+				return fmt.Errorf("body: %w", err)
+			}
+		}
+	case b.body != "":
+		fd := field(in.Descriptor(), b.body)
+		if err := unmarshal.Unmarshal(body, in.Mutable(fd).Message().Interface()); err != nil {
+			return fmt.Errorf("body: %w", err)
+		}
+	}
+
+	vars := mux.Vars(r)
+	for i, path := range b.fields {
+		if err := setField(in, path, []string{vars[fmt.Sprintf("v%d", i)]}); err != nil {
+			return err
+		}
+	}
+
+	if b.body == "*" {
+		return nil
+	}
+	for key, values := range r.URL.Query() {
+		if err := setField(in, key, values); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write write a unary response
+func (b *binding) write(w http.ResponseWriter, out protoreflect.Message) {
+	bytes, err := marshal.Marshal(b.responseOf(out))
+	if err != nil {
+		grpcerr.Write(w, status.Error(codes.Internal, err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+// writeStream write the messages of a server stream as newline delimited
+// JSON. The status is sent with the first message so that a stream that fails
+// straight away gets an error status. Later errors end the stream with an
+// {"error": ...} line.
+func (b *binding) writeStream(w http.ResponseWriter, stream grpc.ClientStream) {
+	flusher, _ := w.(http.Flusher)
+	started := false
+
+	for {
+		out := newMessage(b.method.Output())
+		err := stream.RecvMsg(out.Interface())
+		if err == io.EOF {
+			if started == false {
+				w.Header().Set("Content-Type", ndjsonContentType)
+				w.WriteHeader(http.StatusOK)
+			}
+			return
+		}
+		if err != nil {
+			if started == false {
+				grpcerr.Write(w, err)
+				return
+			}
+			line, _ := json.Marshal(grpcerr.BodyOf(err))
+			w.Write(append(line, '\n'))
+			return
+		}
+
+		bytes, err := marshal.Marshal(b.responseOf(out))
+		if err != nil {
+			bytes, _ = json.Marshal(grpcerr.BodyOf(status.Error(codes.Internal, err.Error())))
+		} else {
+			bytes = []byte(`{"result":` + string(bytes) + "}")
+		}
+
+		if started == false {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		w.Write(append(bytes, '\n'))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// responseOf get the part of a response that is sent
+func (b *binding) responseOf(out protoreflect.Message) proto.Message {
+	if b.response == "" {
+		return out.Interface()
+	}
+
+	fd := field(out.Descriptor(), b.response)
+	if fd.Kind() == protoreflect.MessageKind && fd.IsList() == false && fd.IsMap() == false {
+		return out.Get(fd).Message().Interface()
+	}
+	// Anything else is sent as a message with only that field
+	only := newMessage(out.Descriptor())
+	only.Set(fd, out.Get(fd))
+
+	return only.Interface()
+}
+
+// outgoingMetadata get the GRPC metadata for a request. The X-Forwarded-
+// values are set by the gateway alone, as the server trusts them to identify
+// callers.
+func outgoingMetadata(r *http.Request) metadata.MD {
+	md := metadata.MD{}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, metadataPrefix) == false {
+			continue
+		}
+		name = strings.TrimPrefix(name, metadataPrefix)
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), forwardedPrefix) {
+			continue
+		}
+		md.Append(name, values...)
+	}
+	for _, name := range forwardHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			md.Append(name, values...)
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		md.Set("X-Forwarded-For", host)
+	}
+	md.Set("X-Forwarded-Host", r.Host)
+
+	return md
+}
+
+// newMessage get an empty message, of its generated type if it has one
+func newMessage(md protoreflect.MessageDescriptor) protoreflect.Message {
+	if mt, err := protoregistry.GlobalTypes.FindMessageByName(md.FullName()); err == nil {
+		return mt.New()
+	}
+	return dynamicpb.NewMessage(md)
+}
+
+// field get a field of a message by its dotted path of proto or JSON names,
+// or nil if there is no such field
+func field(md protoreflect.MessageDescriptor, path string) protoreflect.FieldDescriptor {
+	var fd protoreflect.FieldDescriptor
+	for i, name := range strings.Split(path, ".") {
+		if i > 0 {
+			if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+				return nil
+			}
+			md = fd.Message()
+		}
+		fd = md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil
+		}
+	}
+
+	return fd
+}
+
+// setField set a field from its dotted path and values as text. Repeated
+// fields get every value and others the last.
+func setField(m protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		fd := field(m.Descriptor(), name)
+		if fd == nil || fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("%s: no such message field", path)
+		}
+		m = m.Mutable(fd).Message()
+	}
+
+	fd := field(m.Descriptor(), names[len(names)-1])
+	if fd == nil || fd.IsMap() {
+		return fmt.Errorf("%s: no such field", path)
+	}
+
+	if fd.IsList() {
+		list := m.Mutable(fd).List()
+		for _, text := range values {
+			v, err := parseValue(fd, text)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			list.Append(v)
+		}
+		return nil
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+	v, err := parseValue(fd, values[len(values)-1])
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	m.Set(fd, v)
+
+	return nil
+}
+
+// parseValue parse text as a value for a scalar field
+func parseValue(fd protoreflect.FieldDescriptor, text string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(text), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(text)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(text, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(text, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(text, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(text, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(text, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(text, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		return protoreflect.ValueOfBytes([]byte(text)), nil
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(text)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(text, 10, 32)
+		if err != nil || fd.Enum().Values().ByNumber(protoreflect.EnumNumber(v)) == nil {
+			return protoreflect.Value{}, fmt.Errorf("%q is not a %s", text, fd.Enum().Name())
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), nil
+	}
+
+	return protoreflect.Value{}, fmt.Errorf("%s fields can not be set from text", fd.Kind())
+}
@@ -0,0 +1,251 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/imarsman/nanovms/app/grpcerr"
+	"github.com/imarsman/nanovms/app/grpcpass"
+	"github.com/matryer/is"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testService an xkcd service that makes up comics
+type testService struct {
+	grpcpass.UnimplementedXKCDServiceServer
+}
+
+func (s *testService) GetXKCD(ctx context.Context, in *grpcpass.MessageNumber) (*grpcpass.Message, error) {
+	if in.GetNumber() == 404 {
+		return nil, status.Error(codes.NotFound, "no comic 404")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	return &grpcpass.Message{
+		Number: in.GetNumber(),
+		Title:  strings.Join(md.Get("x-request-id"), ","),
+		Alt:    strings.Join(md.Get("x-forwarded-for"), ","),
+	}, nil
+}
+
+func (s *testService) ListXKCD(in *grpcpass.Range, stream grpcpass.XKCDService_ListXKCDServer) error {
+	if in.GetTo() < in.GetFrom() {
+		return status.Error(codes.InvalidArgument, "bad range")
+	}
+	for n := in.GetFrom(); n <= in.GetTo(); n++ {
+		if err := stream.Send(&grpcpass.Message{Number: n}); err != nil {
+			return err
+		}
+	}
+	if in.GetTo() > 100 {
+		return status.Error(codes.Unavailable, "too far")
+	}
+
+	return nil
+}
+
+// SearchXKCD send back the query to show how it was read
+func (s *testService) SearchXKCD(ctx context.Context, in *grpcpass.Query) (*grpcpass.Messages, error) {
+	return &grpcpass.Messages{Messages: []*grpcpass.Message{{
+		Number: in.GetRange().GetFrom(),
+		Title:  in.GetText(),
+	}}}, nil
+}
+
+// Slideshow send a comic with the number of each command
+func (s *testService) Slideshow(stream grpcpass.XKCDService_SlideshowServer) error {
+	for {
+		cmd, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&grpcpass.Message{Number: cmd.GetNumber(), Title: cmd.GetAction().String()}); err != nil {
+			return err
+		}
+	}
+}
+
+// newGateway serve the test service over bufconn and the gateway to it
+func newGateway(t *testing.T) *httptest.Server {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	grpcpass.RegisterXKCDServiceServer(server, &testService{})
+	go server.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	if err := Register(router, conn, grpcpass.Service()); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(router)
+
+	t.Cleanup(func() {
+		ts.Close()
+		conn.Close()
+		server.Stop()
+	})
+
+	return ts
+}
+
+// lines read newline delimited JSON
+func lines(t *testing.T, r io.Reader) []map[string]interface{} {
+	var all []map[string]interface{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("%v in %s", err, scanner.Text())
+		}
+		all = append(all, line)
+	}
+
+	return all
+}
+
+// TestUnary test calling unary methods with path variables, query parameters
+// and bodies
+func TestUnary(t *testing.T) {
+	is := is.New(t)
+	ts := newGateway(t)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/xkcd/7", nil)
+	is.NoErr(err)
+	req.Header.Set("X-Request-Id", "abc")
+	req.Header.Set("Grpc-Metadata-X-Forwarded-For", "203.0.113.9")
+	req.Header.Set("X-Forwarded-For", "203.0.113.10")
+	resp, err := http.DefaultClient.Do(req)
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json"))
+
+	msg := map[string]interface{}{}
+	is.NoErr(json.NewDecoder(resp.Body).Decode(&msg))
+	is.Equal(msg["number"], "7")      // int64 is a string in JSON
+	is.Equal(msg["title"], "abc")     // header passed as metadata
+	is.Equal(msg["alt"], "127.0.0.1") // the real client, not one it names
+	is.Equal(msg["img"], "")          // unset fields included
+
+	resp, err = http.Get(ts.URL + "/v1/xkcd:search?text=island&range.from=3&limit=2")
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	found := map[string][]map[string]interface{}{}
+	is.NoErr(json.NewDecoder(resp.Body).Decode(&found))
+	is.Equal(found["messages"][0]["number"], "3")
+	is.Equal(found["messages"][0]["title"], "island")
+
+	resp, err = http.Post(ts.URL+"/v1/xkcd:search", "application/json", strings.NewReader(`{"text": "tree", "range": {"from": 5, "to": 9}}`))
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	found = map[string][]map[string]interface{}{}
+	is.NoErr(json.NewDecoder(resp.Body).Decode(&found))
+	is.Equal(found["messages"][0]["number"], "5")
+	is.Equal(found["messages"][0]["title"], "tree")
+}
+
+// TestErrors test that GRPC errors and bad requests get HTTP statuses
+func TestErrors(t *testing.T) {
+	is := is.New(t)
+	ts := newGateway(t)
+
+	var tests = []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodGet, "/v1/xkcd/404", "", http.StatusNotFound, "NotFound"},
+		{http.MethodGet, "/v1/xkcd/seven", "", http.StatusBadRequest, "InvalidArgument"},
+		{http.MethodGet, "/v1/xkcd:search?colour=red", "", http.StatusBadRequest, "InvalidArgument"},
+		{http.MethodPost, "/v1/xkcd:search", `{"text": `, http.StatusBadRequest, "InvalidArgument"},
+		{http.MethodPost, "/v1/xkcd:search", `{"colour": "red"}`, http.StatusBadRequest, "InvalidArgument"},
+		{http.MethodGet, "/v1/xkcd?from=5&to=2", "", http.StatusBadRequest, "InvalidArgument"},
+		{http.MethodPost, "/v1/xkcd:search", `{"text": "` + strings.Repeat("a", maxBody) + `"}`, http.StatusBadRequest, "InvalidArgument"},
+		{http.MethodPost, "/v1/xkcd:slideshow", `{"action": "PLAY", "colour": "red"}`, http.StatusBadRequest, "InvalidArgument"},
+		{http.MethodPost, "/v1/xkcd:slideshow", `{"action": `, http.StatusBadRequest, "InvalidArgument"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader(test.body))
+		is.NoErr(err)
+		resp, err := http.DefaultClient.Do(req)
+		is.NoErr(err)
+		defer resp.Body.Close()
+		is.Equal(resp.StatusCode, test.status) // status for path
+
+		body := grpcerr.Body{}
+		is.NoErr(json.NewDecoder(resp.Body).Decode(&body))
+		is.Equal(body.Error.Status, test.status)
+		is.Equal(body.Error.Code, test.code)
+		is.True(body.Error.Message != "")
+	}
+}
+
+// TestStreams test server and bidirectional streams as newline delimited JSON
+func TestStreams(t *testing.T) {
+	is := is.New(t)
+	ts := newGateway(t)
+
+	resp, err := http.Get(ts.URL + "/v1/xkcd?from=1&to=3")
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-ndjson"))
+	results := lines(t, resp.Body)
+	is.Equal(len(results), 3)
+	is.Equal(results[2]["result"].(map[string]interface{})["number"], "3")
+
+	// Errors after the first message end the stream
+	resp, err = http.Get(ts.URL + "/v1/xkcd?from=101&to=102")
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	results = lines(t, resp.Body)
+	is.Equal(len(results), 3)
+	is.Equal(results[2]["error"].(map[string]interface{})["code"], "Unavailable")
+
+	commands := `{"action": "PLAY", "number": 3}
+{"action": "NEXT", "number": 4}
+{"action": "PAUSE", "intervalMs": 100, "number": 5}
+`
+	resp, err = http.Post(ts.URL+"/v1/xkcd:slideshow", "application/x-ndjson", strings.NewReader(commands))
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	results = lines(t, resp.Body)
+	is.Equal(len(results), 3)
+	is.Equal(results[1]["result"].(map[string]interface{})["number"], "4")
+	is.Equal(results[2]["result"].(map[string]interface{})["title"], "PAUSE")
+}
+
+// TestMuxTemplate test turning rule paths into mux templates
+func TestMuxTemplate(t *testing.T) {
+	is := is.New(t)
+
+	template, fields := muxTemplate("/v1/{name=shelves/*}/books/{book.id}:get")
+	is.Equal(template, "/v1/{v0:shelves/[^/]+}/books/{v1:[^/]+}:get")
+	is.Equal(fields, []string{"name", "book.id"})
+}
@@ -0,0 +1,99 @@
+// Package grpcerr writes failed GRPC calls as JSON error responses, for the
+// HTTP handlers that call the GRPC server. The body has the same shape as the
+// errors of the other JSON APIs, with the GRPC code and details added.
+package grpcerr
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const jsonContentType = "application/json; charset=utf-8"
+
+// Body body of an error response. Details are the status details as JSON.
+//
+//	{
+//	  "error": {
+//	    "status": 400,
+//	    "code": "InvalidArgument",
+//	    "message": "range 5 to 2 is not a range of comics"
+//	  }
+//	}
+type Body struct {
+	Error Detail `json:"error"`
+}
+
+// Detail the HTTP status, GRPC code, message and details for an error
+type Detail struct {
+	Status  int               `json:"status"`
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details []json.RawMessage `json:"details,omitempty"`
+}
+
+// HTTPStatus get the HTTP status for a GRPC code. Errors in the request keep
+// their status, as with grpc-gateway, while failures of the GRPC server are a
+// 502 as it is upstream, or a 504 if the call timed out.
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	}
+
+	return http.StatusBadGateway
+}
+
+// BodyOf get the error body for an error, which is treated as a GRPC status
+func BodyOf(err error) *Body {
+	s := status.Convert(err)
+
+	body := Body{}
+	body.Error.Status = HTTPStatus(s.Code())
+	body.Error.Code = s.Code().String()
+	body.Error.Message = s.Message()
+	for _, detail := range s.Proto().GetDetails() {
+		// Details of types not linked in can not be shown
+		if bytes, err := protojson.Marshal(detail); err == nil {
+			body.Error.Details = append(body.Error.Details, bytes)
+		}
+	}
+
+	return &body
+}
+
+// Write write a JSON error response for an error
+func Write(w http.ResponseWriter, err error) {
+	body := BodyOf(err)
+
+	bytes, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(body.Error.Status)
+	w.Write(bytes)
+}
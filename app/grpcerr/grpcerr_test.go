@@ -0,0 +1,45 @@
+package grpcerr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matryer/is"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestWrite test the statuses and bodies written for GRPC errors
+func TestWrite(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(HTTPStatus(codes.InvalidArgument), http.StatusBadRequest)
+	is.Equal(HTTPStatus(codes.Unauthenticated), http.StatusUnauthorized)
+	is.Equal(HTTPStatus(codes.ResourceExhausted), http.StatusTooManyRequests)
+	is.Equal(HTTPStatus(codes.DeadlineExceeded), http.StatusGatewayTimeout)
+	is.Equal(HTTPStatus(codes.Unavailable), http.StatusBadGateway)
+	is.Equal(HTTPStatus(codes.Internal), http.StatusBadGateway)
+
+	s, err := status.New(codes.NotFound, "no comic 404").WithDetails(&errdetails.ResourceInfo{ResourceName: "404"})
+	is.NoErr(err)
+	w := httptest.NewRecorder()
+	Write(w, s.Err())
+	is.Equal(w.Code, http.StatusNotFound)
+	is.Equal(w.Header().Get("Content-Type"), jsonContentType)
+
+	body := Body{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &body))
+	is.Equal(body.Error.Status, http.StatusNotFound)
+	is.Equal(body.Error.Code, "NotFound")
+	is.Equal(body.Error.Message, "no comic 404")
+	is.Equal(len(body.Error.Details), 1)
+
+	// Errors that are not GRPC statuses are failures upstream
+	body = *BodyOf(errors.New("connection refused"))
+	is.Equal(body.Error.Status, http.StatusBadGateway)
+	is.Equal(body.Error.Code, "Unknown")
+}
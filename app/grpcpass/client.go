@@ -0,0 +1,69 @@
+package grpcpass
+
+import (
+	"sync"
+
+	"github.com/imarsman/nanovms/app/creds"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+// backendScheme resolver scheme for the configured GRPC backends
+const backendScheme = "nanovms"
+
+// balancing calls go to each ready backend in turn
+const balancing = `{"loadBalancingConfig": [{"round_robin": {}}]}`
+
+var clientMu sync.Mutex
+var clientConn *grpc.ClientConn // shared by HTTP handlers
+
+// Conn get the connection to the configured GRPC backends shared by HTTP
+// handlers, dialling it on first use. Calls are balanced across the backends
+// with one connection to each, kept alive with pings and remade as needed.
+// Dialling does not wait for the backends, so calls made while none can be
+// reached fail with codes.Unavailable.
+func Conn() (*grpc.ClientConn, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if clientConn != nil {
+		return clientConn, nil
+	}
+
+	backends := manual.NewBuilderWithScheme(backendScheme)
+	backends.InitialState(resolver.State{Addresses: backendAddresses()})
+
+	conn, err := grpc.Dial(backendScheme+":///"+serviceName,
+		grpc.WithResolvers(backends),
+		grpc.WithDefaultServiceConfig(balancing),
+		grpc.WithTransportCredentials(*creds.ClientCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                conf.GRPC.Keepalive.Duration,
+			Timeout:             conf.GRPC.KeepaliveTimeout.Duration,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	clientConn = conn
+
+	return clientConn, nil
+}
+
+// backendAddresses the configured backends, or the GRPC address if none are
+func backendAddresses() []resolver.Address {
+	backends := conf.GRPC.Backends
+	if len(backends) == 0 {
+		backends = []string{conf.GRPC.Address}
+	}
+
+	addresses := make([]resolver.Address, 0, len(backends))
+	for _, backend := range backends {
+		addresses = append(addresses, resolver.Address{Addr: backend})
+	}
+
+	return addresses
+}
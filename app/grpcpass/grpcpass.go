@@ -3,16 +3,27 @@ package grpcpass
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/imarsman/nanovms/app/cache"
+	"github.com/imarsman/nanovms/app/config"
 	"github.com/imarsman/nanovms/app/creds"
+	"github.com/imarsman/nanovms/app/grpcerr"
+	"github.com/imarsman/nanovms/app/interceptor"
+	"github.com/imarsman/nanovms/app/metrics"
+	"github.com/imarsman/nanovms/app/outbound"
 	"github.com/tidwall/gjson"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 const ( // various content types
@@ -22,6 +33,14 @@ const ( // various content types
 )
 
 var grpcServer *grpc.Server
+var healthServer *health.Server
+var conf = config.Default()
+
+// xkcdCache comic info by number
+var xkcdCache = cache.FromConfig("xkcd", conf)
+
+// serviceName full name of the XKCD service, used for health checks
+const serviceName = "grpcpass.XKCDService"
 
 // XKCD a struct to contain the elements of an xkcd image to be used by the app
 type XKCD struct {
@@ -54,42 +73,86 @@ type XKCDService struct {
 	UnimplementedXKCDServiceServer
 }
 
-// GRPCServer get GRPC server
-func GRPCServer() *grpc.Server {
-	return grpcServer
-}
+// GRPCServer get GRPC server, creating it on the first call. The configuration
+// is also used for the HTTP handler client and upstream xkcd calls.
+func GRPCServer(c *config.Config) *grpc.Server {
+	conf = c
+	if grpcServer != nil {
+		return grpcServer
+	}
 
-func init() {
 	// https://grpc.io/docs/languages/go/basics/
 	// https://github.com/grpc/grpc-go/tree/master/examples
 	// var opts []grpc.ServerOption
-	grpcServer = grpc.NewServer(grpc.Creds(*creds.TransportCredentials()))
+	opts := []grpc.ServerOption{
+		grpc.Creds(*creds.TransportCredentials()),
+		// Let clients ping as often as they are allowed to be configured to
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: config.MinKeepalive, PermitWithoutStream: true}),
+	}
+	// Request IDs, logging, recovery, identity, rate limits and metrics
+	opts = append(opts, interceptor.New(c).ServerOptions()...)
+	grpcServer = grpc.NewServer(opts...)
 	// grpcServer = grpc.NewServer()
 
 	RegisterXKCDServiceServer(grpcServer, &XKCDService{})
+
+	// Standard grpc.health.v1 service so the server can be probed the same way
+	// as any other GRPC server
+	healthServer = health.NewServer()
+	healthServer.SetServingStatus(serviceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
 	fmt.Printf("grpc server: %+v\n", grpcServer.GetServiceInfo())
+
+	return grpcServer
 }
 
-// XkcdHandler handler for XKCD data
-func XkcdHandler(w http.ResponseWriter, r *http.Request) {
-	// serverAddr := "localhost:9000"
-	serverAddr := "[::1]:5222"
+// CheckHealth call the health service of the configured GRPC server for the
+// XKCD service
+func CheckHealth(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, conf.GRPC.Address, grpc.WithTransportCredentials(*creds.ClientCredentials()), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: serviceName})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("service status %v", resp.GetStatus())
+	}
 
-	var opts []grpc.DialOption
+	return nil
+}
 
-	opts = append(opts, grpc.WithInsecure())
-	opts = append(opts, grpc.WithBlock())
+// Service the descriptor of the XKCD service, with the HTTP rules of its
+// methods
+func Service() protoreflect.ServiceDescriptor {
+	return File_grpcpass_proto_grpcpass_proto.Services().ByName("XKCDService")
+}
 
+// XkcdHandler handler for XKCD data, calling the GRPC service over the
+// shared connection. Failed calls are a 502, or a 504 if they time out, unless
+// the GRPC code is for a bad request.
+func XkcdHandler(w http.ResponseWriter, r *http.Request) {
 	// Connect with credentials
 	// Currently trying only to use TLS to allow GCP to permit the connection
-	conn, err := grpc.Dial(serverAddr, grpc.WithTransportCredentials(*creds.ClientCredentials()))
+	conn, err := Conn()
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		grpcerr.Write(w, err)
+		return
 	}
 	client := NewXKCDServiceClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Give up when the HTTP client does
+	ctx, cancel := context.WithTimeout(r.Context(), conf.GRPC.CallTimeout.Duration)
 	defer cancel()
+	// Name the HTTP client so it is rate limited on its own
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", host)
+	}
 
 	number := MessageNumber{}
 	number.Number = 0
@@ -97,7 +160,13 @@ func XkcdHandler(w http.ResponseWriter, r *http.Request) {
 	callOption := grpc.MaxCallRecvMsgSize(5000)
 	message, err := client.GetXKCD(ctx, &number, callOption)
 	if err != nil {
-		log.Fatalf("%v.GetXKCD(_) = _, %v: ", client, err)
+		// Nobody is waiting for an answer
+		if r.Context().Err() != nil {
+			return
+		}
+		log.Printf("GetXKCD: %v", err)
+		grpcerr.Write(w, err)
+		return
 	}
 
 	xkcd := NewXKCD()
@@ -113,8 +182,8 @@ func XkcdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Add("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusOK)
 	w.Write(json)
 }
 
@@ -135,12 +204,12 @@ func (s *XKCDService) GetXKCD(ctx context.Context, in *MessageNumber) (*Message,
 
 	num := int(in.GetNumber())
 	if num == 0 {
-		bytes, err = FetchRandomXKCD()
+		bytes, err = FetchRandomXKCD(ctx)
 		if err != nil {
 			return &Message{}, err
 		}
 	} else {
-		bytes, err = FetchXKCD(num)
+		bytes, err = FetchXKCD(ctx, num)
 		if err != nil {
 			return &Message{}, err
 		}
@@ -151,15 +220,18 @@ func (s *XKCDService) GetXKCD(ctx context.Context, in *MessageNumber) (*Message,
 		return &Message{}, err
 	}
 
-	msg := &Message{
+	return xkcd.Message(), nil
+}
+
+// Message get the GRPC message for a comic
+func (xkcd *XKCD) Message() *Message {
+	return &Message{
 		Number: int64(xkcd.Number),
 		Date:   xkcd.Date,
 		Img:    xkcd.Img,
 		Title:  xkcd.Title,
 		Alt:    xkcd.AltText,
 	}
-
-	return msg, nil
 }
 
 /*
@@ -170,26 +242,46 @@ func (s *XKCDService) GetXKCD(ctx context.Context, in *MessageNumber) (*Message,
 */
 
 // FetchRandomXKCD fetch info for a comic for a day from xkcd
-func FetchRandomXKCD() ([]byte, error) {
+func FetchRandomXKCD(ctx context.Context) ([]byte, error) {
+	return FetchXKCD(ctx, randomNumber())
+}
+
+// randomNumber get the number of a random comic from the first 2000
+func randomNumber() int {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	return FetchXKCD(r.Intn(2000) + 1)
+	return r.Intn(2000) + 1
 }
 
-// FetchXKCD fetch info for a comic for a day from xkcd
-func FetchXKCD(num int) ([]byte, error) {
-	if num > 2000 {
+// FetchXKCD fetch info for a comic for a day from xkcd, giving up when the
+// context is done
+func FetchXKCD(ctx context.Context, num int) ([]byte, error) {
+	if num < 1 {
 		return []byte{}, fmt.Errorf("Invalid index %d", num)
 	}
 
-	url := "http://xkcd.com/" + fmt.Sprintf("%v", num) + "/info.0.json"
+	url := conf.Upstream.XKCD + "/" + fmt.Sprintf("%v", num) + "/info.0.json"
+
+	v, err := xkcdCache.Get(ctx, url, func(ctx context.Context) (interface{}, error) {
+		start := time.Now()
+		bytes, err := outbound.Get(ctx, url)
+		metrics.ObserveUpstream("xkcd", start, err)
 
-	resp, err := http.Get(url)
+		return bytes, err
+	})
 	if err != nil {
 		return []byte{}, err
 	}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+	return v.([]byte), nil
+}
+
+// FetchLatestXKCD fetch info for the latest comic from xkcd. It is not cached
+// so that new comics are seen as soon as they are published.
+func FetchLatestXKCD(ctx context.Context) ([]byte, error) {
+	start := time.Now()
+	bytes, err := outbound.Get(ctx, conf.Upstream.XKCD+"/info.0.json")
+	metrics.ObserveUpstream("xkcd", start, err)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -1,12 +1,13 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
 // 	protoc-gen-go v1.27.1
-// 	protoc        v3.17.3
+// 	protoc        (unknown)
 // source: grpcpass/proto/grpcpass.proto
 
 package grpcpass
 
 import (
+	_ "google.golang.org/genproto/googleapis/api/annotations"
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
 	reflect "reflect"
@@ -20,6 +21,58 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type SlideshowCommand_Action int32
+
+const (
+	SlideshowCommand_PLAY     SlideshowCommand_Action = 0 // show the next comic every interval
+	SlideshowCommand_PAUSE    SlideshowCommand_Action = 1 // stop until told to play or step
+	SlideshowCommand_NEXT     SlideshowCommand_Action = 2 // show the next comic now
+	SlideshowCommand_PREVIOUS SlideshowCommand_Action = 3 // show the previous comic now
+)
+
+// Enum value maps for SlideshowCommand_Action.
+var (
+	SlideshowCommand_Action_name = map[int32]string{
+		0: "PLAY",
+		1: "PAUSE",
+		2: "NEXT",
+		3: "PREVIOUS",
+	}
+	SlideshowCommand_Action_value = map[string]int32{
+		"PLAY":     0,
+		"PAUSE":    1,
+		"NEXT":     2,
+		"PREVIOUS": 3,
+	}
+)
+
+func (x SlideshowCommand_Action) Enum() *SlideshowCommand_Action {
+	p := new(SlideshowCommand_Action)
+	*p = x
+	return p
+}
+
+func (x SlideshowCommand_Action) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (SlideshowCommand_Action) Descriptor() protoreflect.EnumDescriptor {
+	return file_grpcpass_proto_grpcpass_proto_enumTypes[0].Descriptor()
+}
+
+func (SlideshowCommand_Action) Type() protoreflect.EnumType {
+	return &file_grpcpass_proto_grpcpass_proto_enumTypes[0]
+}
+
+func (x SlideshowCommand_Action) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use SlideshowCommand_Action.Descriptor instead.
+func (SlideshowCommand_Action) EnumDescriptor() ([]byte, []int) {
+	return file_grpcpass_proto_grpcpass_proto_rawDescGZIP(), []int{6, 0}
+}
+
 type Message struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -146,28 +199,359 @@ func (x *MessageNumber) GetNumber() int64 {
 	return 0
 }
 
+// Range comics from one number to another, both included
+type Range struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From int64 `protobuf:"varint,1,opt,name=from,proto3" json:"from,omitempty"`
+	To   int64 `protobuf:"varint,2,opt,name=to,proto3" json:"to,omitempty"`
+}
+
+func (x *Range) Reset() {
+	*x = Range{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Range) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Range) ProtoMessage() {}
+
+func (x *Range) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Range.ProtoReflect.Descriptor instead.
+func (*Range) Descriptor() ([]byte, []int) {
+	return file_grpcpass_proto_grpcpass_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Range) GetFrom() int64 {
+	if x != nil {
+		return x.From
+	}
+	return 0
+}
+
+func (x *Range) GetTo() int64 {
+	if x != nil {
+		return x.To
+	}
+	return 0
+}
+
+// WatchRequest the latest comic the client has, 0 for none
+type WatchRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	After int64 `protobuf:"varint,1,opt,name=after,proto3" json:"after,omitempty"`
+}
+
+func (x *WatchRequest) Reset() {
+	*x = WatchRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRequest) ProtoMessage() {}
+
+func (x *WatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRequest.ProtoReflect.Descriptor instead.
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return file_grpcpass_proto_grpcpass_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *WatchRequest) GetAfter() int64 {
+	if x != nil {
+		return x.After
+	}
+	return 0
+}
+
+// Query words to find in comic titles and alt text, within a range of comics.
+// The most recent comics are searched if the range is empty.
+type Query struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Text  string `protobuf:"bytes,1,opt,name=text,proto3" json:"text,omitempty"`
+	Range *Range `protobuf:"bytes,2,opt,name=range,proto3" json:"range,omitempty"`
+	Limit int32  `protobuf:"varint,3,opt,name=limit,proto3" json:"limit,omitempty"`
+}
+
+func (x *Query) Reset() {
+	*x = Query{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Query) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Query) ProtoMessage() {}
+
+func (x *Query) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Query.ProtoReflect.Descriptor instead.
+func (*Query) Descriptor() ([]byte, []int) {
+	return file_grpcpass_proto_grpcpass_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Query) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *Query) GetRange() *Range {
+	if x != nil {
+		return x.Range
+	}
+	return nil
+}
+
+func (x *Query) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type Messages struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Messages []*Message `protobuf:"bytes,1,rep,name=messages,proto3" json:"messages,omitempty"`
+}
+
+func (x *Messages) Reset() {
+	*x = Messages{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Messages) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Messages) ProtoMessage() {}
+
+func (x *Messages) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Messages.ProtoReflect.Descriptor instead.
+func (*Messages) Descriptor() ([]byte, []int) {
+	return file_grpcpass_proto_grpcpass_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Messages) GetMessages() []*Message {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+// SlideshowCommand change what a slideshow is doing
+type SlideshowCommand struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Action     SlideshowCommand_Action `protobuf:"varint,1,opt,name=action,proto3,enum=grpcpass.SlideshowCommand_Action" json:"action,omitempty"`
+	IntervalMs int64                   `protobuf:"varint,2,opt,name=interval_ms,json=intervalMs,proto3" json:"interval_ms,omitempty"` // time between comics while playing, if set
+	Number     int64                   `protobuf:"varint,3,opt,name=number,proto3" json:"number,omitempty"`                           // comic to go to, if set
+}
+
+func (x *SlideshowCommand) Reset() {
+	*x = SlideshowCommand{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SlideshowCommand) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SlideshowCommand) ProtoMessage() {}
+
+func (x *SlideshowCommand) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcpass_proto_grpcpass_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SlideshowCommand.ProtoReflect.Descriptor instead.
+func (*SlideshowCommand) Descriptor() ([]byte, []int) {
+	return file_grpcpass_proto_grpcpass_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *SlideshowCommand) GetAction() SlideshowCommand_Action {
+	if x != nil {
+		return x.Action
+	}
+	return SlideshowCommand_PLAY
+}
+
+func (x *SlideshowCommand) GetIntervalMs() int64 {
+	if x != nil {
+		return x.IntervalMs
+	}
+	return 0
+}
+
+func (x *SlideshowCommand) GetNumber() int64 {
+	if x != nil {
+		return x.Number
+	}
+	return 0
+}
+
 var File_grpcpass_proto_grpcpass_proto protoreflect.FileDescriptor
 
 var file_grpcpass_proto_grpcpass_proto_rawDesc = []byte{
 	0x0a, 0x1d, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f,
 	0x2f, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
-	0x08, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x22, 0x6f, 0x0a, 0x07, 0x4d, 0x65, 0x73,
-	0x73, 0x61, 0x67, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04,
-	0x64, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x64, 0x61, 0x74, 0x65,
-	0x12, 0x10, 0x0a, 0x03, 0x69, 0x6d, 0x67, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x69,
-	0x6d, 0x67, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x69, 0x74, 0x6c, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28,
-	0x09, 0x52, 0x05, 0x74, 0x69, 0x74, 0x6c, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x61, 0x6c, 0x74, 0x18,
-	0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x61, 0x6c, 0x74, 0x22, 0x27, 0x0a, 0x0d, 0x4d, 0x65,
-	0x73, 0x73, 0x61, 0x67, 0x65, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12, 0x16, 0x0a, 0x06, 0x6e,
-	0x75, 0x6d, 0x62, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6e, 0x75, 0x6d,
-	0x62, 0x65, 0x72, 0x32, 0x46, 0x0a, 0x0b, 0x58, 0x4b, 0x43, 0x44, 0x53, 0x65, 0x72, 0x76, 0x69,
-	0x63, 0x65, 0x12, 0x37, 0x0a, 0x07, 0x47, 0x65, 0x74, 0x58, 0x4b, 0x43, 0x44, 0x12, 0x17, 0x2e,
+	0x08, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x1a, 0x1c, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x6f, 0x0a, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61,
+	0x67, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x06, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61,
+	0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x64, 0x61, 0x74, 0x65, 0x12, 0x10,
+	0x0a, 0x03, 0x69, 0x6d, 0x67, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x69, 0x6d, 0x67,
+	0x12, 0x14, 0x0a, 0x05, 0x74, 0x69, 0x74, 0x6c, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x74, 0x69, 0x74, 0x6c, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x61, 0x6c, 0x74, 0x18, 0x05, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x03, 0x61, 0x6c, 0x74, 0x22, 0x27, 0x0a, 0x0d, 0x4d, 0x65, 0x73, 0x73,
+	0x61, 0x67, 0x65, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12, 0x16, 0x0a, 0x06, 0x6e, 0x75, 0x6d,
+	0x62, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6e, 0x75, 0x6d, 0x62, 0x65,
+	0x72, 0x22, 0x2b, 0x0a, 0x05, 0x52, 0x61, 0x6e, 0x67, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72,
+	0x6f, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x0e,
+	0x0a, 0x02, 0x74, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x74, 0x6f, 0x22, 0x24,
+	0x0a, 0x0c, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x14,
+	0x0a, 0x05, 0x61, 0x66, 0x74, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x61,
+	0x66, 0x74, 0x65, 0x72, 0x22, 0x58, 0x0a, 0x05, 0x51, 0x75, 0x65, 0x72, 0x79, 0x12, 0x12, 0x0a,
+	0x04, 0x74, 0x65, 0x78, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x65, 0x78,
+	0x74, 0x12, 0x25, 0x0a, 0x05, 0x72, 0x61, 0x6e, 0x67, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x0f, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x52, 0x61, 0x6e, 0x67,
+	0x65, 0x52, 0x05, 0x72, 0x61, 0x6e, 0x67, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x69, 0x6d, 0x69,
+	0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x22, 0x39,
+	0x0a, 0x08, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x12, 0x2d, 0x0a, 0x08, 0x6d, 0x65,
+	0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x67,
+	0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x52,
+	0x08, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x22, 0xbd, 0x01, 0x0a, 0x10, 0x53, 0x6c,
+	0x69, 0x64, 0x65, 0x73, 0x68, 0x6f, 0x77, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x12, 0x39,
+	0x0a, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x21,
+	0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x53, 0x6c, 0x69, 0x64, 0x65, 0x73,
+	0x68, 0x6f, 0x77, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x2e, 0x41, 0x63, 0x74, 0x69, 0x6f,
+	0x6e, 0x52, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x69, 0x6e, 0x74,
+	0x65, 0x72, 0x76, 0x61, 0x6c, 0x5f, 0x6d, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a,
+	0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x4d, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x6e, 0x75,
+	0x6d, 0x62, 0x65, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6e, 0x75, 0x6d, 0x62,
+	0x65, 0x72, 0x22, 0x35, 0x0a, 0x06, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x08, 0x0a, 0x04,
+	0x50, 0x4c, 0x41, 0x59, 0x10, 0x00, 0x12, 0x09, 0x0a, 0x05, 0x50, 0x41, 0x55, 0x53, 0x45, 0x10,
+	0x01, 0x12, 0x08, 0x0a, 0x04, 0x4e, 0x45, 0x58, 0x54, 0x10, 0x02, 0x12, 0x0c, 0x0a, 0x08, 0x50,
+	0x52, 0x45, 0x56, 0x49, 0x4f, 0x55, 0x53, 0x10, 0x03, 0x32, 0xb8, 0x03, 0x0a, 0x0b, 0x58, 0x4b,
+	0x43, 0x44, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x50, 0x0a, 0x07, 0x47, 0x65, 0x74,
+	0x58, 0x4b, 0x43, 0x44, 0x12, 0x17, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e,
+	0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x1a, 0x11, 0x2e,
 	0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
-	0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x1a, 0x11, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73,
-	0x73, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x00, 0x42, 0x0d, 0x5a, 0x0b, 0x2e,
-	0x2e, 0x3b, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x33,
+	0x22, 0x19, 0x82, 0xd3, 0xe4, 0x93, 0x02, 0x13, 0x12, 0x11, 0x2f, 0x76, 0x31, 0x2f, 0x78, 0x6b,
+	0x63, 0x64, 0x2f, 0x7b, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x7d, 0x12, 0x42, 0x0a, 0x08, 0x4c,
+	0x69, 0x73, 0x74, 0x58, 0x4b, 0x43, 0x44, 0x12, 0x0f, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61,
+	0x73, 0x73, 0x2e, 0x52, 0x61, 0x6e, 0x67, 0x65, 0x1a, 0x11, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70,
+	0x61, 0x73, 0x73, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x10, 0x82, 0xd3, 0xe4,
+	0x93, 0x02, 0x0a, 0x12, 0x08, 0x2f, 0x76, 0x31, 0x2f, 0x78, 0x6b, 0x63, 0x64, 0x30, 0x01, 0x12,
+	0x52, 0x0a, 0x0b, 0x57, 0x61, 0x74, 0x63, 0x68, 0x4c, 0x61, 0x74, 0x65, 0x73, 0x74, 0x12, 0x16,
+	0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x11, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73,
+	0x73, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x16, 0x82, 0xd3, 0xe4, 0x93, 0x02,
+	0x10, 0x12, 0x0e, 0x2f, 0x76, 0x31, 0x2f, 0x78, 0x6b, 0x63, 0x64, 0x3a, 0x77, 0x61, 0x74, 0x63,
+	0x68, 0x30, 0x01, 0x12, 0x60, 0x0a, 0x0a, 0x53, 0x65, 0x61, 0x72, 0x63, 0x68, 0x58, 0x4b, 0x43,
+	0x44, 0x12, 0x0f, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x51, 0x75, 0x65,
+	0x72, 0x79, 0x1a, 0x12, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x4d, 0x65,
+	0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x22, 0x2d, 0x82, 0xd3, 0xe4, 0x93, 0x02, 0x27, 0x5a, 0x14,
+	0x3a, 0x01, 0x2a, 0x22, 0x0f, 0x2f, 0x76, 0x31, 0x2f, 0x78, 0x6b, 0x63, 0x64, 0x3a, 0x73, 0x65,
+	0x61, 0x72, 0x63, 0x68, 0x12, 0x0f, 0x2f, 0x76, 0x31, 0x2f, 0x78, 0x6b, 0x63, 0x64, 0x3a, 0x73,
+	0x65, 0x61, 0x72, 0x63, 0x68, 0x12, 0x5d, 0x0a, 0x09, 0x53, 0x6c, 0x69, 0x64, 0x65, 0x73, 0x68,
+	0x6f, 0x77, 0x12, 0x1a, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x53, 0x6c,
+	0x69, 0x64, 0x65, 0x73, 0x68, 0x6f, 0x77, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x1a, 0x11,
+	0x2e, 0x67, 0x72, 0x70, 0x63, 0x70, 0x61, 0x73, 0x73, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67,
+	0x65, 0x22, 0x1d, 0x82, 0xd3, 0xe4, 0x93, 0x02, 0x17, 0x3a, 0x01, 0x2a, 0x22, 0x12, 0x2f, 0x76,
+	0x31, 0x2f, 0x78, 0x6b, 0x63, 0x64, 0x3a, 0x73, 0x6c, 0x69, 0x64, 0x65, 0x73, 0x68, 0x6f, 0x77,
+	0x28, 0x01, 0x30, 0x01, 0x42, 0x0d, 0x5a, 0x0b, 0x2e, 0x2e, 0x3b, 0x67, 0x72, 0x70, 0x63, 0x70,
+	0x61, 0x73, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -182,19 +566,37 @@ func file_grpcpass_proto_grpcpass_proto_rawDescGZIP() []byte {
 	return file_grpcpass_proto_grpcpass_proto_rawDescData
 }
 
-var file_grpcpass_proto_grpcpass_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_grpcpass_proto_grpcpass_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_grpcpass_proto_grpcpass_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
 var file_grpcpass_proto_grpcpass_proto_goTypes = []interface{}{
-	(*Message)(nil),       // 0: grpcpass.Message
-	(*MessageNumber)(nil), // 1: grpcpass.MessageNumber
+	(SlideshowCommand_Action)(0), // 0: grpcpass.SlideshowCommand.Action
+	(*Message)(nil),              // 1: grpcpass.Message
+	(*MessageNumber)(nil),        // 2: grpcpass.MessageNumber
+	(*Range)(nil),                // 3: grpcpass.Range
+	(*WatchRequest)(nil),         // 4: grpcpass.WatchRequest
+	(*Query)(nil),                // 5: grpcpass.Query
+	(*Messages)(nil),             // 6: grpcpass.Messages
+	(*SlideshowCommand)(nil),     // 7: grpcpass.SlideshowCommand
 }
 var file_grpcpass_proto_grpcpass_proto_depIdxs = []int32{
-	1, // 0: grpcpass.XKCDService.GetXKCD:input_type -> grpcpass.MessageNumber
-	0, // 1: grpcpass.XKCDService.GetXKCD:output_type -> grpcpass.Message
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	3, // 0: grpcpass.Query.range:type_name -> grpcpass.Range
+	1, // 1: grpcpass.Messages.messages:type_name -> grpcpass.Message
+	0, // 2: grpcpass.SlideshowCommand.action:type_name -> grpcpass.SlideshowCommand.Action
+	2, // 3: grpcpass.XKCDService.GetXKCD:input_type -> grpcpass.MessageNumber
+	3, // 4: grpcpass.XKCDService.ListXKCD:input_type -> grpcpass.Range
+	4, // 5: grpcpass.XKCDService.WatchLatest:input_type -> grpcpass.WatchRequest
+	5, // 6: grpcpass.XKCDService.SearchXKCD:input_type -> grpcpass.Query
+	7, // 7: grpcpass.XKCDService.Slideshow:input_type -> grpcpass.SlideshowCommand
+	1, // 8: grpcpass.XKCDService.GetXKCD:output_type -> grpcpass.Message
+	1, // 9: grpcpass.XKCDService.ListXKCD:output_type -> grpcpass.Message
+	1, // 10: grpcpass.XKCDService.WatchLatest:output_type -> grpcpass.Message
+	6, // 11: grpcpass.XKCDService.SearchXKCD:output_type -> grpcpass.Messages
+	1, // 12: grpcpass.XKCDService.Slideshow:output_type -> grpcpass.Message
+	8, // [8:13] is the sub-list for method output_type
+	3, // [3:8] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_grpcpass_proto_grpcpass_proto_init() }
@@ -227,19 +629,80 @@ func file_grpcpass_proto_grpcpass_proto_init() {
 				return nil
 			}
 		}
+		file_grpcpass_proto_grpcpass_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Range); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcpass_proto_grpcpass_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcpass_proto_grpcpass_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Query); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcpass_proto_grpcpass_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Messages); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcpass_proto_grpcpass_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SlideshowCommand); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_grpcpass_proto_grpcpass_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   2,
+			NumEnums:      1,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_grpcpass_proto_grpcpass_proto_goTypes,
 		DependencyIndexes: file_grpcpass_proto_grpcpass_proto_depIdxs,
+		EnumInfos:         file_grpcpass_proto_grpcpass_proto_enumTypes,
 		MessageInfos:      file_grpcpass_proto_grpcpass_proto_msgTypes,
 	}.Build()
 	File_grpcpass_proto_grpcpass_proto = out.File
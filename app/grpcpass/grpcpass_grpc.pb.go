@@ -18,7 +18,16 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type XKCDServiceClient interface {
+	// GetXKCD get a comic, or a random one for number 0
 	GetXKCD(ctx context.Context, in *MessageNumber, opts ...grpc.CallOption) (*Message, error)
+	// ListXKCD send each comic in a range in order
+	ListXKCD(ctx context.Context, in *Range, opts ...grpc.CallOption) (XKCDService_ListXKCDClient, error)
+	// WatchLatest send the latest comic whenever a new one appears
+	WatchLatest(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (XKCDService_WatchLatestClient, error)
+	// SearchXKCD find comics by title and alt text, best first
+	SearchXKCD(ctx context.Context, in *Query, opts ...grpc.CallOption) (*Messages, error)
+	// Slideshow send comics at a pace controlled by commands from the client
+	Slideshow(ctx context.Context, opts ...grpc.CallOption) (XKCDService_SlideshowClient, error)
 }
 
 type xKCDServiceClient struct {
@@ -38,11 +47,124 @@ func (c *xKCDServiceClient) GetXKCD(ctx context.Context, in *MessageNumber, opts
 	return out, nil
 }
 
+func (c *xKCDServiceClient) ListXKCD(ctx context.Context, in *Range, opts ...grpc.CallOption) (XKCDService_ListXKCDClient, error) {
+	stream, err := c.cc.NewStream(ctx, &XKCDService_ServiceDesc.Streams[0], "/grpcpass.XKCDService/ListXKCD", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &xKCDServiceListXKCDClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type XKCDService_ListXKCDClient interface {
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type xKCDServiceListXKCDClient struct {
+	grpc.ClientStream
+}
+
+func (x *xKCDServiceListXKCDClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *xKCDServiceClient) WatchLatest(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (XKCDService_WatchLatestClient, error) {
+	stream, err := c.cc.NewStream(ctx, &XKCDService_ServiceDesc.Streams[1], "/grpcpass.XKCDService/WatchLatest", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &xKCDServiceWatchLatestClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type XKCDService_WatchLatestClient interface {
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type xKCDServiceWatchLatestClient struct {
+	grpc.ClientStream
+}
+
+func (x *xKCDServiceWatchLatestClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *xKCDServiceClient) SearchXKCD(ctx context.Context, in *Query, opts ...grpc.CallOption) (*Messages, error) {
+	out := new(Messages)
+	err := c.cc.Invoke(ctx, "/grpcpass.XKCDService/SearchXKCD", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *xKCDServiceClient) Slideshow(ctx context.Context, opts ...grpc.CallOption) (XKCDService_SlideshowClient, error) {
+	stream, err := c.cc.NewStream(ctx, &XKCDService_ServiceDesc.Streams[2], "/grpcpass.XKCDService/Slideshow", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &xKCDServiceSlideshowClient{stream}
+	return x, nil
+}
+
+type XKCDService_SlideshowClient interface {
+	Send(*SlideshowCommand) error
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type xKCDServiceSlideshowClient struct {
+	grpc.ClientStream
+}
+
+func (x *xKCDServiceSlideshowClient) Send(m *SlideshowCommand) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *xKCDServiceSlideshowClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // XKCDServiceServer is the server API for XKCDService service.
 // All implementations must embed UnimplementedXKCDServiceServer
 // for forward compatibility
 type XKCDServiceServer interface {
+	// GetXKCD get a comic, or a random one for number 0
 	GetXKCD(context.Context, *MessageNumber) (*Message, error)
+	// ListXKCD send each comic in a range in order
+	ListXKCD(*Range, XKCDService_ListXKCDServer) error
+	// WatchLatest send the latest comic whenever a new one appears
+	WatchLatest(*WatchRequest, XKCDService_WatchLatestServer) error
+	// SearchXKCD find comics by title and alt text, best first
+	SearchXKCD(context.Context, *Query) (*Messages, error)
+	// Slideshow send comics at a pace controlled by commands from the client
+	Slideshow(XKCDService_SlideshowServer) error
 	mustEmbedUnimplementedXKCDServiceServer()
 }
 
@@ -53,6 +175,18 @@ type UnimplementedXKCDServiceServer struct {
 func (UnimplementedXKCDServiceServer) GetXKCD(context.Context, *MessageNumber) (*Message, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetXKCD not implemented")
 }
+func (UnimplementedXKCDServiceServer) ListXKCD(*Range, XKCDService_ListXKCDServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListXKCD not implemented")
+}
+func (UnimplementedXKCDServiceServer) WatchLatest(*WatchRequest, XKCDService_WatchLatestServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchLatest not implemented")
+}
+func (UnimplementedXKCDServiceServer) SearchXKCD(context.Context, *Query) (*Messages, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchXKCD not implemented")
+}
+func (UnimplementedXKCDServiceServer) Slideshow(XKCDService_SlideshowServer) error {
+	return status.Errorf(codes.Unimplemented, "method Slideshow not implemented")
+}
 func (UnimplementedXKCDServiceServer) mustEmbedUnimplementedXKCDServiceServer() {}
 
 // UnsafeXKCDServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -84,6 +218,92 @@ func _XKCDService_GetXKCD_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _XKCDService_ListXKCD_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Range)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(XKCDServiceServer).ListXKCD(m, &xKCDServiceListXKCDServer{stream})
+}
+
+type XKCDService_ListXKCDServer interface {
+	Send(*Message) error
+	grpc.ServerStream
+}
+
+type xKCDServiceListXKCDServer struct {
+	grpc.ServerStream
+}
+
+func (x *xKCDServiceListXKCDServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _XKCDService_WatchLatest_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(XKCDServiceServer).WatchLatest(m, &xKCDServiceWatchLatestServer{stream})
+}
+
+type XKCDService_WatchLatestServer interface {
+	Send(*Message) error
+	grpc.ServerStream
+}
+
+type xKCDServiceWatchLatestServer struct {
+	grpc.ServerStream
+}
+
+func (x *xKCDServiceWatchLatestServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _XKCDService_SearchXKCD_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Query)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(XKCDServiceServer).SearchXKCD(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpcpass.XKCDService/SearchXKCD",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(XKCDServiceServer).SearchXKCD(ctx, req.(*Query))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _XKCDService_Slideshow_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(XKCDServiceServer).Slideshow(&xKCDServiceSlideshowServer{stream})
+}
+
+type XKCDService_SlideshowServer interface {
+	Send(*Message) error
+	Recv() (*SlideshowCommand, error)
+	grpc.ServerStream
+}
+
+type xKCDServiceSlideshowServer struct {
+	grpc.ServerStream
+}
+
+func (x *xKCDServiceSlideshowServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *xKCDServiceSlideshowServer) Recv() (*SlideshowCommand, error) {
+	m := new(SlideshowCommand)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // XKCDService_ServiceDesc is the grpc.ServiceDesc for XKCDService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -95,7 +315,28 @@ var XKCDService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetXKCD",
 			Handler:    _XKCDService_GetXKCD_Handler,
 		},
+		{
+			MethodName: "SearchXKCD",
+			Handler:    _XKCDService_SearchXKCD_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListXKCD",
+			Handler:       _XKCDService_ListXKCD_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchLatest",
+			Handler:       _XKCDService_WatchLatest_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Slideshow",
+			Handler:       _XKCDService_Slideshow_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "grpcpass/proto/grpcpass.proto",
 }
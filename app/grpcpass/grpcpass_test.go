@@ -1,16 +1,35 @@
 package grpcpass
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/creds"
+	"github.com/imarsman/nanovms/app/grpcerr"
 	"github.com/matryer/is"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 // TestCall test call for numbered cartoon
 func TestCall(t *testing.T) {
 	is := is.New(t)
 
-	bytes, err := FetchXKCD(1001)
+	bytes, err := FetchXKCD(context.Background(), 1001)
 	is.NoErr(err)
 	is.True(len(bytes) > 0)
 
@@ -26,7 +45,7 @@ func TestCall(t *testing.T) {
 func TestCallRandom(t *testing.T) {
 	is := is.New(t)
 
-	bytes, err := FetchRandomXKCD()
+	bytes, err := FetchRandomXKCD(context.Background())
 	is.NoErr(err)
 	is.True(len(bytes) > 0)
 
@@ -37,3 +56,333 @@ func TestCallRandom(t *testing.T) {
 
 	t.Logf("%+v", xkcd)
 }
+
+// TestHealth test the grpc.health.v1 service on the configured server
+func TestHealth(t *testing.T) {
+	is := is.New(t)
+
+	c := config.Default()
+	c.GRPC.Address = "127.0.0.1:15222"
+	server := GRPCServer(c)
+
+	lis, err := net.Listen("tcp", c.GRPC.Address)
+	is.NoErr(err)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	is.NoErr(CheckHealth(ctx))
+}
+
+// fakeComics titles and alt text of comics served by serveXKCD. Other comics
+// are "Comic n", and comic 4 is missing.
+var fakeComics = map[int64][2]string{
+	3: {"Island (sketch)", "Hello, island"},
+	5: {"Blown apart", "Trees and islands"},
+}
+
+// serveXKCD serve comics 1 to latest as xkcd does and the service over
+// bufconn, returning a client for it
+func serveXKCD(t *testing.T, latest *int64) XKCDServiceClient {
+	fakeXKCD(t, latest)
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	RegisterXKCDServiceServer(server, &XKCDService{})
+	go server.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+
+	return NewXKCDServiceClient(conn)
+}
+
+// fakeXKCD serve comics 1 to latest as xkcd does, as the configured upstream
+func fakeXKCD(t *testing.T, latest *int64) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		number := atomic.LoadInt64(latest)
+		if r.URL.Path != "/info.0.json" {
+			n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/info.0.json"), 10, 64)
+			if err != nil || n < 1 || n > number || n == 4 {
+				http.NotFound(w, r)
+				return
+			}
+			number = n
+		}
+
+		text, ok := fakeComics[number]
+		if ok == false {
+			text = [2]string{fmt.Sprintf("Comic %d", number), fmt.Sprintf("Alt %d", number)}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"num": number, "safe_title": text[0], "alt": text[1], "year": "2020", "month": "1", "day": "2",
+		})
+	}))
+
+	previous := conf
+	conf = config.Default()
+	conf.Upstream.XKCD = upstream.URL
+
+	t.Cleanup(func() {
+		upstream.Close()
+		conf = previous
+	})
+}
+
+// TestListXKCD test streaming a range of comics
+func TestListXKCD(t *testing.T) {
+	is := is.New(t)
+
+	latest := int64(10)
+	client := serveXKCD(t, &latest)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.ListXKCD(ctx, &Range{From: 1, To: 6})
+	is.NoErr(err)
+	var numbers []int64
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		is.NoErr(err)
+		numbers = append(numbers, msg.GetNumber())
+	}
+	is.Equal(numbers, []int64{1, 2, 3, 5, 6}) // missing comic skipped
+
+	for _, r := range []*Range{{From: 5, To: 2}, {From: 0, To: 2}, {From: 1, To: 200}} {
+		stream, err := client.ListXKCD(ctx, r)
+		is.NoErr(err)
+		_, err = stream.Recv()
+		is.Equal(status.Code(err), codes.InvalidArgument)
+	}
+}
+
+// TestWatchLatest test being sent new comics as they appear
+func TestWatchLatest(t *testing.T) {
+	is := is.New(t)
+
+	interval := watchInterval
+	watchInterval = 20 * time.Millisecond
+	defer func() { watchInterval = interval }()
+
+	latest := int64(10)
+	client := serveXKCD(t, &latest)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchLatest(ctx, &WatchRequest{After: 9})
+	is.NoErr(err)
+	msg, err := stream.Recv()
+	is.NoErr(err)
+	is.Equal(msg.GetNumber(), int64(10))
+
+	atomic.StoreInt64(&latest, 11)
+	msg, err = stream.Recv()
+	is.NoErr(err)
+	is.Equal(msg.GetNumber(), int64(11))
+
+	// Nothing is sent until there is a comic newer than the client's
+	stream, err = client.WatchLatest(ctx, &WatchRequest{After: 11})
+	is.NoErr(err)
+	time.AfterFunc(100*time.Millisecond, func() { atomic.StoreInt64(&latest, 12) })
+	msg, err = stream.Recv()
+	is.NoErr(err)
+	is.Equal(msg.GetNumber(), int64(12))
+}
+
+// TestSearchXKCD test searching comic titles and alt text
+func TestSearchXKCD(t *testing.T) {
+	is := is.New(t)
+
+	latest := int64(10)
+	client := serveXKCD(t, &latest)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	found, err := client.SearchXKCD(ctx, &Query{Text: "island"})
+	is.NoErr(err)
+	is.Equal(len(found.GetMessages()), 2)
+	is.Equal(found.GetMessages()[0].GetNumber(), int64(3)) // title match first
+	is.Equal(found.GetMessages()[1].GetNumber(), int64(5))
+
+	found, err = client.SearchXKCD(ctx, &Query{Text: `"blown apart"`})
+	is.NoErr(err)
+	is.Equal(len(found.GetMessages()), 1)
+	is.Equal(found.GetMessages()[0].GetTitle(), "Blown apart")
+
+	found, err = client.SearchXKCD(ctx, &Query{Text: "island", Limit: 1})
+	is.NoErr(err)
+	is.Equal(len(found.GetMessages()), 1)
+
+	found, err = client.SearchXKCD(ctx, &Query{Text: "island", Range: &Range{From: 4, To: 10}})
+	is.NoErr(err)
+	is.Equal(len(found.GetMessages()), 1)
+	is.Equal(found.GetMessages()[0].GetNumber(), int64(5))
+
+	_, err = client.SearchXKCD(ctx, &Query{Text: "  "})
+	is.Equal(status.Code(err), codes.InvalidArgument)
+	_, err = client.SearchXKCD(ctx, &Query{Text: "island", Range: &Range{From: 1, To: 1000}})
+	is.Equal(status.Code(err), codes.InvalidArgument)
+}
+
+// TestSlideshow test playing, pausing and stepping through comics
+func TestSlideshow(t *testing.T) {
+	is := is.New(t)
+
+	latest := int64(10)
+	client := serveXKCD(t, &latest)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Slideshow(ctx)
+	is.NoErr(err)
+
+	next := func() int64 {
+		msg, err := stream.Recv()
+		is.NoErr(err)
+		return msg.GetNumber()
+	}
+
+	is.NoErr(stream.Send(&SlideshowCommand{Action: SlideshowCommand_PLAY, Number: 3, IntervalMs: 200}))
+	is.Equal(next(), int64(3))
+	is.Equal(next(), int64(5)) // played on, past the missing comic
+
+	is.NoErr(stream.Send(&SlideshowCommand{Action: SlideshowCommand_PAUSE}))
+	is.NoErr(stream.Send(&SlideshowCommand{Action: SlideshowCommand_NEXT}))
+	is.Equal(next(), int64(6))
+	is.NoErr(stream.Send(&SlideshowCommand{Action: SlideshowCommand_PREVIOUS}))
+	is.Equal(next(), int64(5))
+	is.NoErr(stream.Send(&SlideshowCommand{Action: SlideshowCommand_PREVIOUS}))
+	is.Equal(next(), int64(3))
+	is.NoErr(stream.Send(&SlideshowCommand{Action: SlideshowCommand_NEXT, Number: 10}))
+	is.Equal(next(), int64(10))
+	is.NoErr(stream.Send(&SlideshowCommand{Action: SlideshowCommand_NEXT}))
+	is.Equal(next(), int64(1)) // past the latest back to the first
+
+	is.NoErr(stream.CloseSend())
+	_, err = stream.Recv()
+	is.Equal(err, io.EOF)
+
+	// Intervals too short to be polite to xkcd are refused
+	stream, err = client.Slideshow(ctx)
+	is.NoErr(err)
+	is.NoErr(stream.Send(&SlideshowCommand{Action: SlideshowCommand_PLAY, IntervalMs: 1}))
+	_, err = stream.Recv()
+	is.Equal(status.Code(err), codes.InvalidArgument)
+}
+
+// backend an xkcd service counting its calls and keeping the last caller
+// named, which always gets comic 7 unless it is slow
+type backend struct {
+	*XKCDService
+	calls     int64
+	slow      bool
+	forwarded atomic.Value
+}
+
+func (b *backend) GetXKCD(ctx context.Context, in *MessageNumber) (*Message, error) {
+	atomic.AddInt64(&b.calls, 1)
+	md, _ := metadata.FromIncomingContext(ctx)
+	b.forwarded.Store(md.Get("x-forwarded-for"))
+	if b.slow {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return b.XKCDService.GetXKCD(ctx, &MessageNumber{Number: 7})
+}
+
+// serveBackend serve a backend over TLS on a local port
+func serveBackend(t *testing.T, b *backend) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.Creds(*creds.TransportCredentials()))
+	RegisterXKCDServiceServer(server, b)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	return lis.Addr().String()
+}
+
+// TestXkcdHandler test that the handler balances calls across backends over
+// one connection and reports failed calls
+func TestXkcdHandler(t *testing.T) {
+	is := is.New(t)
+
+	latest := int64(10)
+	fakeXKCD(t, &latest)
+
+	resetConn := func() {
+		clientMu.Lock()
+		defer clientMu.Unlock()
+		if clientConn != nil {
+			clientConn.Close()
+			clientConn = nil
+		}
+	}
+	resetConn()
+	defer resetConn()
+
+	first, second := &backend{}, &backend{}
+	conf.GRPC.Backends = config.Addresses{serveBackend(t, first), serveBackend(t, second)}
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		XkcdHandler(w, httptest.NewRequest(http.MethodGet, "/getimage", nil))
+		return w
+	}
+
+	for i := 0; i < 10; i++ {
+		w := get()
+		is.Equal(w.Code, http.StatusOK)
+		xkcd := XKCD{}
+		is.NoErr(json.Unmarshal(w.Body.Bytes(), &xkcd))
+		is.Equal(xkcd.Number, 7)
+	}
+	conn, err := Conn()
+	is.NoErr(err)
+	is.True(atomic.LoadInt64(&first.calls) > 0)             // both backends called
+	is.True(atomic.LoadInt64(&second.calls) > 0)            // on the shared connection
+	is.Equal(first.forwarded.Load(), []string{"192.0.2.1"}) // the HTTP client
+	conn2, err := Conn()
+	is.NoErr(err)
+	is.True(conn == conn2)
+
+	// A call that takes too long is a 504
+	resetConn()
+	conf.GRPC.Backends = config.Addresses{serveBackend(t, &backend{slow: true})}
+	conf.GRPC.CallTimeout.Duration = 100 * time.Millisecond
+	w := get()
+	is.Equal(w.Code, http.StatusGatewayTimeout)
+	body := grpcerr.Body{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &body))
+	is.Equal(body.Error.Code, "DeadlineExceeded")
+
+	// No backend to call is a 502, and the process carries on
+	resetConn()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	lis.Close()
+	conf.GRPC.Backends = config.Addresses{lis.Addr().String()}
+	conf.GRPC.CallTimeout.Duration = 2 * time.Second
+	w = get()
+	is.Equal(w.Code, http.StatusBadGateway)
+	body = grpcerr.Body{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &body))
+	is.Equal(body.Error.Status, http.StatusBadGateway)
+	is.Equal(body.Error.Code, "Unavailable")
+}
@@ -0,0 +1,427 @@
+package grpcpass
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/imarsman/nanovms/app/index"
+	"github.com/imarsman/nanovms/app/outbound"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limits on the comics one call works through
+const (
+	maxListRange   = 100 // comics sent by one ListXKCD call
+	maxSearchRange = 500 // comics searched by one SearchXKCD call
+	searchRange    = 100 // latest comics searched when no range is given
+	searchLimit    = 10  // results when no limit is given
+	maxSearchLimit = 100
+	fetchWorkers   = 8 // comics fetched at once to index them
+	maxMissing     = 3 // missing comics in a row skipped by a slideshow
+)
+
+// Slideshow pace
+const (
+	slideshowInterval    = 5 * time.Second // between comics unless set
+	minSlideshowInterval = 100 * time.Millisecond
+)
+
+// watchInterval time between checks for a new comic by WatchLatest
+var watchInterval = time.Minute
+
+// comicBoosts titles count for more than alt text in searches
+var comicBoosts = map[string]float64{"title": 2, "alt": 1}
+
+// comics index of comic titles and alt text, added to as comics are searched.
+// Comics do not change once published so they are never dropped.
+var comics = struct {
+	sync.Mutex
+	index    *index.Index
+	messages map[string]*Message // by ID in the index
+}{index: index.New(comicBoosts), messages: make(map[string]*Message)}
+
+// ListXKCD send each comic in a range in order, skipping any that are missing
+func (s *XKCDService) ListXKCD(in *Range, stream XKCDService_ListXKCDServer) error {
+	from, to := in.GetFrom(), in.GetTo()
+	if err := checkRange(from, to, maxListRange); err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	for n := from; n <= to; n++ {
+		msg, err := fetchMessage(ctx, n)
+		if missing(err) {
+			continue
+		}
+		if err != nil {
+			return upstreamError(err)
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WatchLatest send the latest comic if it is newer than the one the client
+// has, then each new comic as it appears until the client goes away
+func (s *XKCDService) WatchLatest(in *WatchRequest, stream XKCDService_WatchLatestServer) error {
+	ctx := stream.Context()
+	after := in.GetAfter()
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		msg, err := fetchLatest(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return upstreamError(ctx.Err())
+		case err != nil:
+			// Keep watching through upstream outages
+			log.Printf("WatchLatest: %v", err)
+		case msg.GetNumber() > after:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+			after = msg.GetNumber()
+		}
+
+		select {
+		case <-ctx.Done():
+			return upstreamError(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// SearchXKCD find comics in a range whose title or alt text has every word
+// and quoted phrase in the query, best first. Comics in the range are fetched
+// and indexed the first time they are searched.
+func (s *XKCDService) SearchXKCD(ctx context.Context, in *Query) (*Messages, error) {
+	if len(index.Tokenize(in.GetText())) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "nothing to search for in %q", in.GetText())
+	}
+
+	limit := int(in.GetLimit())
+	switch {
+	case limit < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "limit %d is negative", limit)
+	case limit == 0:
+		limit = searchLimit
+	case limit > maxSearchLimit:
+		limit = maxSearchLimit
+	}
+
+	from, to := in.GetRange().GetFrom(), in.GetRange().GetTo()
+	if from == 0 && to == 0 {
+		latest, err := fetchLatest(ctx)
+		if err != nil {
+			return nil, upstreamError(err)
+		}
+		from, to = latest.GetNumber()-searchRange+1, latest.GetNumber()
+		if from < 1 {
+			from = 1
+		}
+	}
+	if err := checkRange(from, to, maxSearchRange); err != nil {
+		return nil, err
+	}
+
+	if err := indexComics(ctx, from, to); err != nil {
+		return nil, upstreamError(err)
+	}
+
+	found := &Messages{}
+	comics.Lock()
+	defer comics.Unlock()
+
+	for _, hit := range comics.index.Search(in.GetText()) {
+		msg := comics.messages[hit.ID]
+		if msg.GetNumber() < from || msg.GetNumber() > to {
+			continue
+		}
+		found.Messages = append(found.Messages, msg)
+		if len(found.Messages) == limit {
+			break
+		}
+	}
+
+	return found, nil
+}
+
+// indexComics fetch and index the comics in a range that are not indexed yet,
+// several at a time
+func indexComics(ctx context.Context, from, to int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	numbers := make(chan int64)
+	errs := make(chan error, fetchWorkers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < fetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range numbers {
+				msg, err := fetchMessage(ctx, n)
+				if missing(err) {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				addComic(msg)
+			}
+		}()
+	}
+
+send:
+	for n := from; n <= to; n++ {
+		if indexed(n) {
+			continue
+		}
+		select {
+		case numbers <- n:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(numbers)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	return ctx.Err()
+}
+
+// addComic add a comic to the search index
+func addComic(msg *Message) {
+	id := strconv.FormatInt(msg.GetNumber(), 10)
+
+	comics.Lock()
+	comics.messages[id] = msg
+	comics.Unlock()
+
+	comics.index.Add(index.Document{ID: id, Fields: map[string]string{
+		"title": msg.GetTitle(),
+		"alt":   msg.GetAlt(),
+	}})
+}
+
+// indexed whether a comic is in the search index
+func indexed(number int64) bool {
+	return comics.index.Has(strconv.FormatInt(number, 10))
+}
+
+// Slideshow send comics while the client plays, pauses and steps through
+// them, until the client closes its side of the stream
+func (s *XKCDService) Slideshow(stream XKCDService_SlideshowServer) error {
+	ctx := stream.Context()
+
+	// Commands are received on their own so comics can be sent while waiting
+	commands := make(chan *SlideshowCommand)
+	received := make(chan error, 1)
+	go func() {
+		for {
+			cmd, err := stream.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			select {
+			case commands <- cmd:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	show := slideshow{stream: stream, interval: slideshowInterval}
+	show.ticker = time.NewTicker(slideshowInterval)
+	show.ticker.Stop()
+	defer show.ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return upstreamError(ctx.Err())
+		case err := <-received:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-show.ticks:
+			if err := show.show(ctx, show.number+1, 1); err != nil {
+				return err
+			}
+		case cmd := <-commands:
+			if err := show.command(ctx, cmd); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// slideshow the state of a Slideshow stream
+type slideshow struct {
+	stream   XKCDService_SlideshowServer
+	number   int64 // comic last shown, 0 before the first
+	interval time.Duration
+	ticker   *time.Ticker
+	ticks    <-chan time.Time // the ticker's channel while playing, otherwise nil
+}
+
+// command apply a command from the client. A command with a number shows
+// that comic straight away.
+func (s *slideshow) command(ctx context.Context, cmd *SlideshowCommand) error {
+	if ms := cmd.GetIntervalMs(); ms != 0 {
+		interval := time.Duration(ms) * time.Millisecond
+		if interval < minSlideshowInterval {
+			return status.Errorf(codes.InvalidArgument, "interval %v is less than %v", interval, minSlideshowInterval)
+		}
+		s.interval = interval
+	}
+
+	number := cmd.GetNumber()
+	switch cmd.GetAction() {
+	case SlideshowCommand_PLAY:
+		s.ticker.Reset(s.interval)
+		s.ticks = s.ticker.C
+		if number == 0 && s.number == 0 {
+			number = int64(randomNumber())
+		}
+		if number == 0 {
+			return nil
+		}
+		return s.show(ctx, number, 1)
+	case SlideshowCommand_PAUSE:
+		s.ticker.Stop()
+		s.ticks = nil
+		if number == 0 {
+			return nil
+		}
+		return s.show(ctx, number, 1)
+	case SlideshowCommand_NEXT, SlideshowCommand_PREVIOUS:
+		step := int64(1)
+		if cmd.GetAction() == SlideshowCommand_PREVIOUS {
+			step = -1
+		}
+		if number == 0 {
+			number = s.number + step
+		}
+		// The comic after a step gets a whole interval
+		if s.ticks != nil {
+			s.ticker.Reset(s.interval)
+		}
+		return s.show(ctx, number, step)
+	}
+
+	return status.Errorf(codes.InvalidArgument, "unknown slideshow action %v", cmd.GetAction())
+}
+
+// show send a comic, moving on in the direction of step past comics that are
+// missing. Going forward past the latest comic starts again from the first.
+func (s *slideshow) show(ctx context.Context, number, step int64) error {
+	wrapped := false
+	for missed := 0; ; missed++ {
+		if number < 1 {
+			number, step = 1, 1
+		}
+
+		msg, err := fetchMessage(ctx, number)
+		if err == nil {
+			s.number = number
+			return s.stream.Send(msg)
+		}
+		if missing(err) == false {
+			return upstreamError(err)
+		}
+
+		switch {
+		case missed < maxMissing:
+			number += step
+		case step > 0 && wrapped == false:
+			number, missed, wrapped = 1, -1, true
+		default:
+			return status.Errorf(codes.NotFound, "no comic found near %d", number)
+		}
+	}
+}
+
+// fetchMessage get a comic as a GRPC message
+func fetchMessage(ctx context.Context, number int64) (*Message, error) {
+	bytes, err := FetchXKCD(ctx, int(number))
+	if err != nil {
+		return nil, err
+	}
+
+	xkcd, err := ParseXKCDJSON(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return xkcd.Message(), nil
+}
+
+// fetchLatest get the latest comic as a GRPC message
+func fetchLatest(ctx context.Context) (*Message, error) {
+	bytes, err := FetchLatestXKCD(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	xkcd, err := ParseXKCDJSON(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return xkcd.Message(), nil
+}
+
+// checkRange check that a range of comics is in order and not too long
+func checkRange(from, to, max int64) error {
+	switch {
+	case from < 1 || to < from:
+		return status.Errorf(codes.InvalidArgument, "range %d to %d is not a range of comics", from, to)
+	case to-from >= max:
+		return status.Errorf(codes.InvalidArgument, "range %d to %d has more than %d comics", from, to, max)
+	}
+
+	return nil
+}
+
+// missing whether a comic could not be fetched because there is no such
+// comic, such as number 404
+func missing(err error) bool {
+	var statusErr *outbound.StatusError
+
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// upstreamError get the GRPC status for a failed call to xkcd
+func upstreamError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	return status.Errorf(codes.Unavailable, "xkcd: %v", err)
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/imarsman/nanovms/app/cache"
+)
+
+// CacheStats statistics for one upstream response cache
+type CacheStats struct {
+	cache.Stats
+	HitRatio float64 `json:"hitRatio"`
+}
+
+// CacheStatsHandler get hit and miss statistics for the upstream response
+// caches
+func CacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	all := cache.All()
+	stats := make([]CacheStats, 0, len(all))
+	for _, s := range all {
+		stats = append(stats, CacheStats{Stats: s, HitRatio: s.HitRatio()})
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]CacheStats{"caches": stats})
+}
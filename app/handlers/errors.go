@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorBody body of a JSON error response
+//
+//	{
+//	  "error": {
+//	    "status": 400,
+//	    "message": "invalid transaction",
+//	    "details": ["amount must be positive"]
+//	  }
+//	}
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail the status, a message and optional details for an error
+type ErrorDetail struct {
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+// writeError write a JSON error response
+func writeError(w http.ResponseWriter, status int, message string, details ...string) {
+	body := ErrorBody{}
+	body.Error.Status = status
+	body.Error.Message = message
+	body.Error.Details = details
+
+	bytes, err := json.MarshalIndent(&body, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imarsman/nanovms/app/masking"
+)
+
+// Media types for transaction output
+const (
+	jsonMediaType   = "application/json"
+	csvMediaType    = "text/csv"
+	ndjsonMediaType = "application/x-ndjson"
+
+	csvContentType    = "text/csv; charset=utf-8"
+	ndjsonContentType = "application/x-ndjson; charset=utf-8"
+)
+
+// transactionFormats media types transactions can be written in, preferred
+// first
+var transactionFormats = []string{jsonMediaType, csvMediaType, ndjsonMediaType}
+
+// flushEvery rows written between flushes of streamed output
+const flushEvery = 100
+
+// negotiate choose the offer best matching an Accept header. Each offer gets
+// the quality of the most specific range matching it and the highest quality
+// wins, with ties going to the earlier offer. The first offer is used when the
+// header is empty or nothing acceptable is offered.
+func negotiate(accept string, offers []string) string {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		// Specificity is 3 for an exact match, 2 for type/* and 1 for */*
+		specificity, q := 0, 0.0
+		for _, r := range ranges {
+			s := 0
+			switch {
+			case r.mediaType == offer:
+				s = 3
+			case strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(r.mediaType, "*")):
+				s = 2
+			case r.mediaType == "*/*":
+				s = 1
+			}
+			if s > specificity {
+				specificity, q = s, r.q
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// transactionEncoder writes masked transactions one at a time
+type transactionEncoder interface {
+	// contentType content type of the output
+	contentType() string
+	// paged whether output is paged by default
+	paged() bool
+	// begin write anything that comes before the rows
+	begin(columns []string) error
+	// encode write a row
+	encode(o masking.Object) error
+	// end write anything that comes after the rows
+	end(next string) error
+}
+
+// newTransactionEncoder get an encoder for a media type writing to w
+func newTransactionEncoder(mediaType string, w io.Writer) transactionEncoder {
+	switch mediaType {
+	case csvMediaType:
+		return &csvEncoder{w: csv.NewWriter(w)}
+	case ndjsonMediaType:
+		return &ndjsonEncoder{w: w}
+	}
+
+	return &jsonEncoder{w: w}
+}
+
+// streamTransactions mask and write transactions, flushing as it goes so that
+// the response is never held in memory as a whole
+func streamTransactions(w http.ResponseWriter, encoder transactionEncoder, rp *masking.RolePolicy, transactions transactionSource, next string) error {
+	// Column names come from the type so that empty output still has them
+	columns := []string{}
+	empty, err := masker.Fields(rp, &Transaction{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return err
+	}
+	for _, f := range empty {
+		columns = append(columns, f.Name)
+	}
+
+	w.Header().Set("Content-Type", encoder.contentType())
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if err := encoder.begin(columns); err != nil {
+		return err
+	}
+	rows := 0
+	err = transactions(func(t *Transaction) error {
+		o, err := masker.Fields(rp, t)
+		if err != nil {
+			return err
+		}
+		if err := encoder.encode(o); err != nil {
+			return err
+		}
+		rows++
+		if flusher != nil && rows%flushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return encoder.end(next)
+}
+
+// jsonEncoder writes {"transactions": [...], "next": "..."} indented as the
+// whole list used to be
+type jsonEncoder struct {
+	w    io.Writer
+	rows int
+}
+
+func (e *jsonEncoder) contentType() string {
+	return jsonContentType
+}
+
+func (e *jsonEncoder) paged() bool {
+	return true
+}
+
+func (e *jsonEncoder) begin(columns []string) error {
+	_, err := io.WriteString(e.w, "{\n  \"transactions\": [")
+	return err
+}
+
+func (e *jsonEncoder) encode(o masking.Object) error {
+	bytes, err := json.MarshalIndent(o, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n    "
+	if e.rows == 0 {
+		sep = "\n    "
+	}
+	e.rows++
+	_, err = fmt.Fprintf(e.w, "%s%s", sep, bytes)
+
+	return err
+}
+
+func (e *jsonEncoder) end(next string) error {
+	closing := "]"
+	if e.rows > 0 {
+		closing = "\n  ]"
+	}
+	if next != "" {
+		link, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+		closing += ",\n  \"next\": " + string(link)
+	}
+	_, err := io.WriteString(e.w, closing+"\n}")
+
+	return err
+}
+
+// ndjsonEncoder writes one JSON object per line. The next page is only given
+// in the Link header.
+type ndjsonEncoder struct {
+	w io.Writer
+}
+
+func (e *ndjsonEncoder) contentType() string {
+	return ndjsonContentType
+}
+
+func (e *ndjsonEncoder) paged() bool {
+	return false
+}
+
+func (e *ndjsonEncoder) begin(columns []string) error {
+	return nil
+}
+
+func (e *ndjsonEncoder) encode(o masking.Object) error {
+	bytes, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(bytes, '\n'))
+
+	return err
+}
+
+func (e *ndjsonEncoder) end(next string) error {
+	return nil
+}
+
+// csvEncoder writes a header row and then a row per transaction. The next
+// page is only given in the Link header.
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvEncoder) contentType() string {
+	return csvContentType
+}
+
+func (e *csvEncoder) paged() bool {
+	return false
+}
+
+func (e *csvEncoder) begin(columns []string) error {
+	return e.w.Write(columns)
+}
+
+func (e *csvEncoder) encode(o masking.Object) error {
+	record := make([]string, len(o))
+	for i, f := range o {
+		switch v := f.Value.(type) {
+		case time.Time:
+			record[i] = v.Format(time.RFC3339)
+		case string:
+			record[i] = escapeCell(v)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	if err := e.w.Write(record); err != nil {
+		return err
+	}
+	// Pass rows through to the response rather than letting them build up
+	e.w.Flush()
+
+	return e.w.Error()
+}
+
+func (e *csvEncoder) end(next string) error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// formulaPrefixes the first characters that make a spreadsheet read a cell as
+// a formula
+const formulaPrefixes = "=+-@"
+
+// escapeCell prefix a text cell that a spreadsheet would run as a formula with
+// a quote so it is shown as text. Numbers are not text cells, so negative
+// amounts are written as they are.
+func escapeCell(s string) string {
+	if s != "" && strings.ContainsRune(formulaPrefixes, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// unescapeCell undo escapeCell for a cell read back from a CSV export
+func unescapeCell(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(formulaPrefixes, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
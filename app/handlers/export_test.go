@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/matryer/is"
+)
+
+// TestNegotiate test choosing a format from Accept headers
+func TestNegotiate(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(negotiate("", transactionFormats), jsonMediaType)
+	is.Equal(negotiate("text/csv", transactionFormats), csvMediaType)
+	is.Equal(negotiate("application/x-ndjson", transactionFormats), ndjsonMediaType)
+	is.Equal(negotiate("text/html", transactionFormats), jsonMediaType)
+	is.Equal(negotiate("*/*", transactionFormats), jsonMediaType)
+	is.Equal(negotiate("text/*", transactionFormats), csvMediaType)
+	is.Equal(negotiate("application/json;q=0.5, text/csv", transactionFormats), csvMediaType)
+	is.Equal(negotiate("application/json;q=0, */*;q=0.1", transactionFormats), csvMediaType)
+}
+
+// TestExport test CSV and NDJSON output of transactions
+func TestExport(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+	SetStore(NewMemoryStore(transactions.Transactions))
+	router := GetRouter(config.Default())
+
+	get := func(accept, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	// Exports are not paged unless asked
+	res := get(csvMediaType, "/transactions")
+	is.Equal(res.Code, http.StatusOK)
+	is.Equal(res.Header().Get("Content-Type"), csvContentType)
+	records, err := csv.NewReader(res.Body).ReadAll()
+	is.NoErr(err)
+	is.Equal(len(records), len(transactions.Transactions)+1)
+	is.Equal(records[0][0], "id")
+	for _, record := range records[1:] {
+		// Masked for the default role
+		is.True(strings.HasPrefix(record[8], "h_"))
+	}
+
+	res = get(ndjsonMediaType, "/transactions?sort=id&limit=2")
+	is.Equal(res.Code, http.StatusOK)
+	is.Equal(res.Header().Get("Content-Type"), ndjsonContentType)
+	is.True(strings.Contains(res.Header().Get("Link"), `rel="next"`))
+	lines := 0
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		row := map[string]interface{}{}
+		is.NoErr(json.Unmarshal(scanner.Bytes(), &row))
+		lines++
+		is.Equal(row["id"], float64(lines))
+	}
+	is.Equal(lines, 2)
+
+	// JSON stays paged and parses as a whole
+	res = get("application/json", "/transactions?limit=1")
+	is.Equal(res.Code, http.StatusOK)
+	list := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &list))
+	is.Equal(len(list["transactions"].([]interface{})), 1)
+	is.True(list["next"] != "")
+
+	res = get("application/json", "/transactions?posted_from=2099-01-01T00:00:00Z")
+	list = map[string]interface{}{}
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &list))
+	is.Equal(len(list["transactions"].([]interface{})), 0)
+
+	// Large exports read the whole store once and stay in order
+	var many []Transaction
+	for i := 1; i <= 1007; i++ {
+		tx := sampleTransaction()
+		tx.ID = i
+		tx.Amount = (i * 7919) % 1000
+		many = append(many, tx)
+	}
+	counting := &countingStore{TransactionStore: NewMemoryStore(many)}
+	SetStore(counting)
+	res = get(ndjsonMediaType, "/transactions?sort=amount")
+	is.Equal(res.Code, http.StatusOK)
+	rows, previous := 0, map[string]interface{}{}
+	scanner = bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		row := map[string]interface{}{}
+		is.NoErr(json.Unmarshal(scanner.Bytes(), &row))
+		if rows > 0 {
+			ordered := previous["amount"].(float64) < row["amount"].(float64) ||
+				previous["amount"] == row["amount"] && previous["id"].(float64) < row["id"].(float64)
+			is.True(ordered)
+		}
+		previous = row
+		rows++
+	}
+	is.Equal(rows, len(many))
+	is.Equal(counting.scans, 1)
+
+	// Text a spreadsheet would run as a formula is quoted, numbers are not
+	tx := sampleTransaction()
+	tx.ID = 1
+	tx.Amount = -5
+	tx.TransactionCategory = "=HYPERLINK(\"http://example.com\")"
+	SetStore(NewMemoryStore([]Transaction{tx}))
+	res = get(csvMediaType, "/transactions")
+	records, err = csv.NewReader(res.Body).ReadAll()
+	is.NoErr(err)
+	is.Equal(records[0][5], "transaction_category")
+	is.Equal(records[1][5], "'=HYPERLINK(\"http://example.com\")")
+	is.Equal(records[1][1], "-5")
+}
+
+func TestEscapeCell(t *testing.T) {
+	is := is.New(t)
+
+	for _, cell := range []string{"=1+1", "+1", "-1", "@SUM(A1)"} {
+		is.Equal(escapeCell(cell), "'"+cell)
+		is.Equal(unescapeCell(escapeCell(cell)), cell)
+	}
+	for _, cell := range []string{"", "Grocery", "'quoted", "'"} {
+		is.Equal(escapeCell(cell), cell)
+		is.Equal(unescapeCell(cell), cell)
+	}
+}
+
+// countingStore a store counting the times it is read in full
+type countingStore struct {
+	TransactionStore
+	scans int
+}
+
+func (s *countingStore) Each(fn func(t Transaction) bool) error {
+	s.scans++
+	return s.TransactionStore.Each(fn)
+}
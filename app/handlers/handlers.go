@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
@@ -11,6 +13,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"text/template"
 	"time"
@@ -21,7 +24,11 @@ import (
 
 	// "github.com/imarsman/nanovms/app"
 
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/gateway"
 	"github.com/imarsman/nanovms/app/grpcpass"
+	"github.com/imarsman/nanovms/app/health"
+	"github.com/imarsman/nanovms/app/metrics"
 	"github.com/imarsman/nanovms/app/msg"
 	"github.com/imarsman/nanovms/app/tweets"
 )
@@ -64,19 +71,44 @@ type PageData struct {
 }
 
 var router *mux.Router
-var inCloud bool
+var conf = config.Default()
 
-func SetInCloud(isInCloud bool) {
-	inCloud = isInCloud
-}
-
-// GetRouter get reference to HTTP router
-func GetRouter(inCloud bool) *mux.Router {
+// GetRouter get reference to HTTP router set up for the given configuration
+func GetRouter(c *config.Config) *mux.Router {
+	conf = c
 	router = mux.NewRouter().StrictSlash(true)
+	router.Use(metrics.Middleware)
+
+	// Prometheus metrics
+	router.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet).Name("Metrics")
+
+	// Hit and miss counts for caches of upstream API responses
+	router.HandleFunc("/cachez", CacheStatsHandler).Methods(http.MethodGet).Name("Cache statistics")
+
+	// Health checks. /livez covers the HTTP side of the process, /healthz adds
+	// the GRPC and NATS servers and /readyz adds the upstream APIs.
+	router.HandleFunc("/livez", health.Handler(newHealthRegistry(livenessChecks()))).Methods(http.MethodGet).Name("Liveness")
+	router.HandleFunc("/healthz", health.Handler(newHealthRegistry(healthChecks()))).Methods(http.MethodGet).Name("Health")
+	router.HandleFunc("/readyz", health.Handler(newHealthRegistry(readinessChecks()))).Methods(http.MethodGet).Name("Readiness")
 
 	// Sample JSON returning function
 	router.HandleFunc("/transactions", GetTransactionsHandler).Methods(http.MethodGet).Name("Sample transactions")
 
+	// Transaction CRUD
+	router.HandleFunc("/transactions", CreateTransactionHandler).Methods(http.MethodPost).Name("Create transaction")
+	router.HandleFunc("/transactions/import", ImportTransactionsHandler).Methods(http.MethodPost).Name("Import transactions")
+	router.HandleFunc("/transactions/{id:[0-9]+}", GetTransactionHandler).Methods(http.MethodGet).Name("Get transaction")
+	router.HandleFunc("/transactions/{id:[0-9]+}", UpdateTransactionHandler).Methods(http.MethodPut).Name("Update transaction")
+	router.HandleFunc("/transactions/{id:[0-9]+}", DeleteTransactionHandler).Methods(http.MethodDelete).Name("Delete transaction")
+
+	// Account balances and statements from the transaction ledger
+	router.HandleFunc("/ledger", LedgerHandler).Methods(http.MethodGet).Name("Ledger")
+	router.HandleFunc("/accounts/{id}/balance", BalanceHandler).Methods(http.MethodGet).Name("Account balance")
+	router.HandleFunc("/accounts/{id}/statement", StatementHandler).Methods(http.MethodGet).Name("Account statement")
+
+	// Reverse tokens in masked transactions
+	router.HandleFunc("/tokens/{token}", DetokenizeHandler).Methods(http.MethodGet).Name("Detokenize")
+
 	// We need to convert the embed FS to an io.FS in order to work with it
 	fsys := fs.FS(static)
 
@@ -96,8 +128,9 @@ func GetRouter(inCloud bool) *mux.Router {
 
 	// NATS demo
 	router.PathPrefix("/msgsearch").HandlerFunc(natsHandler).Methods(http.MethodGet).Name("Get NATS request")
+	router.HandleFunc("/msghistory", natsHistoryHandler).Methods(http.MethodGet).Name("Get NATS search history")
 
-	if inCloud {
+	if conf.Cloud {
 		// For GRPC test using XKCD fetches
 		router.PathPrefix("/getimage").HandlerFunc(xkcdNoGRPCHandler).Methods(http.MethodGet).Name("Get visa Non GRPC")
 		// router.PathPrefix("/getimage").HandlerFunc(xkcdHandler).Methods(http.MethodGet).Name("Get
@@ -107,6 +140,15 @@ func GetRouter(inCloud bool) *mux.Router {
 		// GRPC server not currently working
 		router.PathPrefix("/getimage").HandlerFunc(grpcpass.XkcdHandler).Methods(http.MethodGet).Name("Get via GRPC")
 		// router.PathPrefix("/getimage").HandlerFunc(XkcdNoGRPCHandler).Methods(http.MethodGet).Name("Get visa Non GRPC")
+
+		// The xkcd service as REST under /v1/xkcd
+		conn, err := grpcpass.Conn()
+		if err == nil {
+			err = gateway.Register(router, conn, grpcpass.Service())
+		}
+		if err != nil {
+			log.Printf("Not serving the GRPC gateway: %v", err)
+		}
 	}
 	router.PathPrefix("/").HandlerFunc(TemplatePageHandler).Methods(http.MethodGet).Name("Dynamic pages")
 
@@ -201,6 +243,10 @@ func counterIncrement() uint64 {
 func init() {
 	csrfCache = cache.New(5*time.Minute, 2*time.Minute)
 
+	metrics.CounterFunc("page_loads_total", "Template page loads.", func() float64 {
+		return float64(atomic.LoadUint64(&count))
+	})
+
 	t := time.Now()
 	startTime = &t
 
@@ -223,11 +269,31 @@ func init() {
 	}
 }
 
-// natsHandler NATS request handler
+// upstreamTimeout longest a handler waits for upstream APIs and NATS searches
+// before giving up, when the client has not given up first
+const upstreamTimeout = 20 * time.Second
+
+// htmlMediaType media type of HTML page fragments
+const htmlMediaType = "text/html"
+
+// searchFormats media types search results can be written in, preferred
+// first. The HTML fragment is for msgshow.js and the JSON is the ResultSet
+// returned by the search workers.
+var searchFormats = []string{htmlMediaType, jsonMediaType}
+
+// natsHandler NATS request handler. The search parameter is required and
+// start, the offset of the first result, must be a non-negative integer if
+// given. Results are an HTML fragment or, with Accept: application/json, a
+// msg.ResultSet. A search that fails or finds nothing is still a 200 with the
+// error in the result set. Bad parameters are a 400 and an unavailable NATS
+// connection a 503, as an error fragment for HTML and an ErrorBody for JSON.
 func natsHandler(w http.ResponseWriter, r *http.Request) {
+	format := negotiate(r.Header.Get("Accept"), searchFormats)
+	w.Header().Set("Vary", "Accept")
+
 	search := r.URL.Query().Get("search")
-	if search == "" {
-		w.WriteHeader(http.StatusInternalServerError)
+	if strings.TrimSpace(search) == "" {
+		writeSearchError(w, format, http.StatusBadRequest, search, "missing search", "the search parameter is required")
 		return
 	}
 
@@ -236,64 +302,96 @@ func natsHandler(w http.ResponseWriter, r *http.Request) {
 	if startStr != "" {
 		var err error
 		start, err = strconv.Atoi(startStr)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if err != nil || start < 0 {
+			writeSearchError(w, format, http.StatusBadRequest, search, "invalid start",
+				"start must be a non-negative integer")
 			return
 		}
 	}
 
-	var result []byte
-	result, err := msg.QueryNATS(search, start, inCloud)
+	ctx, cancel := context.WithTimeout(r.Context(), upstreamTimeout)
+	defer cancel()
+
+	result, err := msg.QueryNATS(ctx, search, start)
+	if errors.Is(err, context.Canceled) {
+		// The client has gone so there is no one to answer
+		return
+	}
+	if err == msg.ErrNotConnected {
+		// Show why in the search results area rather than failing silently
+		writeSearchError(w, format, http.StatusServiceUnavailable, search, "search is unavailable", err.Error())
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeSearchError(w, format, http.StatusInternalServerError, search, "search failed", err.Error())
 		return
 	}
 
-	// if inCloud {
-	// 	var err error
-	// 	result, err = msg.QueryRemoteNATS(search)
-	// 	if err != nil {
-	// 		fmt.Println("err", err)
-	// 		w.WriteHeader(http.StatusInternalServerError)
-	// 		return
-	// 	}
-	// } else {
-	// 	var err error
-	// 	result, err = msg.QueryNATS(search)
-	// 	if err != nil {
-	// 		fmt.Println("err", err)
-	// 		w.WriteHeader(http.StatusInternalServerError)
-	// 		return
-	// 	}
-	// }
-
 	response := msg.ResultSet{}
-
 	err = json.Unmarshal(result, &response)
 	if err != nil {
-		// fmt.Println("unmarshal err", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeSearchError(w, format, http.StatusBadGateway, search, "invalid reply from search worker", err.Error())
+		return
+	}
+
+	if format == jsonMediaType {
+		writeJSON(w, http.StatusOK, &response)
 		return
 	}
 
 	output, err := msg.ToHTML(&response, false)
 	if err != nil {
-		// fmt.Println("To HTML err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Add("Content-Type", htmlContentType)
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(output))
+}
 
-	// fmt.Println("length", len(output))
+// writeSearchError write a search error as an ErrorBody for JSON or as the
+// search results fragment for HTML, where the search and detail are escaped
+func writeSearchError(w http.ResponseWriter, format string, status int, search, message, detail string) {
+	if format == jsonMediaType {
+		writeError(w, status, message, detail)
+		return
+	}
 
+	output, err := msg.ToHTML(&msg.ResultSet{
+		SearchTerm:   search,
+		Error:        true,
+		ErrorMessage: strings.ToUpper(message[:1]) + message[1:] + ": " + detail,
+	}, false)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", htmlContentType)
+	w.WriteHeader(status)
+	w.Write([]byte(output))
+}
+
+// natsHistoryHandler get recent searches replayed from NATS Streaming as an
+// HTML snippet
+func natsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	output, err := msg.HistoryToHTML()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", htmlContentType)
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(output))
 }
 
 // xkcdNoGRPCHandler handler for XKCD with no GRPC
 func xkcdNoGRPCHandler(w http.ResponseWriter, r *http.Request) {
-	bytes, err := grpcpass.FetchRandomXKCD()
+	ctx, cancel := context.WithTimeout(r.Context(), upstreamTimeout)
+	defer cancel()
+
+	bytes, err := grpcpass.FetchRandomXKCD(ctx)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -320,7 +418,10 @@ func xkcdNoGRPCHandler(w http.ResponseWriter, r *http.Request) {
 func twitterHandler(w http.ResponseWriter, r *http.Request) {
 	findTokenFromRequest(r)
 
-	td, err := tweets.GetTweetData()
+	ctx, cancel := context.WithTimeout(r.Context(), upstreamTimeout)
+	defer cancel()
+
+	td, err := tweets.GetTweetData(ctx)
 	if err != nil { // simulate error getting data
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -391,31 +492,203 @@ func TemplatePageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("NOT FOUND"))
 }
 
-// GetTransactionsHandler get list of transactions
+// GetTransactionsHandler get list of transactions, filtered, sorted and paged
+// using the query parameters described by parseTransactionQuery
 func GetTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTransactionQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rp, ok := callerPolicy(w, r)
+	if ok == false {
+		return
+	}
+	if err := query.permitted(rp); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The format is negotiated from the Accept header. JSON is paged by
+	// default while the export formats stream everything unless limited,
+	// getting each transaction as it is written.
+	encoder := newTransactionEncoder(negotiate(r.Header.Get("Accept"), transactionFormats), w)
+	if query.limit == 0 && encoder.paged() {
+		query.limit = defaultPageLimit
+	}
+	transactions, nextURL := query.all(store), ""
+	if query.limit > 0 {
+		page, next, err := query.page(store, query.after, query.limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		transactions = pageSource(page)
+		if next != nil {
+			nextURL = nextLink(r.URL, next)
+			w.Header().Set("Link", "<"+nextURL+">; rel=\"next\"")
+		}
+	}
+
+	// Fields are masked according to the policy for the caller's role
+	if err := streamTransactions(w, encoder, rp, transactions, nextURL); err != nil {
+		log.Println("Problem writing transactions:", err)
+	}
+}
+
+// writeJSON write a value as indented JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	// Indent for clarity here but would consider not for machine->machine communication
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	w.Header().Set("Content-Type", jsonContentType)
-	transactionList, err := readTransactions()
-	if err != nil { // simulate error getting data
-		w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
+
+// maxTransactionBody largest accepted transaction request body
+const maxTransactionBody = 1 << 20
+
+// transactionID get the ID from the request path
+func transactionID(r *http.Request) (int, error) {
+	return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// decodeTransaction read and validate a transaction from a request body
+func decodeTransaction(w http.ResponseWriter, r *http.Request) (Transaction, bool) {
+	transaction := Transaction{}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxTransactionBody)
+	if err := json.NewDecoder(r.Body).Decode(&transaction); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body", err.Error())
+		return transaction, false
+	}
+	if err := transaction.Validate(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid transaction", err.(*ValidationError).Problems...)
+		return transaction, false
+	}
+
+	return transaction, true
+}
+
+// writeTransaction write a single transaction masked for the caller's role
+func writeTransaction(w http.ResponseWriter, r *http.Request, status int, transaction Transaction) {
+	rp, ok := callerPolicy(w, r)
+	if ok == false {
+		return
+	}
+
+	masked, err := masker.Fields(rp, &transaction)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	sortDescendingPostTimestamp(&transactionList)
+	writeJSON(w, status, masked)
+}
+
+// writeStoreError write the response for an error from the store
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case ErrExists:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
 
-	// obscured, err := obscured(transactions)
-	transactionList, err = obscureTransactionID(transactionList) // allow for error
+// GetTransactionHandler get a transaction by ID
+func GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := transactionID(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, "invalid id")
 		return
 	}
 
-	json, err := toJSON(transactionList)
+	transaction, err := store.Get(id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(json))
+	writeTransaction(w, r, http.StatusOK, transaction)
+}
+
+// CreateTransactionHandler add a transaction. The ID is assigned if not set.
+func CreateTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	if callerWriter(w, r) == false {
+		return
+	}
+	transaction, ok := decodeTransaction(w, r)
+	if ok == false {
+		return
+	}
+
+	// Not while an import checks for transactions already stored
+	importLock.Lock()
+	transaction, err := store.Create(transaction)
+	importLock.Unlock()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/transactions/%d", transaction.ID))
+	writeTransaction(w, r, http.StatusCreated, transaction)
+}
+
+// UpdateTransactionHandler replace a transaction. The ID in the body, if
+// set, must match the path.
+func UpdateTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	if callerWriter(w, r) == false {
+		return
+	}
+	id, err := transactionID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	transaction, ok := decodeTransaction(w, r)
+	if ok == false {
+		return
+	}
+	if transaction.ID != 0 && transaction.ID != id {
+		writeError(w, http.StatusBadRequest, "id in body does not match path")
+		return
+	}
+	transaction.ID = id
+
+	transaction, err = store.Update(transaction)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeTransaction(w, r, http.StatusOK, transaction)
+}
+
+// DeleteTransactionHandler remove a transaction
+func DeleteTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	if callerWriter(w, r) == false {
+		return
+	}
+	id, err := transactionID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	if err := store.Delete(id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
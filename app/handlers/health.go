@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/grpcpass"
+	"github.com/imarsman/nanovms/app/health"
+	"github.com/imarsman/nanovms/app/msg"
+	cache "github.com/patrickmn/go-cache"
+)
+
+// checkTimeout time allowed for any single health check
+const checkTimeout = 3 * time.Second
+
+// livenessChecks checks of the HTTP side of the process only, so that a
+// failure means the process should be restarted. Used for /livez.
+func livenessChecks() []health.Check {
+	return []health.Check{
+		{Name: "http router", Run: checkRouter},
+		{Name: "templates", Run: checkTemplates},
+		{Name: "csrf cache", Run: checkCSRFCache},
+	}
+}
+
+// healthChecks checks of every embedded subsystem. Used for /healthz.
+func healthChecks() []health.Check {
+	return append(livenessChecks(),
+		health.Check{Name: "grpc server", Run: checkGRPC},
+		health.Check{Name: "nats server", Run: checkNATS},
+	)
+}
+
+// readinessChecks checks of everything needed to serve requests, including
+// the upstream APIs. Used for /readyz.
+func readinessChecks() []health.Check {
+	checks := append(healthChecks(),
+		health.HTTPCheck("xkcd api", conf.Upstream.XKCD+"/info.0.json"),
+		health.HTTPCheck("twitter api", conf.Upstream.Twitter),
+	)
+
+	// Only the API used for searches matters
+	switch conf.Search.Backend {
+	case config.SearchPLOS:
+		checks = append(checks, health.HTTPCheck("plos api", conf.Upstream.PLOS))
+	case config.SearchCrossref:
+		checks = append(checks, health.HTTPCheck("crossref api", conf.Upstream.Crossref))
+	}
+
+	return checks
+}
+
+// newHealthRegistry get a registry for a set of checks
+func newHealthRegistry(checks []health.Check) *health.Registry {
+	registry := health.NewRegistry(checkTimeout)
+	registry.Add(checks...)
+
+	return registry
+}
+
+func checkRouter(ctx context.Context) error {
+	if router == nil {
+		return errors.New("router not set up")
+	}
+	count := 0
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		count++
+		return nil
+	})
+	if count == 0 {
+		return errors.New("no routes")
+	}
+
+	return nil
+}
+
+func checkTemplates(ctx context.Context) error {
+	if templates == nil {
+		return errors.New("templates not parsed")
+	}
+	if templates.Lookup("index.html") == nil {
+		return errors.New("index template missing")
+	}
+
+	return nil
+}
+
+func checkCSRFCache(ctx context.Context) error {
+	if csrfCache == nil {
+		return errors.New("cache not set up")
+	}
+	key := "healthcheck"
+	csrfCache.Set(key, "", cache.DefaultExpiration)
+	defer csrfCache.Delete(key)
+	if _, ok := csrfCache.Get(key); ok == false {
+		return errors.New("cache lookup failed")
+	}
+
+	return nil
+}
+
+func checkGRPC(ctx context.Context) error {
+	// GRPC server is not run in the cloud for now
+	if conf.Cloud {
+		return health.ErrDisabled
+	}
+
+	return grpcpass.CheckHealth(ctx)
+}
+
+func checkNATS(ctx context.Context) error {
+	return msg.CheckConnection(ctx)
+}
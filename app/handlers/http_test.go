@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/fs"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/gorilla/mux"
+	"github.com/imarsman/nanovms/app/config"
 	"github.com/matryer/is"
 )
 
@@ -91,3 +93,179 @@ func TestCallHandlers(t *testing.T) {
 	err = callServer(t, newTemplateServer(), http.MethodGet, "/", http.StatusOK)
 	is.NoErr(err)
 }
+
+// TestLiveness test the liveness endpoint on the full router
+func TestLiveness(t *testing.T) {
+	is := is.New(t)
+
+	err := callServer(t, GetRouter(config.Default()), http.MethodGet, "/livez", http.StatusOK)
+	is.NoErr(err)
+}
+
+// request make a request against a router and get the response
+func request(router *mux.Router, method, path, body string) *httptest.ResponseRecorder {
+	return requestAs(router, "", method, path, body)
+}
+
+// roleConfig get the default configuration with roles read from a proxy on
+// this host
+func roleConfig() *config.Config {
+	c := config.Default()
+	c.Masking.RoleHeader = true
+
+	return c
+}
+
+// requestAs make a request in a role, set by a proxy on this host, against a
+// router and get the response
+func requestAs(router *mux.Router, role, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:40000"
+	if role != "" {
+		req.Header.Set(roleHeader, role)
+	}
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	return res
+}
+
+// TestTransactionCRUD test create, read, update and delete of transactions
+func TestTransactionCRUD(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+	SetStore(NewMemoryStore(transactions.Transactions))
+	router := GetRouter(roleConfig())
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		return requestAs(router, "support", method, path, body)
+	}
+
+	body := `{"amount": 500, "created_at": "2021-07-01T10:00:00+00:00", "transaction_id": 123456,
+		"transaction_category": "Grocery", "posted_timestamp": "2021-07-01T10:00:00+00:00",
+		"transaction_type": "POS", "sending_account": 1234, "receiving_account": 3877}`
+
+	// Only roles that may write can change transactions
+	for _, role := range []string{"public", "auditor"} {
+		res := requestAs(router, role, http.MethodPost, "/transactions", body)
+		is.Equal(res.Code, http.StatusForbidden)
+		res = requestAs(router, role, http.MethodDelete, "/transactions/1", "")
+		is.Equal(res.Code, http.StatusForbidden)
+	}
+
+	res := request(http.MethodPost, "/transactions", body)
+	is.Equal(res.Code, http.StatusCreated)
+	location := res.Header().Get("Location")
+	is.Equal(location, "/transactions/11")
+
+	created := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &created))
+	is.Equal(created["transaction_id"], float64(3456)) // masked for the default role
+
+	res = request(http.MethodGet, location, "")
+	is.Equal(res.Code, http.StatusOK)
+
+	res = request(http.MethodPut, location, strings.Replace(body, "500", "750", 1))
+	is.Equal(res.Code, http.StatusOK)
+	is.True(strings.Contains(res.Body.String(), `"amount": 750`))
+
+	res = request(http.MethodPut, location, `{"amount": -1}`)
+	is.Equal(res.Code, http.StatusUnprocessableEntity)
+	t.Log(res.Body.String())
+
+	res = request(http.MethodPost, "/transactions", `{"amount":`)
+	is.Equal(res.Code, http.StatusBadRequest)
+
+	res = request(http.MethodDelete, location, "")
+	is.Equal(res.Code, http.StatusNoContent)
+
+	res = request(http.MethodGet, location, "")
+	is.Equal(res.Code, http.StatusNotFound)
+	errBody := ErrorBody{}
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &errBody))
+	is.Equal(errBody.Error.Status, http.StatusNotFound)
+}
+
+// TestMaskingRoles test transaction output for different caller roles
+func TestMaskingRoles(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+	SetStore(NewMemoryStore(transactions.Transactions))
+	router := GetRouter(roleConfig())
+
+	res := requestAs(router, "support", http.MethodGet, "/transactions/1", "")
+	is.Equal(res.Code, http.StatusOK)
+	support := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &support))
+	token := support["sending_account"].(string)
+
+	res = requestAs(router, "support", http.MethodGet, "/tokens/"+token, "")
+	is.Equal(res.Code, http.StatusForbidden)
+
+	res = requestAs(router, "auditor", http.MethodGet, "/tokens/"+token, "")
+	is.Equal(res.Code, http.StatusOK)
+	is.True(strings.Contains(res.Body.String(), `"value": "1234"`))
+
+	res = requestAs(router, "public", http.MethodGet, "/transactions/1", "")
+	is.Equal(res.Code, http.StatusOK)
+	is.True(strings.Contains(res.Body.String(), `"transaction_note": "[REDACTED]"`))
+
+	res = requestAs(router, "intruder", http.MethodGet, "/transactions", "")
+	is.Equal(res.Code, http.StatusForbidden)
+
+	// The role is the default unless a trusted proxy sets it
+	req := httptest.NewRequest(http.MethodGet, "/tokens/"+token, nil)
+	req.Header.Set(roleHeader, "auditor")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	is.Equal(res.Code, http.StatusForbidden) // from 192.0.2.1
+
+	router = GetRouter(config.Default())
+	res = requestAs(router, "auditor", http.MethodGet, "/tokens/"+token, "")
+	is.Equal(res.Code, http.StatusForbidden) // header not enabled
+	res = requestAs(router, "intruder", http.MethodGet, "/transactions/1", "")
+	is.Equal(res.Code, http.StatusOK)
+	is.True(strings.Contains(res.Body.String(), `"transaction_note": "[REDACTED]"`))
+}
+
+// TestSearchErrors test responses to bad searches in both formats
+func TestSearchErrors(t *testing.T) {
+	is := is.New(t)
+
+	router := GetRouter(config.Default())
+	search := func(accept, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	for path, status := range map[string]int{
+		"/msgsearch":                       http.StatusBadRequest,
+		"/msgsearch?search=%20":            http.StatusBadRequest,
+		"/msgsearch?search=mites&start=x":  http.StatusBadRequest,
+		"/msgsearch?search=mites&start=-1": http.StatusBadRequest,
+		"/msgsearch?search=mites":          http.StatusServiceUnavailable, // NATS is not connected
+	} {
+		res := search("application/json", path)
+		is.Equal(res.Code, status)
+		is.Equal(res.Header().Get("Content-Type"), jsonContentType)
+		errBody := ErrorBody{}
+		is.NoErr(json.Unmarshal(res.Body.Bytes(), &errBody))
+		is.Equal(errBody.Error.Status, status)
+
+		res = search("*/*", path)
+		is.Equal(res.Code, status)
+		is.Equal(res.Header().Get("Content-Type"), htmlContentType)
+	}
+
+	// Nothing from the request is written back as HTML
+	res := search("*/*", "/msgsearch?search=%3Cb%3E&start=%3Cscript%3Ealert(1)%3C/script%3E")
+	is.Equal(res.Code, http.StatusBadRequest)
+	is.True(strings.Contains(res.Body.String(), "<script>") == false)
+	is.True(strings.Contains(res.Body.String(), "<b>") == false)
+}
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxImportBody largest upload accepted by the import handler
+const maxImportBody = 32 << 20
+
+// Row outcomes in an import report
+const (
+	importImported = "imported"
+	importSkipped  = "skipped"
+	importInvalid  = "invalid"
+)
+
+// importLock serializes imports, and creates with them, so that a
+// transaction can not be stored by another write while an import checks for
+// it
+var importLock sync.Mutex
+
+// ImportRow the outcome for one row of an upload. Rows are numbered from 1,
+// not counting a CSV header.
+type ImportRow struct {
+	Row    int      `json:"row"`
+	Status string   `json:"status"`
+	ID     int      `json:"id,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ImportReport the outcome of an import
+type ImportReport struct {
+	Imported int         `json:"imported"`
+	Skipped  int         `json:"skipped"`
+	Invalid  int         `json:"invalid"`
+	Rows     []ImportRow `json:"rows"`
+}
+
+// importRecord a decoded row, or the reason it could not be decoded
+type importRecord struct {
+	transaction Transaction
+	err         error
+}
+
+// ImportTransactionsHandler add transactions from a JSON array, NDJSON or CSV
+// upload, chosen by Content-Type. Each row is validated and the valid rows are
+// stored with new IDs. Rows with a transaction_id that is already stored, or
+// seen earlier in the upload, are skipped so that an upload can be retried.
+// The response reports the outcome of every row.
+func ImportTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	if callerWriter(w, r) == false {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = jsonMediaType
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBody)
+
+	var records []importRecord
+	switch mediaType {
+	case jsonMediaType:
+		records, err = decodeJSONImport(r.Body)
+	case ndjsonMediaType:
+		records, err = decodeNDJSONImport(r.Body)
+	case csvMediaType:
+		records, err = decodeCSVImport(r.Body)
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported content type "+mediaType,
+			"use "+strings.Join(transactionFormats, ", "))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "could not read upload", err.Error())
+		return
+	}
+
+	report, err := importTransactions(records)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// importTransactions validate and store decoded rows
+func importTransactions(records []importRecord) (*ImportReport, error) {
+	importLock.Lock()
+	defer importLock.Unlock()
+
+	existing, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[int]int, len(existing))
+	for _, t := range existing {
+		stored[t.TransactionID] = t.ID
+	}
+
+	// Valid rows are stored together once all rows are checked
+	report := &ImportReport{Rows: make([]ImportRow, 0, len(records))}
+	var pending []Transaction
+	var pendingRows []int
+	for i, record := range records {
+		row := ImportRow{Row: i + 1}
+		t := record.transaction
+
+		// IDs are assigned by the store
+		t.ID = 0
+		if record.err != nil {
+			row.Errors = []string{record.err.Error()}
+		} else if err := t.Validate(); err != nil {
+			row.Errors = err.(*ValidationError).Problems
+		}
+
+		switch {
+		case row.Errors != nil:
+			row.Status = importInvalid
+		case stored[t.TransactionID] != 0:
+			row.Status = importSkipped
+			row.ID = stored[t.TransactionID]
+		default:
+			row.Status = importImported
+			stored[t.TransactionID] = -1 // later rows are skipped
+			pending = append(pending, t)
+			pendingRows = append(pendingRows, len(report.Rows))
+		}
+
+		switch row.Status {
+		case importImported:
+			report.Imported++
+		case importSkipped:
+			report.Skipped++
+		default:
+			report.Invalid++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	created, err := store.CreateAll(pending)
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range created {
+		report.Rows[pendingRows[i]].ID = t.ID
+	}
+	// Rows skipped as repeats of rows in this upload get the new IDs
+	ids := make(map[int]int, len(created))
+	for _, t := range created {
+		ids[t.TransactionID] = t.ID
+	}
+	for i := range report.Rows {
+		if report.Rows[i].ID == -1 {
+			report.Rows[i].ID = ids[records[i].transaction.TransactionID]
+		}
+	}
+
+	return report, nil
+}
+
+// decodeJSONImport read a JSON array of transactions. Elements with fields of
+// the wrong type are reported per row while malformed JSON fails the upload.
+func decodeJSONImport(r io.Reader) ([]importRecord, error) {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); ok == false || delim != '[' {
+		return nil, errors.New("expected a JSON array of transactions")
+	}
+
+	var records []importRecord
+	for decoder.More() {
+		record := importRecord{}
+		if err := decoder.Decode(&record.transaction); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) == false {
+				return nil, err
+			}
+			record.err = fmt.Errorf("%s must be a %s", typeErr.Field, typeErr.Type)
+		}
+		records = append(records, record)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// decodeNDJSONImport read a transaction per line. Blank lines are ignored and
+// a line that does not parse is reported as a row.
+func decodeNDJSONImport(r io.Reader) ([]importRecord, error) {
+	var records []importRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxTransactionBody)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		record := importRecord{}
+		if err := json.Unmarshal(line, &record.transaction); err != nil {
+			record.err = err
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// decodeCSVImport read transactions from CSV with a header row naming the
+// JSON fields. The columns are those of the CSV export, but only an export
+// made as a role that sees every field, such as auditor, can be read back;
+// hashed, tokenized or shortened values are not the stored values.
+func decodeCSVImport(r io.Reader) ([]importRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	fields := transactionFields()
+	columns := make([]int, len(header))
+	for i, name := range header {
+		index, ok := fields[strings.TrimSpace(name)]
+		if ok == false {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		columns[i] = index
+	}
+
+	var records []importRecord
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		record := importRecord{}
+		var problems []string
+		if len(values) != len(header) {
+			problems = append(problems, fmt.Sprintf("expected %d columns, got %d", len(header), len(values)))
+		}
+		v := reflect.ValueOf(&record.transaction).Elem()
+		for i := 0; i < len(values) && i < len(header); i++ {
+			field := v.Field(columns[i])
+			value := strings.TrimSpace(values[i])
+			switch field.Kind() {
+			case reflect.Int:
+				if value == "" {
+					continue
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					problems = append(problems, header[i]+" must be an integer")
+					continue
+				}
+				field.SetInt(int64(n))
+			case reflect.String:
+				field.SetString(unescapeCell(value))
+			}
+		}
+		if problems != nil {
+			record.err = errors.New(strings.Join(problems, "; "))
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// transactionFields get the index of each Transaction field by JSON name
+func transactionFields() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(Transaction{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		fields[name] = i
+	}
+
+	return fields
+}
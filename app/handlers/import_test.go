@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// TestImport test importing uploads in each format
+func TestImport(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+	SetStore(NewMemoryStore(transactions.Transactions))
+	router := GetRouter(roleConfig())
+
+	upload := func(contentType, body string) (int, ImportReport) {
+		req := httptest.NewRequest(http.MethodPost, "/transactions/import", strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:40000"
+		req.Header.Set(roleHeader, "support")
+		req.Header.Set("Content-Type", contentType)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+
+		report := ImportReport{}
+		if res.Code == http.StatusOK {
+			is.NoErr(json.Unmarshal(res.Body.Bytes(), &report))
+		}
+		return res.Code, report
+	}
+
+	valid := `{"amount": 10, "created_at": "2021-07-01T10:00:00Z", "transaction_id": 9001,
+		"transaction_category": "grocery", "posted_timestamp": "2021-07-01T10:00:00Z",
+		"transaction_type": "POS", "sending_account": 1, "receiving_account": 2}`
+	invalid := `{"amount": -1, "created_at": "yesterday", "transaction_id": 9002,
+		"transaction_category": "Lottery", "posted_timestamp": "2021-07-01T10:00:00Z",
+		"transaction_type": "POS", "sending_account": 1, "receiving_account": 2}`
+	wrongType := `{"amount": "ten"}`
+
+	code, report := upload("application/json", "["+valid+","+invalid+","+wrongType+","+valid+"]")
+	is.Equal(code, http.StatusOK)
+	is.Equal(report.Imported, 1)
+	is.Equal(report.Invalid, 2)
+	is.Equal(report.Skipped, 1)
+	is.Equal(report.Rows[0].Status, importImported)
+	is.Equal(len(report.Rows[1].Errors), 3)
+	is.Equal(report.Rows[3].ID, report.Rows[0].ID)
+
+	stored, err := store.Get(report.Rows[0].ID)
+	is.NoErr(err)
+	is.Equal(stored.TransactionID, 9001)
+
+	// Uploading again changes nothing
+	code, report = upload("application/x-ndjson", strings.ReplaceAll(valid, "\n", "")+"\n\nnot json\n")
+	is.Equal(code, http.StatusOK)
+	is.Equal(report.Skipped, 1)
+	is.Equal(report.Invalid, 1)
+	is.Equal(report.Rows[1].Row, 2)
+
+	csvBody := "transaction_id,amount,created_at,posted_timestamp,transaction_category,transaction_type,sending_account,receiving_account\n" +
+		"9003,25,2021-07-02T10:00:00Z,2021-07-02T10:00:00Z,ATM,POS,3,4\n" +
+		"9004,x,2021-07-02T10:00:00Z,2021-07-02T10:00:00Z,ATM,POS,3,4\n"
+	code, report = upload("text/csv", csvBody)
+	is.Equal(code, http.StatusOK)
+	is.Equal(report.Imported, 1)
+	is.Equal(report.Invalid, 1)
+	is.Equal(report.Rows[1].Errors, []string{"amount must be an integer"})
+
+	code, _ = upload("text/csv", "colour\nred\n")
+	is.Equal(code, http.StatusBadRequest)
+	code, _ = upload("application/json", `{"not": "an array"}`)
+	is.Equal(code, http.StatusBadRequest)
+	code, _ = upload("text/plain", "")
+	is.Equal(code, http.StatusUnsupportedMediaType)
+
+	res := requestAs(router, "public", http.MethodPost, "/transactions/import", "["+valid+"]")
+	is.Equal(res.Code, http.StatusForbidden)
+}
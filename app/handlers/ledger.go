@@ -0,0 +1,485 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imarsman/nanovms/app/masking"
+)
+
+// Kinds of ledger issues
+const (
+	issueDuplicateID     = "duplicate_transaction_id"
+	issueUnknownAccount  = "unknown_account"
+	issueSameAccount     = "same_account"
+	issueBadTimestamp    = "bad_timestamp"
+	issueNegativeBalance = "negative_balance"
+	issueUnbalanced      = "unbalanced"
+)
+
+// LedgerIssue an inconsistency found while replaying transactions
+type LedgerIssue struct {
+	Kind          string `json:"kind"`
+	ID            int    `json:"id,omitempty"`
+	TransactionID int    `json:"transaction_id,omitempty"`
+	Account       int    `json:"account,omitempty"`
+	Message       string `json:"message"`
+}
+
+// accountField the policy field whose rule masks account numbers given on
+// their own, such as the account of a balance or an issue
+const accountField = "sending_account"
+
+// Entry a posting to one account. Amount is negative for the sending account
+// and positive for the receiving account. Field names match Transaction so
+// the same masking rules apply.
+type Entry struct {
+	ID               int       `json:"id"`
+	TransactionID    int       `json:"transaction_id"`
+	PostedTimeStamp  time.Time `json:"posted_timestamp"`
+	Amount           int       `json:"amount"`
+	Balance          int       `json:"balance"`
+	SendingAccount   int       `json:"sending_account"`
+	ReceivingAccount int       `json:"receiving_account"`
+}
+
+// Account an account's running balance and entries in posting order
+type Account struct {
+	ID      int
+	Opening int // balance before any entries
+	Balance int
+	Entries []Entry
+}
+
+// Ledger accounts built by replaying transactions with double-entry
+// bookkeeping. Each transaction debits the sending account and credits the
+// receiving account by the same amount, so all balances sum to the opening
+// balances.
+type Ledger struct {
+	Accounts map[int]*Account
+	Issues   []LedgerIssue
+	Opening  int // sum of opening balances
+	Total    int // sum of all balances
+}
+
+// NewLedger replay transactions in posting order into a ledger, starting from
+// the opening balances of the known accounts. Transactions with duplicate
+// transaction IDs, identical accounts or timestamps that do not parse are
+// flagged and not posted. When accounts are known, transactions with other
+// accounts are flagged and not posted too, and balances that go below zero
+// are flagged. With no known accounts there are no opening balances to go
+// below zero from.
+func NewLedger(transactions []Transaction, opening map[int]int) *Ledger {
+	l := Ledger{}
+	l.Accounts = make(map[int]*Account)
+	for id, balance := range opening {
+		l.Accounts[id] = &Account{ID: id, Opening: balance, Balance: balance}
+		l.Opening += balance
+	}
+	known := len(opening) > 0
+
+	type posting struct {
+		t      Transaction
+		posted time.Time
+	}
+	var postings []posting
+	for _, t := range transactions {
+		posted, err := t.Posted()
+		if err != nil {
+			l.flag(issueBadTimestamp, t, 0, fmt.Sprintf("posted_timestamp %q does not parse", t.PostedTimeStamp))
+			continue
+		}
+		postings = append(postings, posting{t: t, posted: posted})
+	}
+	sort.SliceStable(postings, func(i, j int) bool {
+		if postings[i].posted.Equal(postings[j].posted) {
+			return postings[i].t.ID < postings[j].t.ID
+		}
+		return postings[i].posted.Before(postings[j].posted)
+	})
+
+	seen := make(map[int]int) // transaction ID to ID of first transaction
+	negative := make(map[int]bool)
+	for _, p := range postings {
+		t := p.t
+		if first, ok := seen[t.TransactionID]; ok {
+			l.flag(issueDuplicateID, t, 0, fmt.Sprintf("transaction_id already posted by id %d", first))
+			continue
+		}
+		if unknown := unknownAccount(t, opening); known && unknown != 0 {
+			l.flag(issueUnknownAccount, t, unknown, "account is not known")
+			continue
+		}
+		if t.SendingAccount == t.ReceivingAccount {
+			l.flag(issueSameAccount, t, t.SendingAccount, "sending and receiving accounts are the same")
+			continue
+		}
+		seen[t.TransactionID] = t.ID
+
+		l.post(t, p.posted, t.SendingAccount, -t.Amount)
+		l.post(t, p.posted, t.ReceivingAccount, t.Amount)
+
+		sender := l.Accounts[t.SendingAccount]
+		if known && sender.Balance < 0 && negative[sender.ID] == false {
+			negative[sender.ID] = true
+			l.flag(issueNegativeBalance, t, sender.ID, fmt.Sprintf("balance went to %d", sender.Balance))
+		}
+	}
+
+	for _, a := range l.Accounts {
+		l.Total += a.Balance
+	}
+	if l.Balanced() == false {
+		l.Issues = append(l.Issues, LedgerIssue{Kind: issueUnbalanced, Message: fmt.Sprintf("balances sum to %d, not %d", l.Total, l.Opening)})
+	}
+
+	return &l
+}
+
+// unknownAccount get an account of a transaction that has no opening
+// balance, or 0 if both have one
+func unknownAccount(t Transaction, opening map[int]int) int {
+	for _, account := range []int{t.SendingAccount, t.ReceivingAccount} {
+		if _, ok := opening[account]; ok == false {
+			return account
+		}
+	}
+
+	return 0
+}
+
+// Balanced whether the balances sum to the opening balances
+func (l *Ledger) Balanced() bool {
+	return l.Total == l.Opening
+}
+
+// flag record an issue for a transaction
+func (l *Ledger) flag(kind string, t Transaction, account int, message string) {
+	l.Issues = append(l.Issues, LedgerIssue{
+		Kind:          kind,
+		ID:            t.ID,
+		TransactionID: t.TransactionID,
+		Account:       account,
+		Message:       message,
+	})
+}
+
+// post add an entry to an account, creating the account if needed
+func (l *Ledger) post(t Transaction, posted time.Time, account int, amount int) {
+	a, ok := l.Accounts[account]
+	if ok == false {
+		a = &Account{ID: account}
+		l.Accounts[account] = a
+	}
+	a.Balance += amount
+	a.Entries = append(a.Entries, Entry{
+		ID:               t.ID,
+		TransactionID:    t.TransactionID,
+		PostedTimeStamp:  posted,
+		Amount:           amount,
+		Balance:          a.Balance,
+		SendingAccount:   t.SendingAccount,
+		ReceivingAccount: t.ReceivingAccount,
+	})
+}
+
+// AccountIssues get the issues involving an account
+func (l *Ledger) AccountIssues(account int) []LedgerIssue {
+	issues := []LedgerIssue{}
+	for _, issue := range l.Issues {
+		if issue.Account == account {
+			issues = append(issues, issue)
+		}
+	}
+
+	return issues
+}
+
+// Statement the entries for an account posted in a period with the balances
+// before and after
+type Statement struct {
+	Account        int
+	From           time.Time
+	To             time.Time
+	OpeningBalance int
+	ClosingBalance int
+	Entries        []Entry
+}
+
+// Statement get a statement for entries posted from from, inclusive, to to,
+// exclusive. Zero times leave the period open at that end.
+func (a *Account) Statement(from, to time.Time) *Statement {
+	s := Statement{Account: a.ID, From: from, To: to, OpeningBalance: a.Opening}
+	s.Entries = []Entry{}
+	for _, e := range a.Entries {
+		if from.IsZero() == false && e.PostedTimeStamp.Before(from) {
+			s.OpeningBalance = e.Balance
+			continue
+		}
+		if to.IsZero() == false && e.PostedTimeStamp.Before(to) == false {
+			break
+		}
+		s.Entries = append(s.Entries, e)
+	}
+	s.ClosingBalance = s.OpeningBalance
+	if len(s.Entries) > 0 {
+		s.ClosingBalance = s.Entries[len(s.Entries)-1].Balance
+	}
+
+	return &s
+}
+
+// currentLedger build a ledger from the transactions in the store
+func currentLedger(w http.ResponseWriter) (*Ledger, bool) {
+	transactions, err := store.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+
+	return NewLedger(transactions, conf.Ledger.Accounts), true
+}
+
+// ledgerAccount get the account named in the request path from a ledger. It
+// is named as the caller's role sees it, so roles that see accounts masked use
+// the masked value and can not look up balances by account number.
+func ledgerAccount(w http.ResponseWriter, r *http.Request, l *Ledger, rp *masking.RolePolicy) (*Account, bool) {
+	key := mux.Vars(r)["id"]
+	if rp.Masks(accountField) == false {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid account")
+			return nil, false
+		}
+		a, ok := l.Accounts[id]
+		if ok == false {
+			writeError(w, http.StatusNotFound, "account not found")
+			return nil, false
+		}
+		return a, true
+	}
+
+	var found *Account
+	for _, a := range l.Accounts {
+		masked, err := masker.Value(rp, accountField, a.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return nil, false
+		}
+		if fmt.Sprint(masked) != key {
+			continue
+		}
+		// Masked values such as the last digits can be shared by accounts
+		if found != nil {
+			found = nil
+			break
+		}
+		found = a
+	}
+	if found == nil {
+		writeError(w, http.StatusNotFound, "account not found")
+		return nil, false
+	}
+
+	return found, true
+}
+
+// parseStatementTime parse a statement period bound as an RFC 3339 timestamp
+// or a date. A date as the exclusive end of a period is taken as the start of
+// the next day so that the whole day is included.
+func parseStatementTime(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// maskedIssue a ledger issue with its transaction ID and account masked
+type maskedIssue struct {
+	Kind          string      `json:"kind"`
+	ID            int         `json:"id,omitempty"`
+	TransactionID interface{} `json:"transaction_id,omitempty"`
+	Account       interface{} `json:"account,omitempty"`
+	Message       string      `json:"message"`
+}
+
+// maskIssues get ledger issues with fields masked for a role
+func maskIssues(rp *masking.RolePolicy, issues []LedgerIssue) ([]maskedIssue, error) {
+	masked := make([]maskedIssue, 0, len(issues))
+	for _, issue := range issues {
+		mi := maskedIssue{Kind: issue.Kind, ID: issue.ID, Message: issue.Message}
+		var err error
+		if issue.TransactionID != 0 {
+			if mi.TransactionID, err = masker.Value(rp, "transaction_id", issue.TransactionID); err != nil {
+				return nil, err
+			}
+		}
+		if issue.Account != 0 {
+			if mi.Account, err = masker.Value(rp, accountField, issue.Account); err != nil {
+				return nil, err
+			}
+		}
+		masked = append(masked, mi)
+	}
+
+	return masked, nil
+}
+
+// maskEntries get the masked fields of ledger entries for a role
+func maskEntries(rp *masking.RolePolicy, entries []Entry) ([]masking.Object, error) {
+	objects := make([]masking.Object, 0, len(entries))
+	for i := range entries {
+		o, err := masker.Fields(rp, &entries[i])
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+
+	return objects, nil
+}
+
+// LedgerHandler get a summary of the ledger and all issues found
+func LedgerHandler(w http.ResponseWriter, r *http.Request) {
+	rp, ok := callerPolicy(w, r)
+	if ok == false {
+		return
+	}
+	l, ok := currentLedger(w)
+	if ok == false {
+		return
+	}
+	issues, err := maskIssues(rp, l.Issues)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	summary := struct {
+		Accounts int           `json:"accounts"`
+		Balanced bool          `json:"balanced"`
+		Issues   []maskedIssue `json:"issues"`
+	}{len(l.Accounts), l.Balanced(), issues}
+
+	writeJSON(w, http.StatusOK, &summary)
+}
+
+// BalanceHandler get the balance of an account
+func BalanceHandler(w http.ResponseWriter, r *http.Request) {
+	rp, ok := callerPolicy(w, r)
+	if ok == false {
+		return
+	}
+	l, ok := currentLedger(w)
+	if ok == false {
+		return
+	}
+	a, ok := ledgerAccount(w, r, l, rp)
+	if ok == false {
+		return
+	}
+	account, err := masker.Value(rp, accountField, a.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	issues, err := maskIssues(rp, l.AccountIssues(a.ID))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	balance := struct {
+		Account interface{}   `json:"account"`
+		Balance int           `json:"balance"`
+		Entries int           `json:"entries"`
+		Issues  []maskedIssue `json:"issues"`
+	}{account, a.Balance, len(a.Entries), issues}
+
+	writeJSON(w, http.StatusOK, &balance)
+}
+
+// StatementHandler get the entries for an account between the from and to
+// query parameters, with opening and closing balances
+func StatementHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := parseStatementTime(r.URL.Query().Get("from"), false)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "from must be an RFC 3339 timestamp or a date")
+		return
+	}
+	to, err := parseStatementTime(r.URL.Query().Get("to"), true)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "to must be an RFC 3339 timestamp or a date")
+		return
+	}
+	rp, ok := callerPolicy(w, r)
+	if ok == false {
+		return
+	}
+
+	l, ok := currentLedger(w)
+	if ok == false {
+		return
+	}
+	a, ok := ledgerAccount(w, r, l, rp)
+	if ok == false {
+		return
+	}
+
+	s := a.Statement(from, to)
+	entries, err := maskEntries(rp, s.Entries)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	account, err := masker.Value(rp, accountField, s.Account)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	issues, err := maskIssues(rp, l.AccountIssues(a.ID))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	statement := struct {
+		Account        interface{}      `json:"account"`
+		From           *time.Time       `json:"from,omitempty"`
+		To             *time.Time       `json:"to,omitempty"`
+		OpeningBalance int              `json:"opening_balance"`
+		ClosingBalance int              `json:"closing_balance"`
+		Entries        []masking.Object `json:"entries"`
+		Issues         []maskedIssue    `json:"issues"`
+	}{
+		Account:        account,
+		OpeningBalance: s.OpeningBalance,
+		ClosingBalance: s.ClosingBalance,
+		Entries:        entries,
+		Issues:         issues,
+	}
+	if from.IsZero() == false {
+		statement.From = &from
+	}
+	if to.IsZero() == false {
+		statement.To = &to
+	}
+
+	writeJSON(w, http.StatusOK, &statement)
+}
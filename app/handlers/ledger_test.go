@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/masking"
+	"github.com/matryer/is"
+)
+
+// ledgerTransaction a transaction between two accounts posted on a day in
+// July 2021
+func ledgerTransaction(id, transactionID, from, to, amount, day int) Transaction {
+	t := sampleTransaction()
+	t.ID = id
+	t.TransactionID = transactionID
+	t.SendingAccount = from
+	t.ReceivingAccount = to
+	t.Amount = amount
+	t.PostedTimeStamp = time.Date(2021, 7, day, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)
+
+	return t
+}
+
+// TestLedger test balances and issues from replaying transactions
+func TestLedger(t *testing.T) {
+	is := is.New(t)
+
+	transactions := []Transaction{
+		ledgerTransaction(2, 102, 20, 10, 300, 2),
+		ledgerTransaction(1, 101, 10, 20, 500, 1),
+		ledgerTransaction(3, 103, 20, 30, 100, 3),
+		ledgerTransaction(4, 101, 10, 20, 500, 4), // duplicate transaction ID
+		ledgerTransaction(5, 105, 40, 20, 50, 5),  // unknown account
+		ledgerTransaction(6, 106, 30, 30, 50, 6),  // same account
+	}
+	bad := ledgerTransaction(7, 107, 10, 20, 1, 7)
+	bad.PostedTimeStamp = "soon"
+	transactions = append(transactions, bad)
+
+	l := NewLedger(transactions, map[int]int{10: 100, 20: 0, 30: 0})
+	is.Equal(l.Total, 100)
+	is.True(l.Balanced())
+	is.Equal(l.Accounts[10].Balance, -100)
+	is.Equal(l.Accounts[20].Balance, 100)
+	is.Equal(l.Accounts[30].Balance, 100)
+	is.True(l.Accounts[40] == nil)
+
+	// Entries are in posting order with running balances
+	is.Equal(l.Accounts[10].Entries[0].ID, 1)
+	is.Equal(l.Accounts[10].Entries[0].Balance, -400)
+	is.Equal(l.Accounts[10].Entries[1].Balance, -100)
+
+	kinds := map[string]int{}
+	for _, issue := range l.Issues {
+		kinds[issue.Kind]++
+	}
+	is.Equal(kinds[issueDuplicateID], 1)
+	is.Equal(kinds[issueUnknownAccount], 1)
+	is.Equal(kinds[issueSameAccount], 1)
+	is.Equal(kinds[issueBadTimestamp], 1)
+	is.Equal(kinds[issueNegativeBalance], 1)
+	is.Equal(kinds[issueUnbalanced], 0)
+
+	s := l.Accounts[20].Statement(time.Date(2021, 7, 2, 0, 0, 0, 0, time.UTC), time.Date(2021, 7, 3, 0, 0, 0, 0, time.UTC))
+	is.Equal(s.OpeningBalance, 500)
+	is.Equal(len(s.Entries), 1)
+	is.Equal(s.ClosingBalance, 200)
+	s = l.Accounts[10].Statement(time.Time{}, time.Time{})
+	is.Equal(s.OpeningBalance, 100)
+
+	// With no known accounts there are no opening balances to check against
+	l = NewLedger(transactions, nil)
+	is.Equal(l.Total, 0)
+	is.Equal(l.Accounts[40].Balance, -50)
+	for _, issue := range l.Issues {
+		is.True(issue.Kind != issueUnknownAccount && issue.Kind != issueNegativeBalance)
+	}
+}
+
+// TestLedgerHandlers test the balance and statement endpoints
+func TestLedgerHandlers(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+	SetStore(NewMemoryStore(transactions.Transactions))
+	router := GetRouter(roleConfig())
+
+	res := requestAs(router, "auditor", http.MethodGet, "/accounts/1234/balance", "")
+	is.Equal(res.Code, http.StatusOK)
+	t.Log(res.Body.String())
+
+	// Roles that see accounts masked name them by the masked value
+	res = request(router, http.MethodGet, "/accounts/1234/balance", "")
+	is.Equal(res.Code, http.StatusNotFound)
+	for _, role := range []string{"public", "support"} {
+		res = requestAs(router, role, http.MethodGet, "/transactions/1", "")
+		is.Equal(res.Code, http.StatusOK)
+		masked := map[string]interface{}{}
+		is.NoErr(json.Unmarshal(res.Body.Bytes(), &masked))
+		account := masked["sending_account"].(string)
+
+		res = requestAs(router, role, http.MethodGet, "/accounts/"+account+"/balance", "")
+		is.Equal(res.Code, http.StatusOK)
+		balance := map[string]interface{}{}
+		is.NoErr(json.Unmarshal(res.Body.Bytes(), &balance))
+		is.Equal(balance["account"], account)
+		res = requestAs(router, role, http.MethodGet, "/accounts/"+account+"/statement", "")
+		is.Equal(res.Code, http.StatusOK)
+	}
+
+	res = requestAs(router, "auditor", http.MethodGet, "/accounts/1234/statement?from=2020-01-01&to=2030-01-01", "")
+	is.Equal(res.Code, http.StatusOK)
+	statement := struct {
+		Account int                      `json:"account"`
+		Entries []map[string]interface{} `json:"entries"`
+	}{}
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &statement))
+	is.Equal(statement.Account, 1234)
+	is.True(len(statement.Entries) > 0)
+
+	res = request(router, http.MethodGet, "/accounts/1234/statement?from=last+week", "")
+	is.Equal(res.Code, http.StatusBadRequest)
+
+	res = requestAs(router, "auditor", http.MethodGet, "/accounts/1/balance", "")
+	is.Equal(res.Code, http.StatusNotFound)
+	res = requestAs(router, "auditor", http.MethodGet, "/accounts/h_1234/balance", "")
+	is.Equal(res.Code, http.StatusBadRequest)
+
+	res = request(router, http.MethodGet, "/ledger", "")
+	is.Equal(res.Code, http.StatusOK)
+	t.Log(res.Body.String())
+	is.True(strings.Contains(res.Body.String(), issueNegativeBalance) == false)
+
+	// Accounts and transaction IDs are masked for the caller's role
+	SetStore(NewMemoryStore([]Transaction{
+		ledgerTransaction(1, 101, 10, 20, 500, 1),
+		ledgerTransaction(2, 102, 20, 10, 300, 2),
+		ledgerTransaction(3, 12345, 10, 10, 50, 3), // same account
+	}))
+	hashed, err := masker.Value(&masking.RolePolicy{Fields: map[string]masking.Rule{accountField: {Action: masking.ActionHash}}}, accountField, 10)
+	is.NoErr(err)
+	res = request(router, http.MethodGet, "/accounts/"+hashed.(string)+"/balance", "")
+	is.Equal(res.Code, http.StatusOK)
+	balance := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &balance))
+	is.Equal(balance["account"], hashed)
+	is.True(strings.Contains(res.Body.String(), "12345") == false)
+
+	res = request(router, http.MethodGet, "/ledger", "")
+	is.Equal(res.Code, http.StatusOK)
+	is.True(strings.Contains(res.Body.String(), `"transaction_id": 2345`))
+	is.True(strings.Contains(res.Body.String(), `"account": "h_`))
+
+	// Known accounts are checked for overdrafts and transactions with others
+	c := roleConfig()
+	c.Ledger.Accounts = config.AccountBalances{10: 100, 30: 0}
+	res = request(GetRouter(c), http.MethodGet, "/ledger", "")
+	is.Equal(res.Code, http.StatusOK)
+	is.True(strings.Contains(res.Body.String(), issueUnknownAccount))
+	router = GetRouter(roleConfig())
+
+	// A date as the end of a period includes that day
+	res = requestAs(router, "auditor", http.MethodGet, "/accounts/20/statement?from=2021-07-02&to=2021-07-02", "")
+	is.Equal(res.Code, http.StatusOK)
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &statement))
+	is.Equal(len(statement.Entries), 1)
+	is.Equal(statement.Entries[0]["id"], float64(2))
+}
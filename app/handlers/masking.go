@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/masking"
+)
+
+// roleHeader header naming the role of the caller. It is only read when
+// configured, and then only from an authenticating proxy in front of the app.
+const roleHeader = "X-Role"
+
+var masker *masking.Masker
+
+// init set up a masker with the built in policy so the handlers work before
+// any policy is configured
+func init() {
+	var err error
+	masker, err = OpenMasker(config.Default())
+	if err != nil {
+		panic(err)
+	}
+}
+
+// SetMasker set the masker used for transaction output
+func SetMasker(m *masking.Masker) {
+	masker = m
+}
+
+// OpenMasker get a masker using the policy file and hash key in the
+// configuration, or the built in policy if no file is set
+func OpenMasker(c *config.Config) (*masking.Masker, error) {
+	var policy *masking.Policy
+	var err error
+	if c.Masking.PolicyFile == "" {
+		policy, err = masking.DefaultPolicy()
+	} else {
+		policy, err = masking.LoadPolicy(c.Masking.PolicyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return masking.NewMasker(policy, masking.NewVault(), c.Masking.HashKey)
+}
+
+// callerRole get the role named by a trusted proxy, or an empty string for
+// the policy's default role
+func callerRole(r *http.Request) string {
+	if conf.Masking.RoleHeader == false {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	for _, proxy := range conf.Masking.TrustedProxies {
+		if network, err := config.ParseNetwork(proxy); err == nil && ip != nil && network.Contains(ip) {
+			return r.Header.Get(roleHeader)
+		}
+	}
+
+	return ""
+}
+
+// callerPolicy get the masking policy for the role of the caller, writing an
+// error response if there is none
+func callerPolicy(w http.ResponseWriter, r *http.Request) (*masking.RolePolicy, bool) {
+	rp, err := masker.Role(callerRole(r))
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return nil, false
+	}
+
+	return rp, true
+}
+
+// callerWriter check that the role of the caller may change transactions,
+// writing an error response if not
+func callerWriter(w http.ResponseWriter, r *http.Request) bool {
+	rp, ok := callerPolicy(w, r)
+	if ok == false {
+		return false
+	}
+	if rp.Write == false {
+		writeError(w, http.StatusForbidden, "role may not change transactions")
+		return false
+	}
+
+	return true
+}
+
+// DetokenizeHandler get the value behind a token, for roles allowed to
+// reverse tokens
+func DetokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	rp, ok := callerPolicy(w, r)
+	if ok == false {
+		return
+	}
+	if rp.Detokenize == false {
+		writeError(w, http.StatusForbidden, "role may not detokenize")
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	value, ok := masker.Vault().Detokenize(token)
+	if ok == false {
+		writeError(w, http.StatusNotFound, "token not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"token": token, "value": value})
+}
@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"container/heap"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imarsman/nanovms/app/masking"
+)
+
+// Limits on the number of transactions returned in a page
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// sortKey value of the field a list is sorted by. Only one of the fields is
+// used for any given sort field.
+type sortKey struct {
+	Int int64  `json:"i,omitempty"`
+	Str string `json:"s,omitempty"`
+}
+
+// compare compare two keys, returning -1, 0 or 1
+func (k sortKey) compare(other sortKey) int {
+	switch {
+	case k.Int < other.Int:
+		return -1
+	case k.Int > other.Int:
+		return 1
+	case k.Str < other.Str:
+		return -1
+	case k.Str > other.Str:
+		return 1
+	}
+
+	return 0
+}
+
+// timeKey key for a timestamp string. Timestamps that do not parse sort first.
+func timeKey(s string) sortKey {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return sortKey{}
+	}
+
+	return sortKey{Int: t.UnixNano()}
+}
+
+// sortFields the fields transactions can be sorted by, keyed by JSON name
+var sortFields = map[string]func(t *Transaction) sortKey{
+	"id":                   func(t *Transaction) sortKey { return sortKey{Int: int64(t.ID)} },
+	"amount":               func(t *Transaction) sortKey { return sortKey{Int: int64(t.Amount)} },
+	"transaction_id":       func(t *Transaction) sortKey { return sortKey{Int: int64(t.TransactionID)} },
+	"sending_account":      func(t *Transaction) sortKey { return sortKey{Int: int64(t.SendingAccount)} },
+	"receiving_account":    func(t *Transaction) sortKey { return sortKey{Int: int64(t.ReceivingAccount)} },
+	"transaction_category": func(t *Transaction) sortKey { return sortKey{Str: t.TransactionCategory} },
+	"transaction_type":     func(t *Transaction) sortKey { return sortKey{Str: t.TransactionType} },
+	"created_at":           func(t *Transaction) sortKey { return timeKey(t.CreatedAt) },
+	"posted_timestamp":     func(t *Transaction) sortKey { return timeKey(t.PostedTimeStamp) },
+}
+
+// sortSpec a sort field and direction, written as the field name with a
+// leading "-" for descending order
+type sortSpec struct {
+	field      string
+	descending bool
+}
+
+func (s sortSpec) String() string {
+	if s.descending {
+		return "-" + s.field
+	}
+	return s.field
+}
+
+// compare compare two transactions in sort order, using ID to break ties so
+// that the order is total and cursors are stable
+func (s sortSpec) compare(a, b *Transaction) int {
+	key := sortFields[s.field]
+
+	return s.compareKey(key(a), a.ID, key(b), b.ID)
+}
+
+func (s sortSpec) compareKey(aKey sortKey, aID int, bKey sortKey, bID int) int {
+	c := aKey.compare(bKey)
+	if s.descending {
+		c = -c
+	}
+	if c != 0 {
+		return c
+	}
+	switch {
+	case aID < bID:
+		return -1
+	case aID > bID:
+		return 1
+	}
+
+	return 0
+}
+
+// cursor position after the last transaction of a page. The key can be a
+// value the caller's role may not see, such as an account number, so cursors
+// are sealed before being given to clients.
+type cursor struct {
+	Sort string  `json:"sort"`
+	Key  sortKey `json:"key"`
+	ID   int     `json:"id"`
+}
+
+// cursorAEAD seals cursors. The key is random, so cursors are only good for
+// the life of the process.
+var cursorAEAD cipher.AEAD
+
+func init() {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	cursorAEAD, err = cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// encode seal a cursor, prefixing the nonce
+func (c *cursor) encode() string {
+	bytes, _ := json.Marshal(c)
+	nonce := make([]byte, cursorAEAD.NonceSize())
+	rand.Read(nonce)
+
+	return base64.RawURLEncoding.EncodeToString(cursorAEAD.Seal(nonce, nonce, bytes, nil))
+}
+
+// decodeCursor open a cursor sealed by encode
+func decodeCursor(s string) (*cursor, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(sealed) < cursorAEAD.NonceSize() {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	nonce, sealed := sealed[:cursorAEAD.NonceSize()], sealed[cursorAEAD.NonceSize():]
+	bytes, err := cursorAEAD.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	c := cursor{}
+	if err := json.Unmarshal(bytes, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	return &c, nil
+}
+
+// transactionQuery filters, sort order and page for a list of transactions
+type transactionQuery struct {
+	category   string
+	txType     string
+	account    int
+	minAmount  *int
+	maxAmount  *int
+	postedFrom *time.Time
+	postedTo   *time.Time
+	sort       sortSpec
+	limit      int
+	after      *cursor
+}
+
+// parseTransactionQuery read a query from URL parameters:
+//
+//	category      transaction_category, case insensitive
+//	type          transaction_type, case insensitive
+//	account       sending or receiving account
+//	min_amount    smallest amount, inclusive
+//	max_amount    largest amount, inclusive
+//	posted_from   earliest posted_timestamp, RFC 3339, inclusive
+//	posted_to     latest posted_timestamp, RFC 3339, exclusive
+//	sort          field to sort by, prefixed with - for descending
+//	              (default -posted_timestamp)
+//	limit         page size (maximum 1000, default 100 for JSON and
+//	              no limit for streamed CSV and NDJSON exports)
+//	cursor        opaque cursor from the next link of a previous page
+func parseTransactionQuery(values url.Values) (*transactionQuery, error) {
+	q := transactionQuery{}
+	q.category = values.Get("category")
+	q.txType = values.Get("type")
+	q.sort = sortSpec{field: "posted_timestamp", descending: true}
+
+	var err error
+	if v := values.Get("account"); v != "" {
+		if q.account, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("account must be a number")
+		}
+	}
+	for name, dest := range map[string]**int{"min_amount": &q.minAmount, "max_amount": &q.maxAmount} {
+		if v := values.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", name)
+			}
+			*dest = &n
+		}
+	}
+	for name, dest := range map[string]**time.Time{"posted_from": &q.postedFrom, "posted_to": &q.postedTo} {
+		if v := values.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*dest = &t
+		}
+	}
+	if v := values.Get("sort"); v != "" {
+		q.sort = sortSpec{field: strings.TrimPrefix(v, "-"), descending: strings.HasPrefix(v, "-")}
+		if _, ok := sortFields[q.sort.field]; ok == false {
+			return nil, fmt.Errorf("cannot sort by %s", q.sort.field)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 || q.limit > maxPageLimit {
+			return nil, fmt.Errorf("limit must be a number from 1 to %d", maxPageLimit)
+		}
+	}
+	if v := values.Get("cursor"); v != "" {
+		if q.after, err = decodeCursor(v); err != nil {
+			return nil, err
+		}
+		if q.after.Sort != q.sort.String() {
+			return nil, fmt.Errorf("cursor is for sort %s, not %s", q.after.Sort, q.sort)
+		}
+	}
+
+	return &q, nil
+}
+
+// permitted check that the caller's role sees the fields filtered and sorted
+// by in the clear, as the results would otherwise match masked values to the
+// ones they hide
+func (q *transactionQuery) permitted(rp *masking.RolePolicy) error {
+	if q.account != 0 && (rp.Masks("sending_account") || rp.Masks("receiving_account")) {
+		return fmt.Errorf("accounts are masked for the caller's role and can not be filtered by")
+	}
+	if rp.Masks(q.sort.field) {
+		return fmt.Errorf("%s is masked for the caller's role and can not be sorted by", q.sort.field)
+	}
+
+	return nil
+}
+
+// matches check whether a transaction passes the query filters
+func (q *transactionQuery) matches(t *Transaction) bool {
+	if q.category != "" && strings.EqualFold(t.TransactionCategory, q.category) == false {
+		return false
+	}
+	if q.txType != "" && strings.EqualFold(t.TransactionType, q.txType) == false {
+		return false
+	}
+	if q.account != 0 && t.SendingAccount != q.account && t.ReceivingAccount != q.account {
+		return false
+	}
+	if q.minAmount != nil && t.Amount < *q.minAmount {
+		return false
+	}
+	if q.maxAmount != nil && t.Amount > *q.maxAmount {
+		return false
+	}
+	if q.postedFrom != nil || q.postedTo != nil {
+		posted, err := t.Posted()
+		if err != nil {
+			return false
+		}
+		if q.postedFrom != nil && posted.Before(*q.postedFrom) {
+			return false
+		}
+		if q.postedTo != nil && posted.Before(*q.postedTo) == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pageHeap transactions with the last in sort order on top
+type pageHeap struct {
+	sort  sortSpec
+	items []Transaction
+}
+
+func (h *pageHeap) Len() int           { return len(h.items) }
+func (h *pageHeap) Less(i, j int) bool { return h.sort.compare(&h.items[i], &h.items[j]) > 0 }
+func (h *pageHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *pageHeap) Push(x interface{}) { h.items = append(h.items, x.(Transaction)) }
+func (h *pageHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// page get up to limit matching transactions after a cursor in sort order.
+// The store is read in one pass keeping only the best limit transactions, so
+// memory use does not grow with the store. The returned cursor is nil if there
+// are no more pages.
+func (q *transactionQuery) page(s TransactionStore, after *cursor, limit int) ([]Transaction, *cursor, error) {
+	// One more than the limit is kept to tell whether there is another page
+	h := pageHeap{sort: q.sort}
+	err := s.Each(func(t Transaction) bool {
+		if q.matches(&t) == false {
+			return true
+		}
+		if after != nil && q.sort.compareKey(sortFields[q.sort.field](&t), t.ID, after.Key, after.ID) <= 0 {
+			return true
+		}
+		if h.Len() <= limit {
+			heap.Push(&h, t)
+		} else if q.sort.compare(&t, &h.items[0]) < 0 {
+			h.items[0] = t
+			heap.Fix(&h, 0)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	more := h.Len() > limit
+	if more {
+		heap.Pop(&h)
+	}
+	page := make([]Transaction, h.Len())
+	for i := len(page) - 1; i >= 0; i-- {
+		page[i] = heap.Pop(&h).(Transaction)
+	}
+	if more == false || len(page) == 0 {
+		return page, nil, nil
+	}
+
+	last := &page[len(page)-1]
+	next := cursor{Sort: q.sort.String(), Key: sortFields[q.sort.field](last), ID: last.ID}
+
+	return page, &next, nil
+}
+
+// transactionSource calls fn for transactions in order until fn fails
+type transactionSource func(fn func(t *Transaction) error) error
+
+// pageSource get a source for a page of transactions
+func pageSource(page []Transaction) transactionSource {
+	return func(fn func(t *Transaction) error) error {
+		for i := range page {
+			if err := fn(&page[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// position the place of a transaction in sort order
+type position struct {
+	key sortKey
+	id  int
+}
+
+// all get a source of every matching transaction after the query cursor in
+// sort order. The store is read once for the order of the matching
+// transactions, which are then got one at a time as they are written, so
+// only their keys are held.
+func (q *transactionQuery) all(s TransactionStore) transactionSource {
+	return func(fn func(t *Transaction) error) error {
+		keyOf := sortFields[q.sort.field]
+		var order []position
+		err := s.Each(func(t Transaction) bool {
+			if q.matches(&t) == false {
+				return true
+			}
+			key := keyOf(&t)
+			if q.after != nil && q.sort.compareKey(key, t.ID, q.after.Key, q.after.ID) <= 0 {
+				return true
+			}
+			order = append(order, position{key: key, id: t.ID})
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return q.sort.compareKey(order[i].key, order[i].id, order[j].key, order[j].id) < 0
+		})
+
+		for _, p := range order {
+			t, err := s.Get(p.id)
+			if err == ErrNotFound {
+				continue // deleted since
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(&t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// nextLink get the URL of the page after cursor c, keeping the other query
+// parameters
+func nextLink(u *url.URL, c *cursor) string {
+	values := u.Query()
+	values.Set("cursor", c.encode())
+
+	next := url.URL{Path: u.Path, RawQuery: values.Encode()}
+
+	return next.String()
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// apply get the page of transactions for a query, with no limit when the
+// query has none
+func (q *transactionQuery) apply(transactions []Transaction) ([]Transaction, *cursor) {
+	limit := q.limit
+	if limit == 0 {
+		limit = len(transactions) + 1
+	}
+	page, next, _ := q.page(NewMemoryStore(transactions), q.after, limit)
+
+	return page, next
+}
+
+// sampleQuery parse a query string, failing the test on error
+func sampleQuery(t *testing.T, raw string) *transactionQuery {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := parseTransactionQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+// TestFilter test query filters
+func TestFilter(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+
+	page, next := sampleQuery(t, "category=grocery").apply(transactions.Transactions)
+	is.True(next == nil)
+	is.True(len(page) > 0)
+	for _, tr := range page {
+		is.Equal(tr.TransactionCategory, "Grocery")
+	}
+
+	page, _ = sampleQuery(t, "min_amount=400&max_amount=1000").apply(transactions.Transactions)
+	for _, tr := range page {
+		is.True(tr.Amount >= 400 && tr.Amount <= 1000)
+	}
+
+	page, _ = sampleQuery(t, "account=1234").apply(transactions.Transactions)
+	is.True(len(page) > 0)
+	for _, tr := range page {
+		is.True(tr.SendingAccount == 1234 || tr.ReceivingAccount == 1234)
+	}
+
+	page, _ = sampleQuery(t, "posted_from=2099-01-01T00:00:00Z").apply(transactions.Transactions)
+	is.Equal(len(page), 0)
+
+	for _, bad := range []string{"account=x", "min_amount=ten", "posted_to=yesterday", "sort=note", "limit=0", "cursor=notacursor"} {
+		values, _ := url.ParseQuery(bad)
+		_, err := parseTransactionQuery(values)
+		is.True(err != nil)
+	}
+}
+
+// TestSortFields test sorting by time and by other fields in both directions
+func TestSortFields(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+
+	page, _ := sampleQuery(t, "").apply(transactions.Transactions)
+	for i := 1; i < len(page); i++ {
+		a, _ := page[i-1].Posted()
+		b, _ := page[i].Posted()
+		is.True(a.Before(b) == false)
+	}
+
+	page, _ = sampleQuery(t, "sort=amount").apply(transactions.Transactions)
+	for i := 1; i < len(page); i++ {
+		is.True(page[i-1].Amount <= page[i].Amount)
+	}
+
+	page, _ = sampleQuery(t, "sort=-transaction_category").apply(transactions.Transactions)
+	for i := 1; i < len(page); i++ {
+		is.True(page[i-1].TransactionCategory >= page[i].TransactionCategory)
+	}
+}
+
+// TestPaging test following next links through all pages
+func TestPaging(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+	SetStore(NewMemoryStore(transactions.Transactions))
+	router := GetRouter(roleConfig())
+
+	all, _ := sampleQuery(t, "sort=amount").apply(transactions.Transactions)
+
+	var seen []Transaction
+	path := "/transactions?sort=amount&limit=3"
+	for path != "" {
+		res := requestAs(router, "auditor", http.MethodGet, path, "")
+		is.Equal(res.Code, http.StatusOK)
+
+		list := TransactionList{}
+		is.NoErr(json.Unmarshal(res.Body.Bytes(), &list))
+		is.True(len(list.Transactions) <= 3)
+		seen = append(seen, list.Transactions...)
+		path = list.Next
+	}
+
+	is.Equal(len(seen), len(all))
+	for i := range all {
+		is.Equal(seen[i].ID, all[i].ID)
+	}
+
+	// A cursor can not be reused with a different sort
+	q := sampleQuery(t, "sort=amount&limit=3")
+	_, next := q.apply(transactions.Transactions)
+	res := request(router, http.MethodGet, "/transactions?sort=id&cursor="+next.encode(), "")
+	is.Equal(res.Code, http.StatusBadRequest)
+
+	// Cursors do not show the sort key and can not be made up
+	q = sampleQuery(t, "sort=sending_account&limit=3")
+	_, next = q.apply(transactions.Transactions)
+	sealed, err := base64.RawURLEncoding.DecodeString(next.encode())
+	is.NoErr(err)
+	is.True(bytes.Contains(sealed, []byte(strconv.FormatInt(next.Key.Int, 10))) == false)
+	plain, err := json.Marshal(next)
+	is.NoErr(err)
+	res = requestAs(router, "auditor", http.MethodGet, "/transactions?sort=sending_account&cursor="+base64.RawURLEncoding.EncodeToString(plain), "")
+	is.Equal(res.Code, http.StatusBadRequest)
+
+	// Masked fields can only be filtered and sorted by roles that see them
+	for _, path := range []string{"/transactions?account=1234", "/transactions?sort=-receiving_account", "/transactions?sort=transaction_id"} {
+		for role, status := range map[string]int{"public": http.StatusBadRequest, "support": http.StatusBadRequest, "auditor": http.StatusOK} {
+			res = requestAs(router, role, http.MethodGet, path, "")
+			is.Equal(res.Code, status) // status for role
+		}
+	}
+}
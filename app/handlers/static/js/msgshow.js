@@ -12,6 +12,7 @@ window.onload = function () {
                 loadSearch(next)
             }
         });
+    loadHistory()
 };
 
 // getMeta get the value of a meta tag
@@ -55,7 +56,8 @@ function loadSearch(next) {
     var url = "/msgsearch?search=" + encodeURIComponent(value) + "&start=" + next
 
     xmlhttp.onreadystatechange = function () {
-        if (this.readyState == 4 && this.status == 200) {
+        // Errors such as a bad search come back as a fragment too
+        if (this.readyState == 4 && this.responseText != "") {
             var resp = this.responseText;
             processResponse(resp)
         }
@@ -72,4 +74,25 @@ function processResponse(resp) {
     let e = document.getElementById("#articles");
 
     e.innerHTML = resp
+
+    loadHistory()
+}
+
+// searchFor run a search again from the history
+function searchFor(value, next) {
+    document.getElementById("#searchtext").value = value
+    loadSearch(next)
+}
+
+// loadHistory show the recent searches
+function loadHistory() {
+    var xmlhttp = new XMLHttpRequest();
+
+    xmlhttp.onreadystatechange = function () {
+        if (this.readyState == 4 && this.status == 200) {
+            document.getElementById("#history").innerHTML = this.responseText
+        }
+    };
+    xmlhttp.open("GET", "/msghistory", true);
+    xmlhttp.send();
 }
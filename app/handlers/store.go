@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/imarsman/nanovms/app/config"
+)
+
+// ErrNotFound no transaction with the requested ID
+var ErrNotFound = errors.New("transaction not found")
+
+// ErrExists a transaction with the ID already exists
+var ErrExists = errors.New("transaction already exists")
+
+// TransactionStore storage for transactions, keyed by ID
+type TransactionStore interface {
+	// List get all transactions in ID order
+	List() ([]Transaction, error)
+	// Each call fn for each transaction, in no particular order, until it
+	// returns false. The store must not be used from fn.
+	Each(fn func(t Transaction) bool) error
+	// Get get a transaction by ID
+	Get(id int) (Transaction, error)
+	// Create add a transaction, assigning the next ID if it has none
+	Create(t Transaction) (Transaction, error)
+	// CreateAll add transactions as Create does, all or none of them, writing
+	// them out together
+	CreateAll(ts []Transaction) ([]Transaction, error)
+	// Update replace the transaction with the same ID
+	Update(t Transaction) (Transaction, error)
+	// Delete remove a transaction by ID
+	Delete(id int) error
+}
+
+var store TransactionStore
+
+// init set up an in-memory store with the sample transactions so the
+// handlers work before any store is configured
+func init() {
+	transactionList, err := readTransactions()
+	if err != nil {
+		transactionList = TransactionList{}
+	}
+	store = NewMemoryStore(transactionList.Transactions)
+}
+
+// SetStore set the store used by the transaction handlers
+func SetStore(s TransactionStore) {
+	store = s
+}
+
+// OpenStore open the store set in the configuration, seeded with the sample
+// transactions
+func OpenStore(c *config.Config) (TransactionStore, error) {
+	transactionList, err := readTransactions()
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Store.Type {
+	case config.StoreMemory:
+		return NewMemoryStore(transactionList.Transactions), nil
+	case config.StoreFile:
+		return NewFileStore(c.Store.Path, transactionList.Transactions)
+	}
+
+	return nil, fmt.Errorf("unknown store type %s", c.Store.Type)
+}
+
+// memoryStore a store held in a map
+type memoryStore struct {
+	mu    sync.RWMutex
+	items map[int]Transaction
+}
+
+// NewMemoryStore get an in-memory store holding seed
+func NewMemoryStore(seed []Transaction) TransactionStore {
+	return newMemoryStore(seed)
+}
+
+func newMemoryStore(seed []Transaction) *memoryStore {
+	s := memoryStore{}
+	s.items = make(map[int]Transaction)
+	for _, t := range seed {
+		s.items[t.ID] = t
+	}
+
+	return &s
+}
+
+func (s *memoryStore) List() ([]Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Transaction, 0, len(s.items))
+	for _, t := range s.items {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return list, nil
+}
+
+func (s *memoryStore) Each(fn func(t Transaction) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.items {
+		if fn(t) == false {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Get(id int) (Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.items[id]
+	if ok == false {
+		return Transaction{}, ErrNotFound
+	}
+
+	return t, nil
+}
+
+func (s *memoryStore) Create(t Transaction) (Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.prepareCreate(t)
+	if err != nil {
+		return Transaction{}, err
+	}
+	s.items[t.ID] = t
+
+	return t, nil
+}
+
+func (s *memoryStore) CreateAll(ts []Transaction) ([]Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created, err := s.prepareCreateAll(ts)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range created {
+		s.items[t.ID] = t
+	}
+
+	return created, nil
+}
+
+// prepareCreateAll check new transactions and assign their IDs, as if each
+// were created in turn. Lock must be held.
+func (s *memoryStore) prepareCreateAll(ts []Transaction) ([]Transaction, error) {
+	created := make([]Transaction, 0, len(ts))
+	next := 0
+	for id := range s.items {
+		if id > next {
+			next = id
+		}
+	}
+	ids := make(map[int]bool, len(ts))
+	for _, t := range ts {
+		if t.ID == 0 {
+			t.ID = next + 1
+		} else if _, ok := s.items[t.ID]; ok || ids[t.ID] {
+			return nil, ErrExists
+		}
+		if t.ID > next {
+			next = t.ID
+		}
+		ids[t.ID] = true
+		created = append(created, t)
+	}
+
+	return created, nil
+}
+
+// prepareCreate check a new transaction and assign its ID. Lock must be held.
+func (s *memoryStore) prepareCreate(t Transaction) (Transaction, error) {
+	if t.ID == 0 {
+		for id := range s.items {
+			if id > t.ID {
+				t.ID = id
+			}
+		}
+		t.ID++
+	} else if _, ok := s.items[t.ID]; ok {
+		return Transaction{}, ErrExists
+	}
+
+	return t, nil
+}
+
+func (s *memoryStore) Update(t Transaction) (Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[t.ID]; ok == false {
+		return Transaction{}, ErrNotFound
+	}
+	s.items[t.ID] = t
+
+	return t, nil
+}
+
+func (s *memoryStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[id]; ok == false {
+		return ErrNotFound
+	}
+	delete(s.items, id)
+
+	return nil
+}
+
+// Operations written to the file store log
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// logEntry a line in the file store log
+type logEntry struct {
+	Op          string       `json:"op"`
+	ID          int          `json:"id"`
+	Transaction *Transaction `json:"transaction,omitempty"`
+}
+
+// fileStore an in-memory store backed by an append-only log of JSON lines.
+// The log is replayed when the store is opened.
+type fileStore struct {
+	*memoryStore
+	path string
+}
+
+// NewFileStore open a store backed by the log at path. If there is no log one
+// is created holding seed.
+func NewFileStore(path string, seed []Transaction) (TransactionStore, error) {
+	s := fileStore{}
+	s.memoryStore = newMemoryStore(nil)
+	s.path = path
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		for _, t := range seed {
+			t := t
+			if err := s.append(logEntry{Op: opPut, ID: t.ID, Transaction: &t}); err != nil {
+				return nil, err
+			}
+			s.items[t.ID] = t
+		}
+		return &s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := logEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		switch entry.Op {
+		case opPut:
+			if entry.Transaction == nil {
+				return nil, fmt.Errorf("%s line %d: put with no transaction", path, line)
+			}
+			s.items[entry.ID] = *entry.Transaction
+		case opDelete:
+			delete(s.items, entry.ID)
+		default:
+			return nil, fmt.Errorf("%s line %d: unknown operation %q", path, line, entry.Op)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// append write entries to the end of the log and sync it to disk once
+func (s *fileStore) append(entries ...logEntry) error {
+	var lines []byte
+	for i := range entries {
+		bytes, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, bytes...), '\n')
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(lines)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (s *fileStore) Create(t Transaction) (Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.prepareCreate(t)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if err := s.append(logEntry{Op: opPut, ID: t.ID, Transaction: &t}); err != nil {
+		return Transaction{}, err
+	}
+	s.items[t.ID] = t
+
+	return t, nil
+}
+
+func (s *fileStore) CreateAll(ts []Transaction) ([]Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created, err := s.prepareCreateAll(ts)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]logEntry, len(created))
+	for i := range created {
+		entries[i] = logEntry{Op: opPut, ID: created[i].ID, Transaction: &created[i]}
+	}
+	if err := s.append(entries...); err != nil {
+		return nil, err
+	}
+	for _, t := range created {
+		s.items[t.ID] = t
+	}
+
+	return created, nil
+}
+
+func (s *fileStore) Update(t Transaction) (Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[t.ID]; ok == false {
+		return Transaction{}, ErrNotFound
+	}
+	if err := s.append(logEntry{Op: opPut, ID: t.ID, Transaction: &t}); err != nil {
+		return Transaction{}, err
+	}
+	s.items[t.ID] = t
+
+	return t, nil
+}
+
+func (s *fileStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[id]; ok == false {
+		return ErrNotFound
+	}
+	if err := s.append(logEntry{Op: opDelete, ID: id}); err != nil {
+		return err
+	}
+	delete(s.items, id)
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// sampleTransaction a valid transaction with no ID
+func sampleTransaction() Transaction {
+	return Transaction{
+		Amount:              1250,
+		CreatedAt:           "2021-07-01T10:00:00+00:00",
+		TransactionID:       4242,
+		TransactionCategory: "Grocery",
+		PostedTimeStamp:     "2021-07-01T10:05:00+00:00",
+		TransactionType:     "POS",
+		SendingAccount:      1234,
+		ReceivingAccount:    3877,
+		TransactionNote:     "Test",
+	}
+}
+
+// exerciseStore run create, read, update and delete against a store
+func exerciseStore(t *testing.T, s TransactionStore) Transaction {
+	is := is.New(t)
+
+	before, err := s.List()
+	is.NoErr(err)
+
+	created, err := s.Create(sampleTransaction())
+	is.NoErr(err)
+	is.True(created.ID > 0)
+
+	_, err = s.Create(created)
+	is.Equal(err, ErrExists)
+
+	got, err := s.Get(created.ID)
+	is.NoErr(err)
+	is.Equal(got, created)
+
+	created.Amount = 99
+	updated, err := s.Update(created)
+	is.NoErr(err)
+	is.Equal(updated.Amount, 99)
+
+	missing := sampleTransaction()
+	missing.ID = 100000
+	_, err = s.Update(missing)
+	is.Equal(err, ErrNotFound)
+
+	is.NoErr(s.Delete(before[0].ID))
+	is.Equal(s.Delete(before[0].ID), ErrNotFound)
+	_, err = s.Get(before[0].ID)
+	is.Equal(err, ErrNotFound)
+
+	after, err := s.List()
+	is.NoErr(err)
+	is.Equal(len(after), len(before))
+
+	seen := 0
+	is.NoErr(s.Each(func(t Transaction) bool {
+		seen++
+		return seen < 2
+	}))
+	is.Equal(seen, 2) // stopped early
+
+	batch, err := s.CreateAll([]Transaction{sampleTransaction(), sampleTransaction()})
+	is.NoErr(err)
+	is.Equal(batch[1].ID, batch[0].ID+1)
+	_, err = s.CreateAll([]Transaction{sampleTransaction(), batch[0]})
+	is.Equal(err, ErrExists)
+	all, err := s.List()
+	is.NoErr(err)
+	is.Equal(len(all), len(before)+2) // none of a failed batch is added
+
+	return updated
+}
+
+// TestMemoryStore test the in-memory store
+func TestMemoryStore(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+
+	exerciseStore(t, NewMemoryStore(transactions.Transactions))
+}
+
+// TestFileStore test the file store and replay of its log
+func TestFileStore(t *testing.T) {
+	is := is.New(t)
+
+	transactions, err := readTransactions()
+	is.NoErr(err)
+
+	path := filepath.Join(t.TempDir(), "transactions.log")
+	s, err := NewFileStore(path, transactions.Transactions)
+	is.NoErr(err)
+
+	seeded, err := s.List()
+	is.NoErr(err)
+	is.Equal(len(seeded), len(transactions.Transactions))
+
+	updated := exerciseStore(t, s)
+	expected, err := s.List()
+	is.NoErr(err)
+
+	// Reopen and check the log replays to the same state without reseeding
+	s, err = NewFileStore(path, nil)
+	is.NoErr(err)
+	replayed, err := s.List()
+	is.NoErr(err)
+	is.Equal(replayed, expected)
+
+	got, err := s.Get(updated.ID)
+	is.NoErr(err)
+	is.Equal(got.Amount, 99)
+}
+
+// TestValidate test transaction field validation
+func TestValidate(t *testing.T) {
+	is := is.New(t)
+
+	transaction := sampleTransaction()
+	is.NoErr(transaction.Validate())
+
+	transaction.Amount = -5
+	transaction.CreatedAt = "yesterday"
+	transaction.ReceivingAccount = transaction.SendingAccount
+	transaction.TransactionCategory = "Lottery"
+	err := transaction.Validate()
+	is.True(err != nil)
+	is.Equal(len(err.(*ValidationError).Problems), 4)
+	t.Log(err)
+}
@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // TransactionList a list of transactions. Allows for JSON list to be read
 type TransactionList struct {
 	Transactions []Transaction `json:"transactions"`
+	Next         string        `json:"next,omitempty"` // link to the next page
 }
 
 // Transaction a transaction with attributes
@@ -28,6 +31,98 @@ type Transaction struct {
 	TransactionNote     string `json:"transaction_note"`
 }
 
+// transactionCategories categories a transaction can have
+var transactionCategories = []string{
+	"ATM",
+	"Automotive",
+	"Cryptocurrency",
+	"Electronics",
+	"Entertainment",
+	"Food and Beverage",
+	"Grocery",
+	"Health Services",
+	"Household",
+	"Internet Services",
+	"Transfer",
+	"Travel",
+	"Utilities",
+}
+
+// knownCategory whether a category is one of the transaction categories,
+// ignoring case
+func knownCategory(category string) bool {
+	for _, c := range transactionCategories {
+		if strings.EqualFold(c, category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Created get the parsed created_at timestamp
+func (t *Transaction) Created() (time.Time, error) {
+	return time.Parse(time.RFC3339, t.CreatedAt)
+}
+
+// Posted get the parsed posted_timestamp
+func (t *Transaction) Posted() (time.Time, error) {
+	return time.Parse(time.RFC3339, t.PostedTimeStamp)
+}
+
+// ValidationError problems found with a transaction's fields
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid transaction: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate check that the fields of a transaction are usable
+func (t *Transaction) Validate() error {
+	var problems []string
+
+	if t.ID < 0 {
+		problems = append(problems, "id must not be negative")
+	}
+	if t.Amount <= 0 {
+		problems = append(problems, "amount must be positive")
+	}
+	if _, err := t.Created(); err != nil {
+		problems = append(problems, "created_at must be an RFC 3339 timestamp")
+	}
+	if _, err := t.Posted(); err != nil {
+		problems = append(problems, "posted_timestamp must be an RFC 3339 timestamp")
+	}
+	if t.TransactionID <= 0 {
+		problems = append(problems, "transaction_id must be positive")
+	}
+	if strings.TrimSpace(t.TransactionCategory) == "" {
+		problems = append(problems, "transaction_category is required")
+	} else if knownCategory(t.TransactionCategory) == false {
+		problems = append(problems, fmt.Sprintf("transaction_category %q is not a known category", t.TransactionCategory))
+	}
+	if strings.TrimSpace(t.TransactionType) == "" {
+		problems = append(problems, "transaction_type is required")
+	}
+	if t.SendingAccount <= 0 {
+		problems = append(problems, "sending_account must be positive")
+	}
+	if t.ReceivingAccount <= 0 {
+		problems = append(problems, "receiving_account must be positive")
+	}
+	if t.SendingAccount == t.ReceivingAccount {
+		problems = append(problems, "sending_account and receiving_account must differ")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
 // readTransactions read sample transactions set from JSON file
 func readTransactions() (TransactionList, error) {
 
@@ -46,7 +141,7 @@ func readTransactions() (TransactionList, error) {
 // unless there was a rule requiring this specific sort.
 func sortDescendingPostTimestamp(transactions *TransactionList) *TransactionList {
 	sort.SliceStable(transactions.Transactions, func(i, j int) bool {
-		return transactions.Transactions[i].PostedTimeStamp > transactions.Transactions[j].PostedTimeStamp
+		return timeKey(transactions.Transactions[i].PostedTimeStamp).compare(timeKey(transactions.Transactions[j].PostedTimeStamp)) > 0
 	})
 
 	return transactions
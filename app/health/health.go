@@ -0,0 +1,186 @@
+// Package health runs named checks against the parts of the app and reports
+// on them as JSON for load balancers and instance group health checks.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const jsonContentType = "application/json; charset=utf-8"
+
+// Status state of a component or of the app as a whole
+type Status string
+
+const (
+	// StatusOK component is working
+	StatusOK Status = "ok"
+	// StatusDown component is not working
+	StatusDown Status = "down"
+	// StatusDisabled component is not used in this configuration
+	StatusDisabled Status = "disabled"
+)
+
+// ErrDisabled returned by a check for a component that is not in use. It does
+// not count as a failure.
+var ErrDisabled = errors.New("disabled")
+
+// Check a named check of a component. Run returns nil if the component is
+// working.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// ComponentStatus result of a single check
+type ComponentStatus struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// Report result of all checks
+type Report struct {
+	Status     Status            `json:"status"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Components []ComponentStatus `json:"components"`
+}
+
+// Registry a set of checks run together, each with its own timeout
+type Registry struct {
+	checks  []Check
+	timeout time.Duration
+}
+
+// NewRegistry get a new registry that allows each check timeout to complete
+func NewRegistry(timeout time.Duration) *Registry {
+	r := Registry{}
+	r.timeout = timeout
+
+	return &r
+}
+
+// Add add checks to the registry
+func (r *Registry) Add(checks ...Check) {
+	r.checks = append(r.checks, checks...)
+}
+
+// Report run all checks concurrently and report on them. The overall status
+// is down if any check failed.
+func (r *Registry) Report(ctx context.Context) *Report {
+	report := Report{}
+	report.Status = StatusOK
+	report.Timestamp = time.Now()
+	report.Components = make([]ComponentStatus, len(r.checks))
+
+	var wg sync.WaitGroup
+	for i, c := range r.checks {
+		wg.Add(1)
+		go func(i int, c Check) {
+			defer wg.Done()
+			report.Components[i] = r.run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, cs := range report.Components {
+		if cs.Status == StatusDown {
+			report.Status = StatusDown
+		}
+	}
+
+	return &report
+}
+
+// run run a single check, giving up at the timeout even if the check does not
+// respect its context.
+func (r *Registry) run(ctx context.Context, c Check) ComponentStatus {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				result <- fmt.Errorf("check panicked: %v", p)
+			}
+		}()
+		result <- c.Run(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cs := ComponentStatus{}
+	cs.Name = c.Name
+	cs.Latency = time.Since(start).Round(time.Microsecond).String()
+	switch {
+	case err == nil:
+		cs.Status = StatusOK
+	case errors.Is(err, ErrDisabled):
+		cs.Status = StatusDisabled
+	default:
+		cs.Status = StatusDown
+		cs.Error = err.Error()
+	}
+
+	return cs
+}
+
+// Handler get an HTTP handler that writes the registry report as JSON with a
+// 200 status if everything is ok and a 503 status otherwise.
+func Handler(r *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := r.Report(req.Context())
+
+		bytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", jsonContentType)
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status == StatusOK {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(bytes)
+	}
+}
+
+// HTTPCheck get a check that an upstream URL can be reached. Any response
+// below 500 counts, since some APIs reject requests without parameters.
+func HTTPCheck(name string, url string) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				return fmt.Errorf("got status %d", resp.StatusCode)
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func ok(ctx context.Context) error {
+	return nil
+}
+
+func failing(ctx context.Context) error {
+	return errors.New("broken")
+}
+
+func disabled(ctx context.Context) error {
+	return ErrDisabled
+}
+
+func slow(ctx context.Context) error {
+	time.Sleep(time.Second)
+	return nil
+}
+
+// TestReport test overall and per component status
+func TestReport(t *testing.T) {
+	is := is.New(t)
+
+	r := NewRegistry(100 * time.Millisecond)
+	r.Add(Check{Name: "a", Run: ok}, Check{Name: "b", Run: disabled})
+
+	report := r.Report(context.Background())
+	is.Equal(report.Status, StatusOK)
+	is.Equal(report.Components[0].Name, "a")
+	is.Equal(report.Components[0].Status, StatusOK)
+	is.Equal(report.Components[1].Status, StatusDisabled)
+
+	r.Add(Check{Name: "c", Run: failing}, Check{Name: "d", Run: slow})
+
+	start := time.Now()
+	report = r.Report(context.Background())
+	is.True(time.Since(start) < 500*time.Millisecond) // slow check timed out
+	is.Equal(report.Status, StatusDown)
+	is.Equal(report.Components[2].Error, "broken")
+	is.Equal(report.Components[3].Status, StatusDown)
+	t.Logf("%+v", report)
+}
+
+// TestHandler test the JSON output and status codes
+func TestHandler(t *testing.T) {
+	is := is.New(t)
+
+	r := NewRegistry(time.Second)
+	r.Add(Check{Name: "a", Run: ok})
+
+	res := httptest.NewRecorder()
+	Handler(r)(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	is.Equal(res.Code, http.StatusOK)
+	is.Equal(res.Header().Get("Content-Type"), jsonContentType)
+
+	report := Report{}
+	is.NoErr(json.Unmarshal(res.Body.Bytes(), &report))
+	is.Equal(report.Status, StatusOK)
+	is.Equal(len(report.Components), 1)
+
+	r.Add(Check{Name: "b", Run: failing})
+	res = httptest.NewRecorder()
+	Handler(r)(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	is.Equal(res.Code, http.StatusServiceUnavailable)
+	t.Log(res.Body.String())
+}
+
+// TestHTTPCheck test upstream reachability checks
+func TestHTTPCheck(t *testing.T) {
+	is := is.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer upstream.Close()
+
+	ctx := context.Background()
+	is.NoErr(HTTPCheck("up", upstream.URL+"/up").Run(ctx))
+	is.True(HTTPCheck("down", upstream.URL+"/down").Run(ctx) != nil)
+}
@@ -0,0 +1,349 @@
+// Package index is an in-memory inverted index for full-text search of small
+// document sets. Text is tokenized, stop words dropped and terms stemmed.
+// Documents are ranked with BM25 computed per field and weighted by field
+// boosts, and quoted phrases match terms in sequence.
+package index
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters
+const (
+	k1 = 1.2  // term frequency saturation
+	b  = 0.75 // length normalization
+)
+
+// markup HTML tags, which are dropped before tokenizing
+var markup = regexp.MustCompile(`<[^>]*>`)
+
+// stopWords common words not worth indexing
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "for": true, "from": true, "in": true, "is": true,
+	"it": true, "of": true, "on": true, "or": true, "that": true, "the": true,
+	"this": true, "to": true, "was": true, "were": true, "with": true,
+}
+
+// Token a term and its position in the text it came from. Positions count
+// stop words so phrases with them still line up.
+type Token struct {
+	Term     string
+	Position int
+}
+
+// Tokenize split text into stemmed terms, dropping markup and stop words
+func Tokenize(text string) []Token {
+	text = markup.ReplaceAllString(text, " ")
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return unicode.IsLetter(r) == false && unicode.IsDigit(r) == false
+	})
+
+	tokens := make([]Token, 0, len(words))
+	for i, w := range words {
+		if stopWords[w] {
+			continue
+		}
+		tokens = append(tokens, Token{Term: Stem(w), Position: i})
+	}
+
+	return tokens
+}
+
+// Document a document to index, with the text of each of its fields
+type Document struct {
+	ID     string
+	Fields map[string]string
+}
+
+// Hit a matching document and its score
+type Hit struct {
+	ID    string
+	Score float64
+}
+
+// posting the positions of a term in one document's field
+type posting struct {
+	doc       int
+	positions []int
+}
+
+// fieldIndex postings and length statistics for one field
+type fieldIndex struct {
+	postings    map[string][]posting
+	lengths     map[int]int
+	totalLength int
+}
+
+// Index an inverted index of documents by field. It is safe for concurrent
+// use.
+type Index struct {
+	mu     sync.RWMutex
+	boosts map[string]float64
+	fields map[string]*fieldIndex
+	ids    map[string]int // document numbers by ID
+	docIDs map[int]string // IDs by document number
+	terms  map[int]map[string][]string
+	next   int
+}
+
+// New get an empty index. Scores for a field are multiplied by its boost, with
+// fields missing from boosts counting once.
+func New(boosts map[string]float64) *Index {
+	ix := Index{}
+	ix.boosts = boosts
+	ix.fields = make(map[string]*fieldIndex)
+	ix.ids = make(map[string]int)
+	ix.docIDs = make(map[int]string)
+	ix.terms = make(map[int]map[string][]string)
+
+	return &ix
+}
+
+// boost get the boost for a field
+func (ix *Index) boost(field string) float64 {
+	if boost, ok := ix.boosts[field]; ok {
+		return boost
+	}
+	return 1
+}
+
+// Add add documents, replacing any already indexed with the same ID
+func (ix *Index) Add(docs ...Document) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	for _, d := range docs {
+		ix.remove(d.ID)
+
+		doc := ix.next
+		ix.next++
+		ix.ids[d.ID] = doc
+		ix.docIDs[doc] = d.ID
+		ix.terms[doc] = make(map[string][]string)
+
+		for field, text := range d.Fields {
+			fi := ix.fields[field]
+			if fi == nil {
+				fi = &fieldIndex{postings: make(map[string][]posting), lengths: make(map[int]int)}
+				ix.fields[field] = fi
+			}
+
+			tokens := Tokenize(text)
+			positions := make(map[string][]int)
+			for _, t := range tokens {
+				positions[t.Term] = append(positions[t.Term], t.Position)
+			}
+			for term, p := range positions {
+				fi.postings[term] = append(fi.postings[term], posting{doc: doc, positions: p})
+				ix.terms[doc][field] = append(ix.terms[doc][field], term)
+			}
+			fi.lengths[doc] = len(tokens)
+			fi.totalLength += len(tokens)
+		}
+	}
+}
+
+// Remove remove a document by ID
+func (ix *Index) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(id)
+}
+
+// remove remove a document, with the lock held
+func (ix *Index) remove(id string) {
+	doc, ok := ix.ids[id]
+	if ok == false {
+		return
+	}
+
+	for field, terms := range ix.terms[doc] {
+		fi := ix.fields[field]
+		for _, term := range terms {
+			postings := fi.postings[term]
+			for i, p := range postings {
+				if p.doc == doc {
+					postings = append(postings[:i], postings[i+1:]...)
+					break
+				}
+			}
+			if len(postings) == 0 {
+				delete(fi.postings, term)
+			} else {
+				fi.postings[term] = postings
+			}
+		}
+	}
+	for _, fi := range ix.fields {
+		fi.totalLength -= fi.lengths[doc]
+		delete(fi.lengths, doc)
+	}
+
+	delete(ix.terms, doc)
+	delete(ix.docIDs, doc)
+	delete(ix.ids, id)
+}
+
+// Len number of documents indexed
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	return len(ix.ids)
+}
+
+// Has whether a document is indexed
+func (ix *Index) Has(id string) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	_, ok := ix.ids[id]
+	return ok
+}
+
+// Match get the documents matching text in a field, or in any field if field
+// is empty, with their scores. Text with several terms is a phrase and
+// matches only where the terms appear in order.
+func (ix *Index) Match(field, text string) map[string]float64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	tokens := Tokenize(text)
+	scores := make(map[string]float64)
+	if len(tokens) == 0 {
+		return scores
+	}
+
+	for name, fi := range ix.fields {
+		if field != "" && name != field {
+			continue
+		}
+		for doc, score := range ix.matchField(fi, tokens) {
+			scores[ix.docIDs[doc]] += ix.boost(name) * score
+		}
+	}
+
+	return scores
+}
+
+// matchField score documents with the phrase in one field
+func (ix *Index) matchField(fi *fieldIndex, tokens []Token) map[int]float64 {
+	scores := make(map[int]float64)
+	n := float64(len(fi.lengths))
+	if n == 0 {
+		return scores
+	}
+	avgLength := float64(fi.totalLength) / n
+
+	// Documents with every term, and the positions of each
+	candidates := make(map[int][][]int)
+	for i, t := range tokens {
+		postings := fi.postings[t.Term]
+		if len(postings) == 0 {
+			return scores
+		}
+		next := make(map[int][][]int)
+		for _, p := range postings {
+			if i == 0 {
+				next[p.doc] = [][]int{p.positions}
+			} else if previous, ok := candidates[p.doc]; ok {
+				next[p.doc] = append(previous, p.positions)
+			}
+		}
+		candidates = next
+	}
+
+	idf := 0.0
+	for _, t := range tokens {
+		df := float64(len(fi.postings[t.Term]))
+		idf += math.Log(1 + (n-df+0.5)/(df+0.5))
+	}
+
+	for doc, positions := range candidates {
+		tf := float64(occurrences(tokens, positions))
+		if tf == 0 {
+			continue
+		}
+		norm := 1 - b + b*float64(fi.lengths[doc])/avgLength
+		scores[doc] = idf * tf * (k1 + 1) / (tf + k1*norm)
+	}
+
+	return scores
+}
+
+// occurrences count the places the tokens appear with the same spacing as
+// in the query. A single token occurs at each of its positions.
+func occurrences(tokens []Token, positions [][]int) int {
+	count := 0
+	for _, start := range positions[0] {
+		found := true
+		for i := 1; i < len(tokens) && found; i++ {
+			want := start + tokens[i].Position - tokens[0].Position
+			j := sort.SearchInts(positions[i], want)
+			found = j < len(positions[i]) && positions[i][j] == want
+		}
+		if found {
+			count++
+		}
+	}
+
+	return count
+}
+
+// quoted quoted phrases in a query
+var quoted = regexp.MustCompile(`"([^"]*)"`)
+
+// Search find documents matching every term and quoted phrase in a query, in
+// any field, best first
+func (ix *Index) Search(query string) []Hit {
+	var clauses []string
+	for _, m := range quoted.FindAllStringSubmatch(query, -1) {
+		clauses = append(clauses, m[1])
+	}
+	clauses = append(clauses, strings.Fields(quoted.ReplaceAllString(query, " "))...)
+
+	var scores map[string]float64
+	for _, clause := range clauses {
+		// Clauses of only stop words do not narrow the search
+		if len(Tokenize(clause)) == 0 {
+			continue
+		}
+		matched := ix.Match("", clause)
+		if scores == nil {
+			scores = matched
+			continue
+		}
+		for id := range scores {
+			if score, ok := matched[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	return Rank(scores)
+}
+
+// Rank order scored documents best first, by ID when scores are equal
+func Rank(scores map[string]float64) []Hit {
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, Hit{ID: id, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+
+	return hits
+}
@@ -0,0 +1,99 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// TestStem test stems against the Porter algorithm's reference output
+func TestStem(t *testing.T) {
+	is := is.New(t)
+
+	for word, stem := range map[string]string{
+		"caresses":        "caress",
+		"ponies":          "poni",
+		"mites":           "mite",
+		"hopping":         "hop",
+		"hoping":          "hope",
+		"relational":      "relat",
+		"generalizations": "gener",
+		"vaccination":     "vaccin",
+		"vaccinated":      "vaccin",
+		"adjustment":      "adjust",
+		"happy":           "happi",
+		"covid":           "covid",
+		"19":              "19",
+	} {
+		is.Equal(Stem(word), stem)
+	}
+}
+
+// sample get an index with a few documents, titles counting double
+func sample() *Index {
+	ix := New(map[string]float64{"title": 2})
+	ix.Add(
+		Document{ID: "1", Fields: map[string]string{
+			"title":    "Soil mites in coastal grasslands",
+			"abstract": "<p>We sampled mites at six coastal sites.</p>",
+		}},
+		Document{ID: "2", Fields: map[string]string{
+			"title":    "Honey bee colony losses",
+			"abstract": "<p>Colonies with varroa mites died over winter.</p>",
+		}},
+		Document{ID: "3", Fields: map[string]string{
+			"title":    "Coastal erosion after storms",
+			"abstract": "<p>Grasslands near the coast lost soil.</p>",
+		}},
+	)
+	return ix
+}
+
+// TestSearch test ranking, boosts and phrases
+func TestSearch(t *testing.T) {
+	is := is.New(t)
+	ix := sample()
+	is.Equal(ix.Len(), 3)
+
+	// Title matches rank above abstract matches, and stems match
+	hits := ix.Search("mite")
+	is.Equal(len(hits), 2)
+	is.Equal(hits[0].ID, "1")
+	is.True(hits[0].Score > hits[1].Score)
+
+	// Every clause has to match
+	hits = ix.Search("coastal soil")
+	is.Equal(len(hits), 2)
+	hits = ix.Search("coastal varroa")
+	is.Equal(len(hits), 0)
+
+	// Phrases match terms in order, ignoring stop words between them
+	hits = ix.Search(`"soil mites"`)
+	is.Equal(len(hits), 1)
+	is.Equal(hits[0].ID, "1")
+	is.Equal(len(ix.Search(`"mites soil"`)), 0)
+	is.Equal(len(ix.Search(`"colony losses" "varroa mites"`)), 1)
+
+	// Fields can be searched alone
+	is.Equal(len(ix.Match("title", "grasslands")), 1)
+	is.Equal(len(ix.Match("", "grasslands")), 2)
+
+	// Stop words alone match nothing
+	is.Equal(len(ix.Search("the")), 0)
+}
+
+// TestUpdate test replacing and removing documents
+func TestUpdate(t *testing.T) {
+	is := is.New(t)
+	ix := sample()
+
+	ix.Add(Document{ID: "2", Fields: map[string]string{"title": "Ticks on deer"}})
+	is.Equal(ix.Len(), 3)
+	is.Equal(len(ix.Search("varroa")), 0)
+	is.Equal(ix.Search("ticks")[0].ID, "2")
+
+	ix.Remove("1")
+	is.Equal(ix.Has("1"), false)
+	is.Equal(len(ix.Search("mites")), 0)
+	is.Equal(len(ix.Search("grasslands")), 1)
+}
@@ -0,0 +1,232 @@
+package index
+
+import "strings"
+
+// Stem reduce an English word to its stem with the Porter algorithm, so that
+// forms such as "mites" and "mite" or "vaccination" and "vaccinated" match.
+// Words are expected to be lower case.
+// https://tartarus.org/martin/PorterStemmer/def.txt
+func Stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	w := []byte(word)
+	for _, c := range w {
+		if c < 'a' || c > 'z' {
+			return word
+		}
+	}
+
+	w = step1a(w)
+	w = step1b(w)
+	w = step1c(w)
+	w = step2(w)
+	w = step3(w)
+	w = step4(w)
+	w = step5(w)
+
+	return string(w)
+}
+
+// consonant whether the letter at i is a consonant. Y is a consonant unless
+// it follows a consonant.
+func consonant(w []byte, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || consonant(w, i-1) == false
+	}
+	return true
+}
+
+// measure the number of vowel-consonant sequences in w
+func measure(w []byte) int {
+	m := 0
+	i := 0
+	for i < len(w) && consonant(w, i) {
+		i++
+	}
+	for i < len(w) {
+		for i < len(w) && consonant(w, i) == false {
+			i++
+		}
+		if i >= len(w) {
+			break
+		}
+		for i < len(w) && consonant(w, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+// hasVowel whether w contains a vowel
+func hasVowel(w []byte) bool {
+	for i := range w {
+		if consonant(w, i) == false {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleConsonant whether w ends with a double consonant
+func doubleConsonant(w []byte) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && consonant(w, n-1)
+}
+
+// cvc whether w ends consonant-vowel-consonant, with the last not w, x or y
+func cvc(w []byte) bool {
+	n := len(w)
+	if n < 3 || consonant(w, n-1) == false || consonant(w, n-2) || consonant(w, n-3) == false {
+		return false
+	}
+	return w[n-1] != 'w' && w[n-1] != 'x' && w[n-1] != 'y'
+}
+
+// replace swap suffix for replacement if the stem before it has a measure
+// greater than min. The result reports whether the suffix matched.
+func replace(w []byte, suffix, replacement string, min int) ([]byte, bool) {
+	if strings.HasSuffix(string(w), suffix) == false {
+		return w, false
+	}
+	stem := w[:len(w)-len(suffix)]
+	if measure(stem) > min {
+		return append(stem[:len(stem):len(stem)], replacement...), true
+	}
+	return w, true
+}
+
+func step1a(w []byte) []byte {
+	s := string(w)
+	switch {
+	case strings.HasSuffix(s, "sses"), strings.HasSuffix(s, "ies"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(s, "ss"):
+		return w
+	case strings.HasSuffix(s, "s"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+func step1b(w []byte) []byte {
+	s := string(w)
+	if strings.HasSuffix(s, "eed") {
+		if measure(w[:len(w)-3]) > 0 {
+			return w[:len(w)-1]
+		}
+		return w
+	}
+
+	var stem []byte
+	switch {
+	case strings.HasSuffix(s, "ed") && hasVowel(w[:len(w)-2]):
+		stem = w[:len(w)-2]
+	case strings.HasSuffix(s, "ing") && hasVowel(w[:len(w)-3]):
+		stem = w[:len(w)-3]
+	default:
+		return w
+	}
+
+	t := string(stem)
+	switch {
+	case strings.HasSuffix(t, "at"), strings.HasSuffix(t, "bl"), strings.HasSuffix(t, "iz"):
+		return append(stem[:len(stem):len(stem)], 'e')
+	case doubleConsonant(stem):
+		last := stem[len(stem)-1]
+		if last != 'l' && last != 's' && last != 'z' {
+			return stem[:len(stem)-1]
+		}
+	case measure(stem) == 1 && cvc(stem):
+		return append(stem[:len(stem):len(stem)], 'e')
+	}
+	return stem
+}
+
+func step1c(w []byte) []byte {
+	if w[len(w)-1] == 'y' && hasVowel(w[:len(w)-1]) {
+		return append(w[:len(w)-1:len(w)-1], 'i')
+	}
+	return w
+}
+
+// step2Suffixes double suffixes mapped to single ones
+var step2Suffixes = [][2]string{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"abli", "able"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+}
+
+func step2(w []byte) []byte {
+	for _, s := range step2Suffixes {
+		if r, ok := replace(w, s[0], s[1], 0); ok {
+			return r
+		}
+	}
+	return w
+}
+
+// step3Suffixes suffixes removed or shortened in step 3
+var step3Suffixes = [][2]string{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+func step3(w []byte) []byte {
+	for _, s := range step3Suffixes {
+		if r, ok := replace(w, s[0], s[1], 0); ok {
+			return r
+		}
+	}
+	return w
+}
+
+// step4Suffixes suffixes removed from longer stems in step 4
+var step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+func step4(w []byte) []byte {
+	// Longest suffix first, as "ement" has to win over "ment" and "ent"
+	best := ""
+	for _, s := range step4Suffixes {
+		if strings.HasSuffix(string(w), s) && len(s) > len(best) {
+			best = s
+		}
+	}
+	if best == "" {
+		return w
+	}
+	stem := w[:len(w)-len(best)]
+	if measure(stem) <= 1 {
+		return w
+	}
+	if best == "ion" {
+		last := stem[len(stem)-1]
+		if last != 's' && last != 't' {
+			return w
+		}
+	}
+	return stem
+}
+
+func step5(w []byte) []byte {
+	if w[len(w)-1] == 'e' {
+		stem := w[:len(w)-1]
+		m := measure(stem)
+		if m > 1 || (m == 1 && cvc(stem) == false) {
+			w = stem
+		}
+	}
+	if measure(w) > 1 && doubleConsonant(w) && w[len(w)-1] == 'l' {
+		w = w[:len(w)-1]
+	}
+	return w
+}
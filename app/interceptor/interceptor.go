@@ -0,0 +1,422 @@
+// Package interceptor is the chain of interceptors for the GRPC server. It
+// gives each call a request ID, logs it, turns panics into codes.Internal,
+// identifies the caller by bearer token or client certificate and limits the
+// rate of calls from each caller. Each of these is written once as a step
+// around a call and adapted to unary calls and streams alike.
+package interceptor
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/metrics"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDHeader metadata key of the request ID, read from calls that have
+// one and sent back in the response header
+const RequestIDHeader = "x-request-id"
+
+// maxRequestID longest request ID taken from a caller
+const maxRequestID = 128
+
+// idleLimiter time after which the rate limiter of a quiet caller is dropped
+const idleLimiter = 10 * time.Minute
+
+// healthPrefix methods of the health service, which are not rate limited so
+// that probes always get through
+const healthPrefix = "/grpc.health.v1.Health/"
+
+// How a caller was identified
+const (
+	KindBearer      = "bearer"      // by a configured bearer token
+	KindCertificate = "certificate" // by a verified client certificate
+	KindAnonymous   = "anonymous"   // by address only
+)
+
+// contextKey keys of values the chain adds to call contexts
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	identityKey
+)
+
+// Identity the caller of a GRPC method
+type Identity struct {
+	Name    string // client name of the token or certificate common name, empty if anonymous
+	Kind    string
+	Address string // host the call came from, or the one the gateway called for
+}
+
+// client the key of the caller's rate limiter
+func (id Identity) client() string {
+	if id.Kind == KindAnonymous {
+		return id.Address
+	}
+	return id.Kind + ":" + id.Name
+}
+
+// RequestID get the request ID of a call
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// IdentityFrom get the identity of the caller of a call
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey).(Identity)
+	return id, ok
+}
+
+// call a unary call or stream going through the chain
+type call struct {
+	method    string
+	stream    bool
+	requestID string
+	identity  *Identity // set once the caller is identified
+}
+
+// step one interceptor, wrapping the rest of the chain
+type step func(ctx context.Context, c *call, next func(context.Context) error) error
+
+// Chain the interceptors for a server, sharing its tokens and rate limiters
+type Chain struct {
+	tokens   config.Tokens
+	limiters *limiters
+}
+
+// New get the interceptors for a server with the GRPC settings in c
+func New(c *config.Config) *Chain {
+	ch := Chain{}
+	ch.tokens = c.GRPC.Tokens
+	ch.limiters = newLimiters(rate.Limit(c.GRPC.RateLimit), c.GRPC.RateBurst)
+
+	return &ch
+}
+
+// steps the interceptors in the order calls go through them. Logging wraps
+// recovery so that panics are logged as the codes.Internal they become.
+func (ch *Chain) steps() []step {
+	return []step{requestID, logging, recovery, ch.identify, ch.limit}
+}
+
+// Unary get the unary interceptors in order, ending with metrics
+func (ch *Chain) Unary() []grpc.UnaryServerInterceptor {
+	var interceptors []grpc.UnaryServerInterceptor
+	for _, s := range ch.steps() {
+		interceptors = append(interceptors, unary(s))
+	}
+
+	return append(interceptors, metrics.UnaryServerInterceptor)
+}
+
+// Stream get the stream interceptors in order, ending with metrics
+func (ch *Chain) Stream() []grpc.StreamServerInterceptor {
+	var interceptors []grpc.StreamServerInterceptor
+	for _, s := range ch.steps() {
+		interceptors = append(interceptors, stream(s))
+	}
+
+	return append(interceptors, metrics.StreamServerInterceptor)
+}
+
+// ServerOptions get the options adding the chain to a server
+func (ch *Chain) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(ch.Unary()...),
+		grpc.ChainStreamInterceptor(ch.Stream()...),
+	}
+}
+
+// unary adapt a step to unary calls
+func unary(s step) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		c := callOf(ctx, info.FullMethod, false)
+
+		var resp interface{}
+		err := s(ctx, c, func(ctx context.Context) error {
+			var err error
+			resp, err = handler(withCall(ctx, c), req)
+			return err
+		})
+
+		return resp, err
+	}
+}
+
+// stream adapt a step to streams
+func stream(s step) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		c := callOf(ss.Context(), info.FullMethod, true)
+
+		return s(ss.Context(), c, func(ctx context.Context) error {
+			return handler(srv, &contextStream{ServerStream: ss, ctx: withCall(ctx, c)})
+		})
+	}
+}
+
+// callKey key of the call in the context, so that later steps share it
+type callKey struct{}
+
+// callOf get the call a context is for, or a new one for the first step
+func callOf(ctx context.Context, method string, isStream bool) *call {
+	if c, ok := ctx.Value(callKey{}).(*call); ok {
+		return c
+	}
+	return &call{method: method, stream: isStream}
+}
+
+// withCall get a context carrying the call
+func withCall(ctx context.Context, c *call) context.Context {
+	if existing, ok := ctx.Value(callKey{}).(*call); ok && existing == c {
+		return ctx
+	}
+	return context.WithValue(ctx, callKey{}, c)
+}
+
+// contextStream a server stream with a context from the chain
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// requestID give the call the caller's request ID, or a new one, and send it
+// back in the response header
+func requestID(ctx context.Context, c *call, next func(context.Context) error) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := ""
+	if ids := md.Get(RequestIDHeader); len(ids) > 0 && validRequestID(ids[0]) {
+		id = ids[0]
+	}
+	if id == "" {
+		id = uuid.NewString()
+	}
+	c.requestID = id
+
+	// Fails only outside a real server, where there is nobody to tell
+	grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id))
+
+	return next(context.WithValue(ctx, requestIDKey, id))
+}
+
+// validRequestID whether a request ID from a caller is safe to use and log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, r := range id {
+		if r > unicode.MaxASCII || unicode.IsPrint(r) == false || r == ' ' || r == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// logging log each call when it ends as key=value pairs
+func logging(ctx context.Context, c *call, next func(context.Context) error) error {
+	start := time.Now()
+	err := next(ctx)
+
+	fields := []string{
+		field("method", c.method),
+		field("stream", strconv.FormatBool(c.stream)),
+		field("code", status.Code(err).String()),
+		field("duration", time.Since(start).String()),
+		field("request_id", c.requestID),
+	}
+	if c.identity != nil {
+		fields = append(fields, field("caller", c.identity.client()), field("address", c.identity.Address))
+	}
+	if err != nil {
+		fields = append(fields, field("error", status.Convert(err).Message()))
+	}
+	log.Print("grpc " + strings.Join(fields, " "))
+
+	return err
+}
+
+// field format a key=value pair, quoting values that need it
+func field(key, value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=\n\t") {
+		value = strconv.Quote(value)
+	}
+	return key + "=" + value
+}
+
+// recovery turn a panic in the rest of the chain into codes.Internal so one
+// bad call does not stop the server
+func recovery(ctx context.Context, c *call, next func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("grpc panic in %s, request %s: %v\n%s", c.method, c.requestID, r, debug.Stack())
+			err = status.Errorf(codes.Internal, "internal error, request %s", c.requestID)
+		}
+	}()
+
+	return next(ctx)
+}
+
+// identify add the identity of the caller to the call. A call with a token
+// that is not a known bearer token is refused.
+func (ch *Chain) identify(ctx context.Context, c *call, next func(context.Context) error) error {
+	id, err := ch.identity(ctx)
+	if err != nil {
+		return err
+	}
+	c.identity = &id
+
+	return next(context.WithValue(ctx, identityKey, id))
+}
+
+// identity get the identity of the caller of a call
+func (ch *Chain) identity(ctx context.Context) (Identity, error) {
+	id := Identity{Kind: KindAnonymous}
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		id.Address = host(p.Addr.String())
+	}
+	// The gateway and /getimage call from this host, for the HTTP client they
+	// name
+	if forwarded := md.Get("x-forwarded-for"); len(forwarded) > 0 && loopback(id.Address) {
+		id.Address = strings.TrimSpace(strings.Split(forwarded[0], ",")[0])
+	}
+
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		const prefix = "bearer "
+		if len(auth[0]) <= len(prefix) || strings.EqualFold(auth[0][:len(prefix)], prefix) == false {
+			return id, status.Error(codes.Unauthenticated, "authorization is not a bearer token")
+		}
+		name, ok := ch.client(strings.TrimSpace(auth[0][len(prefix):]))
+		if ok == false {
+			return id, status.Error(codes.Unauthenticated, "unknown bearer token")
+		}
+		id.Name, id.Kind = name, KindBearer
+		return id, nil
+	}
+
+	if ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 && len(info.State.VerifiedChains[0]) > 0 {
+			id.Name, id.Kind = info.State.VerifiedChains[0][0].Subject.CommonName, KindCertificate
+		}
+	}
+
+	return id, nil
+}
+
+// client get the name of the client with a token, comparing every token in
+// constant time
+func (ch *Chain) client(token string) (string, bool) {
+	found := ""
+	for name, t := range ch.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = name
+		}
+	}
+
+	return found, found != ""
+}
+
+// host get the host of an address, or the address if it has no port
+func host(address string) string {
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		return h
+	}
+	return address
+}
+
+// loopback whether a host is this one
+func loopback(h string) bool {
+	ip := net.ParseIP(h)
+	return ip != nil && ip.IsLoopback()
+}
+
+// limit refuse calls from callers that have used up their rate
+func (ch *Chain) limit(ctx context.Context, c *call, next func(context.Context) error) error {
+	if strings.HasPrefix(c.method, healthPrefix) == false && c.identity != nil {
+		if ch.limiters.allow(c.identity.client()) == false {
+			return status.Errorf(codes.ResourceExhausted, "rate limit of %v calls per second exceeded", ch.limiters.rate)
+		}
+	}
+
+	return next(ctx)
+}
+
+// limiters a token bucket for each caller
+type limiters struct {
+	mu      sync.Mutex
+	rate    rate.Limit // calls per second, no limit if 0
+	burst   int
+	clients map[string]*limiter
+	swept   time.Time
+	now     func() time.Time
+}
+
+// limiter a caller's token bucket and when it was last used
+type limiter struct {
+	*rate.Limiter
+	seen time.Time
+}
+
+// newLimiters get limiters allowing r calls a second in bursts of up to burst
+func newLimiters(r rate.Limit, burst int) *limiters {
+	l := limiters{}
+	l.rate = r
+	l.burst = burst
+	l.clients = make(map[string]*limiter)
+	l.now = time.Now
+	l.swept = l.now()
+
+	return &l
+}
+
+// allow take a token from a caller's bucket if there is one
+func (l *limiters) allow(client string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) > idleLimiter {
+		for key, lim := range l.clients {
+			if now.Sub(lim.seen) > idleLimiter {
+				delete(l.clients, key)
+			}
+		}
+		l.swept = now
+	}
+
+	lim, ok := l.clients[client]
+	if ok == false {
+		lim = &limiter{Limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.clients[client] = lim
+	}
+	lim.seen = now
+
+	return lim.AllowN(now, 1)
+}
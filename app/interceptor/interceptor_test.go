@@ -0,0 +1,245 @@
+package interceptor
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/matryer/is"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newChain get a chain with a token for the web client
+func newChain(rateLimit float64, burst int) *Chain {
+	c := config.Default()
+	c.GRPC.Tokens = config.Tokens{"web": "s3cret"}
+	c.GRPC.RateLimit = rateLimit
+	c.GRPC.RateBurst = burst
+
+	return New(c)
+}
+
+// incoming get a context for a call from an address with metadata
+func incoming(address string, pairs ...string) context.Context {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...))
+	return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(address), Port: 40000}})
+}
+
+// invoke make a unary call through the chain, as the server would
+func invoke(ch *Chain, ctx context.Context, method string, handler grpc.UnaryHandler) (interface{}, error) {
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	interceptors := ch.Unary()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+
+	return handler(ctx, nil)
+}
+
+// testStream a server stream with only a context
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+// invokeStream make a streaming call through the chain
+func invokeStream(ch *Chain, ctx context.Context, method string, handler grpc.StreamHandler) error {
+	info := &grpc.StreamServerInfo{FullMethod: method, IsServerStream: true}
+	interceptors := ch.Stream()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(srv interface{}, ss grpc.ServerStream) error {
+			return interceptor(srv, ss, info, next)
+		}
+	}
+
+	return handler(nil, &testStream{ctx: ctx})
+}
+
+// TestRequestID test that calls keep the caller's request ID or get a new one
+func TestRequestID(t *testing.T) {
+	is := is.New(t)
+	ch := newChain(0, 0)
+
+	var seen []string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen = append(seen, RequestID(ctx))
+		return nil, nil
+	}
+
+	_, err := invoke(ch, incoming("10.0.0.1", RequestIDHeader, "abc-123"), "/test.Service/Get", handler)
+	is.NoErr(err)
+	_, err = invoke(ch, incoming("10.0.0.1"), "/test.Service/Get", handler)
+	is.NoErr(err)
+	_, err = invoke(ch, incoming("10.0.0.1"), "/test.Service/Get", handler)
+	is.NoErr(err)
+	_, err = invoke(ch, incoming("10.0.0.1", RequestIDHeader, "has spaces"), "/test.Service/Get", handler)
+	is.NoErr(err)
+
+	is.Equal(seen[0], "abc-123")
+	is.True(seen[1] != "")
+	is.True(seen[1] != seen[2]) // new IDs differ
+	is.True(seen[3] != "has spaces")
+}
+
+// TestIdentity test callers identified by token, certificate and address
+func TestIdentity(t *testing.T) {
+	is := is.New(t)
+	ch := newChain(0, 0)
+
+	var id Identity
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		var ok bool
+		id, ok = IdentityFrom(ctx)
+		is.True(ok)
+		return nil, nil
+	}
+
+	_, err := invoke(ch, incoming("10.0.0.1", "authorization", "Bearer s3cret"), "/test.Service/Get", handler)
+	is.NoErr(err)
+	is.Equal(id, Identity{Name: "web", Kind: KindBearer, Address: "10.0.0.1"})
+
+	_, err = invoke(ch, incoming("10.0.0.1", "authorization", "Bearer guess"), "/test.Service/Get", handler)
+	is.Equal(status.Code(err), codes.Unauthenticated)
+	_, err = invoke(ch, incoming("10.0.0.1", "authorization", "Basic d2ViOnMzY3JldA=="), "/test.Service/Get", handler)
+	is.Equal(status.Code(err), codes.Unauthenticated)
+
+	// The gateway's client is trusted only from this host
+	_, err = invoke(ch, incoming("127.0.0.1", "x-forwarded-for", "203.0.113.9"), "/test.Service/Get", handler)
+	is.NoErr(err)
+	is.Equal(id, Identity{Kind: KindAnonymous, Address: "203.0.113.9"})
+	_, err = invoke(ch, incoming("10.0.0.1", "x-forwarded-for", "203.0.113.9"), "/test.Service/Get", handler)
+	is.NoErr(err)
+	is.Equal(id.Address, "10.0.0.1")
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "batch"}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+	err = invokeStream(ch, ctx, "/test.Service/Watch", func(srv interface{}, ss grpc.ServerStream) error {
+		id, _ = IdentityFrom(ss.Context())
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(id, Identity{Name: "batch", Kind: KindCertificate, Address: "10.0.0.2"})
+}
+
+// TestRateLimit test that each caller has its own token bucket
+func TestRateLimit(t *testing.T) {
+	is := is.New(t)
+	ch := newChain(1, 2)
+	now := time.Now()
+	ch.limiters.now = func() time.Time { return now }
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	call := func(address, method string, pairs ...string) codes.Code {
+		_, err := invoke(ch, incoming(address, pairs...), method, handler)
+		return status.Code(err)
+	}
+
+	is.Equal(call("10.0.0.1", "/test.Service/Get"), codes.OK)
+	is.Equal(call("10.0.0.1", "/test.Service/Get"), codes.OK)
+	is.Equal(call("10.0.0.1", "/test.Service/Get"), codes.ResourceExhausted) // burst used up
+	is.Equal(call("10.0.0.2", "/test.Service/Get"), codes.OK)                // another caller
+	is.Equal(call("10.0.0.1", "/test.Service/Get", "authorization", "Bearer s3cret"), codes.OK)
+	is.Equal(call("10.0.0.1", "/grpc.health.v1.Health/Check"), codes.OK) // probes not limited
+
+	now = now.Add(time.Second)
+	is.Equal(call("10.0.0.1", "/test.Service/Get"), codes.OK) // refilled
+
+	// Quiet callers are forgotten
+	now = now.Add(2 * idleLimiter)
+	is.Equal(call("10.0.0.3", "/test.Service/Get"), codes.OK)
+	is.Equal(len(ch.limiters.clients), 1)
+}
+
+// TestRecovery test that panics become codes.Internal and are logged
+func TestRecovery(t *testing.T) {
+	is := is.New(t)
+	ch := newChain(0, 0)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	_, err := invoke(ch, incoming("10.0.0.1", RequestIDHeader, "r1"), "/test.Service/Get", func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("bad comic")
+	})
+	is.Equal(status.Code(err), codes.Internal)
+	is.True(strings.Contains(status.Convert(err).Message(), "r1"))
+
+	err = invokeStream(ch, incoming("10.0.0.1"), "/test.Service/Watch", func(srv interface{}, ss grpc.ServerStream) error {
+		panic("bad stream")
+	})
+	is.Equal(status.Code(err), codes.Internal)
+
+	is.True(strings.Contains(logged.String(), "bad comic"))
+	is.True(strings.Contains(logged.String(), "grpc method=/test.Service/Get stream=false code=Internal"))
+	is.True(strings.Contains(logged.String(), "request_id=r1 caller=10.0.0.1 address=10.0.0.1"))
+	is.True(strings.Contains(logged.String(), "grpc method=/test.Service/Watch stream=true code=Internal"))
+}
+
+// TestServer test the chain on a server, which sends back the request ID
+func TestServer(t *testing.T) {
+	is := is.New(t)
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(newChain(0, 0).ServerOptions()...)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	is.NoErr(err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := healthpb.NewHealthClient(conn)
+
+	var header metadata.MD
+	_, err = client.Check(metadata.AppendToOutgoingContext(ctx, RequestIDHeader, "xyz"), &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	is.NoErr(err)
+	is.Equal(header.Get(RequestIDHeader), []string{"xyz"})
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	is.NoErr(err)
+	resp, err := stream.Recv()
+	is.NoErr(err)
+	is.Equal(resp.GetStatus(), healthpb.HealthCheckResponse_SERVING)
+	header, err = stream.Header()
+	is.NoErr(err)
+	is.Equal(len(header.Get(RequestIDHeader)), 1)
+
+	_, err = client.Check(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer guess"), &healthpb.HealthCheckRequest{})
+	is.Equal(status.Code(err), codes.Unauthenticated)
+}
@@ -0,0 +1,239 @@
+// Package lifecycle starts the long running servers in the app as supervised
+// components and stops them in order when the process is asked to shut down.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"google.golang.org/grpc"
+)
+
+// Component a long running part of the app that can be started and stopped
+type Component interface {
+	// Name name used when reporting on the component
+	Name() string
+	// Start run the component, blocking until it stops. An error returned
+	// before Stop is called is treated as a failure of the whole app.
+	Start() error
+	// Stop stop the component, giving up when the context is done
+	Stop(ctx context.Context) error
+}
+
+// Manager starts components and stops them in the order they were added
+type Manager struct {
+	components []Component
+	timeout    time.Duration
+	signals    chan os.Signal
+}
+
+// NewManager get a new manager that allows timeout for all components to stop
+func NewManager(timeout time.Duration) *Manager {
+	m := Manager{}
+	m.timeout = timeout
+	m.signals = make(chan os.Signal, 1)
+
+	return &m
+}
+
+// Add add a component to be started. Components are stopped in the order they
+// are added.
+func (m *Manager) Add(c Component) {
+	m.components = append(m.components, c)
+}
+
+// Run start all components and block until SIGINT or SIGTERM is received or a
+// component fails, then stop all components. The result is an exit code, which
+// is non-zero if any component failed or did not stop cleanly.
+func (m *Manager) Run() int {
+	signal.Notify(m.signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(m.signals)
+
+	return m.run()
+}
+
+// run start, wait and stop, without hooking process signals
+func (m *Manager) run() int {
+	exitCode := 0
+
+	var stopping bool
+	var mu sync.Mutex
+	failed := make(chan Component, len(m.components))
+
+	var wg sync.WaitGroup
+	for _, c := range m.components {
+		wg.Add(1)
+		go func(c Component) {
+			defer wg.Done()
+			fmt.Printf("Starting %s\n", c.Name())
+			err := c.Start()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if stopping == false {
+				if err == nil {
+					err = errors.New("stopped unexpectedly")
+				}
+				fmt.Printf("%s failed: %v\n", c.Name(), err)
+				failed <- c
+			}
+		}(c)
+	}
+
+	select {
+	case sig := <-m.signals:
+		fmt.Printf("Received %v, shutting down\n", sig)
+	case c := <-failed:
+		fmt.Printf("Shutting down after %s failed\n", c.Name())
+		exitCode = 1
+	}
+
+	mu.Lock()
+	stopping = true
+	mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	for _, c := range m.components {
+		fmt.Printf("Stopping %s\n", c.Name())
+		if err := c.Stop(ctx); err != nil {
+			fmt.Printf("%s did not stop cleanly: %v\n", c.Name(), err)
+			exitCode = 1
+		}
+	}
+
+	// Components that ignored Stop are abandoned once the deadline has passed
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fmt.Println("Gave up waiting for components to finish")
+		exitCode = 1
+	}
+
+	return exitCode
+}
+
+// httpComponent an HTTP server
+type httpComponent struct {
+	name   string
+	server *http.Server
+}
+
+// HTTPServer get a component for an HTTP server. Stopping it lets in-flight
+// requests complete.
+func HTTPServer(name string, server *http.Server) Component {
+	return &httpComponent{name: name, server: server}
+}
+
+func (c *httpComponent) Name() string {
+	return c.name
+}
+
+func (c *httpComponent) Start() error {
+	err := c.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+func (c *httpComponent) Stop(ctx context.Context) error {
+	return c.server.Shutdown(ctx)
+}
+
+// grpcComponent a GRPC server
+type grpcComponent struct {
+	name    string
+	address string
+	server  *grpc.Server
+}
+
+// GRPCServer get a component for a GRPC server listening on address. Stopping
+// it lets in-flight RPCs complete, then forces a stop at the deadline.
+func GRPCServer(name string, address string, server *grpc.Server) Component {
+	return &grpcComponent{name: name, address: address, server: server}
+}
+
+func (c *grpcComponent) Name() string {
+	return c.name
+}
+
+func (c *grpcComponent) Start() error {
+	lis, err := net.Listen("tcp", c.address)
+	if err != nil {
+		return err
+	}
+
+	return c.server.Serve(lis)
+}
+
+func (c *grpcComponent) Stop(ctx context.Context) error {
+	return stopWithin(ctx, c.server.GracefulStop, c.server.Stop)
+}
+
+// natsComponent an embedded NATS server
+type natsComponent struct {
+	name   string
+	server *server.Server
+}
+
+// NATSServer get a component for an embedded NATS server
+func NATSServer(name string, server *server.Server) Component {
+	return &natsComponent{name: name, server: server}
+}
+
+func (c *natsComponent) Name() string {
+	return c.name
+}
+
+func (c *natsComponent) Start() error {
+	if err := server.Run(c.server); err != nil {
+		return err
+	}
+	if c.server.ReadyForConnections(10*time.Second) == false {
+		return errors.New("not ready for connections")
+	}
+	c.server.WaitForShutdown()
+
+	return nil
+}
+
+func (c *natsComponent) Stop(ctx context.Context) error {
+	return stopWithin(ctx, c.server.Shutdown, nil)
+}
+
+// stopWithin call stop and wait for it to return until the context is done,
+// at which point force is called if it is not nil.
+func stopWithin(ctx context.Context, stop func(), force func()) error {
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if force != nil {
+			force()
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,159 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// fakeComponent a component that records when it is stopped
+type fakeComponent struct {
+	name     string
+	startErr error
+	stopErr  error
+	hang     bool // ignore stop requests
+	stopped  chan struct{}
+	order    *[]string
+	mu       *sync.Mutex
+}
+
+func newFake(name string, order *[]string, mu *sync.Mutex) *fakeComponent {
+	return &fakeComponent{name: name, stopped: make(chan struct{}), order: order, mu: mu}
+}
+
+func (c *fakeComponent) Name() string {
+	return c.name
+}
+
+func (c *fakeComponent) Start() error {
+	if c.startErr != nil {
+		return c.startErr
+	}
+	<-c.stopped
+	if c.hang {
+		select {}
+	}
+
+	return nil
+}
+
+func (c *fakeComponent) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	*c.order = append(*c.order, c.name)
+	c.mu.Unlock()
+	close(c.stopped)
+
+	return c.stopErr
+}
+
+// TestStopOrder test that components are stopped in order on a signal
+func TestStopOrder(t *testing.T) {
+	is := is.New(t)
+
+	var order []string
+	mu := &sync.Mutex{}
+
+	m := NewManager(time.Second)
+	m.Add(newFake("http", &order, mu))
+	m.Add(newFake("grpc", &order, mu))
+	m.Add(newFake("nats", &order, mu))
+
+	m.signals <- syscall.SIGTERM
+	is.Equal(m.run(), 0)
+	is.Equal(order, []string{"http", "grpc", "nats"})
+}
+
+// TestFailure test that a failing component stops the rest with an error code
+func TestFailure(t *testing.T) {
+	is := is.New(t)
+
+	var order []string
+	mu := &sync.Mutex{}
+
+	failing := newFake("grpc", &order, mu)
+	failing.startErr = errors.New("address in use")
+
+	m := NewManager(time.Second)
+	m.Add(newFake("http", &order, mu))
+	m.Add(failing)
+
+	is.Equal(m.run(), 1)
+	is.Equal(len(order), 2)
+}
+
+// TestUncleanStop test that stop errors and deadlines give an error code
+func TestUncleanStop(t *testing.T) {
+	is := is.New(t)
+
+	var order []string
+	mu := &sync.Mutex{}
+
+	bad := newFake("grpc", &order, mu)
+	bad.stopErr = errors.New("could not stop")
+
+	m := NewManager(time.Second)
+	m.Add(bad)
+	m.signals <- syscall.SIGINT
+	is.Equal(m.run(), 1)
+
+	hung := newFake("nats", &order, mu)
+	hung.hang = true
+
+	m = NewManager(50 * time.Millisecond)
+	m.Add(hung)
+	m.signals <- syscall.SIGINT
+	is.Equal(m.run(), 1)
+}
+
+// TestHTTPServer test that the HTTP server drains in-flight requests
+func TestHTTPServer(t *testing.T) {
+	is := is.New(t)
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{Addr: "127.0.0.1:18765", Handler: mux}
+
+	m := NewManager(2 * time.Second)
+	m.Add(HTTPServer("http", server))
+
+	result := make(chan int)
+	go func() {
+		result <- m.run()
+	}()
+
+	status := make(chan int)
+	go func() {
+		var res *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			res, err = http.Get("http://127.0.0.1:18765/")
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+
+	<-started
+	m.signals <- syscall.SIGTERM
+
+	is.Equal(<-status, http.StatusOK)
+	is.Equal(<-result, 0)
+}
@@ -1,91 +1,90 @@
 package main
 
 import (
-	_ "embed"
+	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
-	"strings"
+	"os"
 
+	"github.com/imarsman/nanovms/app/cache"
+	"github.com/imarsman/nanovms/app/config"
 	"github.com/imarsman/nanovms/app/grpcpass"
 	"github.com/imarsman/nanovms/app/handlers"
+	"github.com/imarsman/nanovms/app/lifecycle"
 	"github.com/imarsman/nanovms/app/msg"
-	"github.com/nats-io/nats-server/v2/server"
-	"github.com/nats-io/nats.go"
+	"github.com/imarsman/nanovms/app/outbound"
+	"github.com/imarsman/nanovms/app/tweets"
 )
 
-//go:embed .context
-var runContext string
-
-func init() {
-	inCloud = strings.TrimSpace(runContext) == "cloud"
-	handlers.SetInCloud(inCloud)
-}
-
-var inCloud bool
-
-// InCloud check if running in cloud
-func InCloud() bool {
-	return inCloud
-}
-
 // Main method for app. A simple router and static, struct/json producing
 // template, Golang template pages, and a Twitter API handler.
 func main() {
-	infiniteWait := make(chan string)
-
-	// HTTP
-	if inCloud {
-		fmt.Println("Running in cloud mode with nanovms unikernel. Serving html on port", "8000")
-	} else {
-		fmt.Println("Running locally in OS. Serving html on port", "8000")
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n%s", os.Args[0], config.Usage())
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
 	}
-	go func() {
-		// Get the router with a flag for whether or not app is runnin in cloud
-		httpRouter := handlers.GetRouter(inCloud)
 
-		fmt.Printf("Starting HTTP server on port %v\n", "8000")
-		if err := http.ListenAndServe(":8000", httpRouter); err != nil {
-			fmt.Printf("failed to serve: %s", err)
-		}
-	}()
+	// Build the servers up front so every package gets its configuration even
+	// when a server is not run.
+	cache.Configure(cfg)
+	outbound.Configure(cfg)
+	tweets.Configure(cfg)
+	store, err := handlers.OpenStore(cfg)
+	if err != nil {
+		log.Fatalf("failed to open transaction store: %v", err)
+	}
+	handlers.SetStore(store)
+	masker, err := handlers.OpenMasker(cfg)
+	if err != nil {
+		log.Fatalf("failed to load masking policy: %v", err)
+	}
+	handlers.SetMasker(masker)
+	searchBackend, err := msg.NewBackend(cfg)
+	if err != nil {
+		log.Fatalf("failed to set up search backend: %v", err)
+	}
+	msg.SetBackend(searchBackend)
+	grpcServer := grpcpass.GRPCServer(cfg)
+	ns, err := msg.NATServer(cfg)
+	if err != nil {
+		log.Fatalf("failed to create NATS server: %v", err)
+	}
 
-	// GRPC
-	go func() {
-		// Problems running in cloud for now
-		if inCloud == false {
-			lis, err := net.Listen("tcp", ":5222")
-			if err != nil {
-				log.Fatalf("failed to listen: %v", err)
-			}
-			grpcServer := grpcpass.GRPCServer()
-			fmt.Printf("Starting GRPC server on port %v\n", lis.Addr().String())
-			if err := grpcServer.Serve(lis); err != nil {
-				fmt.Printf("failed to serve: %s", err)
-				// log.Fatalf("failed to serve: %s", err)
-			}
+	// Components are stopped in the order they are added
+	manager := lifecycle.NewManager(cfg.ShutdownTimeout.Duration)
 
-			fmt.Println("grpc", grpcServer.GetServiceInfo())
-		}
-	}()
+	// HTTP
+	if cfg.Cloud {
+		fmt.Println("Running in cloud mode with nanovms unikernel. Serving html on port", cfg.HTTP.Port)
+	} else {
+		fmt.Println("Running locally in OS. Serving html on port", cfg.HTTP.Port)
+	}
+	// Get the router with the configuration for where the app is running
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.HTTP.Port),
+		Handler: handlers.GetRouter(cfg),
+	}
+	manager.Add(lifecycle.HTTPServer("HTTP server", httpServer))
 
-	// NAT
-	go func() {
-		// Problems running in cloud for now
-		if inCloud == false {
-			// Skipping for now
-			ns := msg.NATServer()
+	// Shared connection for searches over NATS, stopped once HTTP requests
+	// using it are done
+	manager.Add(msg.DefaultClient())
 
-			fmt.Printf("Starting NAT server on %v\n", nats.DefaultPort)
-			// Start things up. Block here until done.
-			if err := server.Run(ns); err != nil {
-				server.PrintAndDie(err.Error())
-			}
+	// Answers searches sent over NATS from any instance, locally or in the
+	// cloud using the deployment's server
+	manager.Add(msg.NewSearchWorker())
 
-			ns.WaitForShutdown()
-		}
-	}()
+	// Problems running GRPC and NATS in cloud for now
+	if cfg.Cloud == false {
+		manager.Add(lifecycle.GRPCServer("GRPC server", fmt.Sprintf(":%d", cfg.GRPC.Port), grpcServer))
+		manager.Add(msg.NewStreamingServer())
+		manager.Add(lifecycle.NATSServer("NATS server", ns))
+	}
 
-	<-infiniteWait
+	os.Exit(manager.Run())
 }
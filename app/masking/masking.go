@@ -0,0 +1,371 @@
+// Package masking applies declarative field masking policies to structs as
+// they are serialized, so that the same data can be shown to callers in
+// different roles with different exposure.
+//
+// A policy names a default role and, for each role, a rule per JSON field
+// name. Fields with no rule are left in the clear. The rule actions are:
+//
+//	redact    replace the value with "[REDACTED]"
+//	last      keep the last N characters (numbers keep the last N digits)
+//	hash      replace with a keyed hash, so equal values can still be matched
+//	tokenize  replace with a token that the vault can reverse
+package masking
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed policy.json
+var defaultPolicy embed.FS
+
+// Rule actions
+const (
+	ActionClear    = "clear"
+	ActionRedact   = "redact"
+	ActionLast     = "last"
+	ActionHash     = "hash"
+	ActionTokenize = "tokenize"
+)
+
+// redacted value written for redacted fields
+const redacted = "[REDACTED]"
+
+// tokenPrefix start of tokens
+const tokenPrefix = "tok_"
+
+// ErrUnknownRole no policy for the requested role
+var ErrUnknownRole = errors.New("unknown role")
+
+// Rule masking for a single field
+type Rule struct {
+	Action string `json:"action" yaml:"action"`
+	N      int    `json:"n,omitempty" yaml:"n,omitempty"` // characters kept for last
+}
+
+// RolePolicy rules for a role, keyed by JSON field name
+type RolePolicy struct {
+	Fields     map[string]Rule `json:"fields" yaml:"fields"`
+	Detokenize bool            `json:"detokenize" yaml:"detokenize"` // role may reverse tokens
+	Write      bool            `json:"write" yaml:"write"`           // role may add, change and remove data
+}
+
+// Masks whether the role's rule for a field changes its value
+func (rp *RolePolicy) Masks(field string) bool {
+	action := rp.Fields[field].Action
+
+	return action != "" && action != ActionClear
+}
+
+// Policy masking rules for each role
+type Policy struct {
+	DefaultRole string                `json:"defaultRole" yaml:"defaultRole"`
+	Roles       map[string]RolePolicy `json:"roles" yaml:"roles"`
+}
+
+// DefaultPolicy get the built in policy
+func DefaultPolicy() (*Policy, error) {
+	bytes, err := defaultPolicy.ReadFile("policy.json")
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(bytes, ".json")
+}
+
+// LoadPolicy read a policy from a YAML or JSON file
+func LoadPolicy(path string) (*Policy, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(bytes, filepath.Ext(path))
+}
+
+// ParsePolicy parse and validate a policy in the format given by a file
+// extension
+func ParsePolicy(input []byte, ext string) (*Policy, error) {
+	p := Policy{}
+
+	var err error
+	switch strings.ToLower(ext) {
+	case ".json":
+		err = json.Unmarshal(input, &p)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(input, &p)
+	default:
+		return nil, fmt.Errorf("unsupported policy file type %s", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse masking policy: %v", err)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// Validate check that the policy can be applied
+func (p *Policy) Validate() error {
+	if _, ok := p.Roles[p.DefaultRole]; ok == false {
+		return fmt.Errorf("default role %q has no policy", p.DefaultRole)
+	}
+	for role, rp := range p.Roles {
+		for field, rule := range rp.Fields {
+			switch rule.Action {
+			case ActionClear, ActionRedact, ActionHash, ActionTokenize:
+			case ActionLast:
+				if rule.N < 1 {
+					return fmt.Errorf("role %s field %s: last needs n of at least 1", role, field)
+				}
+			default:
+				return fmt.Errorf("role %s field %s: unknown action %q", role, field, rule.Action)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Vault reversible tokens for tokenized values. A token is the value sealed
+// with a nonce derived from it, so the same value always gets the same token
+// and nothing has to be stored. The keys are random, so tokens are only good
+// for the life of the process.
+type Vault struct {
+	aead   cipher.AEAD
+	macKey []byte // derives nonces
+}
+
+// NewVault get a vault with new keys
+func NewVault() *Vault {
+	key := make([]byte, 32)
+	macKey := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Read(macKey); err != nil {
+		panic(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Vault{aead: aead, macKey: macKey}
+}
+
+// nonce get the nonce for a value
+func (v *Vault) nonce(value string) []byte {
+	mac := hmac.New(sha256.New, v.macKey)
+	mac.Write([]byte(value))
+
+	return mac.Sum(nil)[:v.aead.NonceSize()]
+}
+
+// Tokenize get the token for a value
+func (v *Vault) Tokenize(value string) (string, error) {
+	nonce := v.nonce(value)
+	sealed := v.aead.Seal(nonce, nonce, []byte(value), nil)
+
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Detokenize get the value for a token
+func (v *Vault) Detokenize(token string) (string, bool) {
+	if strings.HasPrefix(token, tokenPrefix) == false {
+		return "", false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, tokenPrefix))
+	if err != nil || len(sealed) < v.aead.NonceSize() {
+		return "", false
+	}
+	nonce, sealed := sealed[:v.aead.NonceSize()], sealed[v.aead.NonceSize():]
+	value, err := v.aead.Open(nil, nonce, sealed, nil)
+	// Only tokens made by Tokenize are accepted
+	if err != nil || hmac.Equal(nonce, v.nonce(string(value))) == false {
+		return "", false
+	}
+
+	return string(value), true
+}
+
+// Field a named value of a serialized struct
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// Object fields of a struct in declaration order. Marshals to a JSON object
+// with the keys in that order.
+type Object []Field
+
+// MarshalJSON write as a JSON object keeping field order
+func (o Object) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// Masker applies a policy using a vault for tokens and a key for hashes
+type Masker struct {
+	policy  *Policy
+	vault   *Vault
+	hashKey []byte
+}
+
+// NewMasker get a masker for a policy. If hashKey is empty a random key is
+// used, so hashes are only stable for the life of the process.
+func NewMasker(policy *Policy, vault *Vault, hashKey string) (*Masker, error) {
+	m := Masker{}
+	m.policy = policy
+	m.vault = vault
+	m.hashKey = []byte(hashKey)
+	if len(m.hashKey) == 0 {
+		m.hashKey = make([]byte, 32)
+		if _, err := rand.Read(m.hashKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &m, nil
+}
+
+// Vault get the vault used for tokens
+func (m *Masker) Vault() *Vault {
+	return m.vault
+}
+
+// Role get the policy for a role, using the default role for an empty name
+func (m *Masker) Role(role string) (*RolePolicy, error) {
+	if role == "" {
+		role = m.policy.DefaultRole
+	}
+	rp, ok := m.policy.Roles[role]
+	if ok == false {
+		return nil, fmt.Errorf("%w %q", ErrUnknownRole, role)
+	}
+
+	return &rp, nil
+}
+
+// Fields get the JSON fields of a struct, or pointer to a struct, with the
+// rules for a role applied
+func (m *Masker) Fields(rp *RolePolicy, v interface{}) (Object, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot mask %T", v)
+	}
+	rt := rv.Type()
+
+	fields := make(Object, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+		name := sf.Name
+		if tag := sf.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+
+		value, err := m.apply(rp.Fields[name], rv.Field(i).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
+		fields = append(fields, Field{Name: name, Value: value})
+	}
+
+	return fields, nil
+}
+
+// Value get a single value with the rule for a field applied, for values
+// written outside of a struct
+func (m *Masker) Value(rp *RolePolicy, field string, value interface{}) (interface{}, error) {
+	return m.apply(rp.Fields[field], value)
+}
+
+// apply apply a rule to a value
+func (m *Masker) apply(rule Rule, value interface{}) (interface{}, error) {
+	switch rule.Action {
+	case "", ActionClear:
+		return value, nil
+	case ActionRedact:
+		return redacted, nil
+	case ActionLast:
+		return last(value, rule.N), nil
+	case ActionHash:
+		mac := hmac.New(sha256.New, m.hashKey)
+		mac.Write([]byte(fmt.Sprint(value)))
+		return "h_" + hex.EncodeToString(mac.Sum(nil))[:16], nil
+	case ActionTokenize:
+		return m.vault.Tokenize(fmt.Sprint(value))
+	}
+
+	return nil, fmt.Errorf("unknown action %q", rule.Action)
+}
+
+// last keep the last n characters of a value. Integers keep their type, which
+// matches the original obscuring of transaction IDs.
+func last(value interface{}, n int) interface{} {
+	s := fmt.Sprint(value)
+	if len(s) <= n {
+		return value
+	}
+	kept := s[len(s)-n:]
+
+	switch value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		if i, err := strconv.Atoi(kept); err == nil {
+			return i
+		}
+	}
+
+	return strings.Repeat("*", len(s)-n) + kept
+}
@@ -0,0 +1,151 @@
+package masking
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+type account struct {
+	Number  int    `json:"number"`
+	Holder  string `json:"holder"`
+	Note    string `json:"note,omitempty"`
+	Skipped string `json:"-"`
+	private string
+}
+
+func testPolicy(t *testing.T) *Policy {
+	p, err := ParsePolicy([]byte(`
+defaultRole: public
+roles:
+  public:
+    fields:
+      number: {action: last, n: 2}
+      holder: {action: hash}
+      note: {action: redact}
+  support:
+    fields:
+      holder: {action: tokenize}
+      note: {action: last, n: 3}
+  auditor:
+    fields: {}
+    detokenize: true
+`), ".yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// TestRoles test masking of the same value for different roles
+func TestRoles(t *testing.T) {
+	is := is.New(t)
+
+	m, err := NewMasker(testPolicy(t), NewVault(), "key")
+	is.NoErr(err)
+
+	a := account{Number: 123456, Holder: "Ada", Note: "secret note", Skipped: "x", private: "y"}
+
+	public, err := m.Role("")
+	is.NoErr(err)
+	fields, err := m.Fields(public, &a)
+	is.NoErr(err)
+	is.Equal(len(fields), 3)
+	is.Equal(fields[0], Field{Name: "number", Value: 56})
+	is.True(strings.HasPrefix(fields[1].Value.(string), "h_"))
+	is.Equal(fields[2].Value, redacted)
+
+	// Hashes are stable for a key
+	again, err := m.Fields(public, a)
+	is.NoErr(err)
+	is.Equal(again[1], fields[1])
+
+	support, err := m.Role("support")
+	is.NoErr(err)
+	fields, err = m.Fields(support, &a)
+	is.NoErr(err)
+	is.Equal(fields[0].Value, 123456)
+	is.Equal(fields[2].Value, "********ote")
+	token := fields[1].Value.(string)
+	is.True(strings.HasPrefix(token, "tok_"))
+
+	value, ok := m.Vault().Detokenize(token)
+	is.True(ok)
+	is.Equal(value, "Ada")
+	_, ok = NewVault().Detokenize(token) // another vault's keys
+	is.True(ok == false)
+	_, ok = m.Vault().Detokenize(token[:len(token)-2])
+	is.True(ok == false)
+
+	auditor, err := m.Role("auditor")
+	is.NoErr(err)
+	is.True(auditor.Detokenize)
+	fields, err = m.Fields(auditor, &a)
+	is.NoErr(err)
+	is.Equal(fields[1].Value, "Ada")
+
+	is.True(public.Masks("holder"))
+	is.True(auditor.Masks("holder") == false)
+	is.True(support.Masks("number") == false)
+
+	// Single values use the rule for the field they are named as
+	hashed, err := m.Value(public, "holder", "Ada")
+	is.NoErr(err)
+	is.Equal(hashed, again[1].Value)
+
+	_, err = m.Role("intruder")
+	is.True(err != nil)
+}
+
+// TestVault test that tokens are the same for a value and reversible
+func TestVault(t *testing.T) {
+	is := is.New(t)
+
+	v := NewVault()
+	a, err := v.Tokenize("1234")
+	is.NoErr(err)
+	again, err := v.Tokenize("1234")
+	is.NoErr(err)
+	b, err := v.Tokenize("1235")
+	is.NoErr(err)
+	is.Equal(a, again)
+	is.True(a != b)
+	is.True(strings.Contains(a, "1234") == false)
+
+	value, ok := v.Detokenize(b)
+	is.True(ok)
+	is.Equal(value, "1235")
+	_, ok = v.Detokenize("tok_" + strings.Repeat("A", 40))
+	is.True(ok == false)
+}
+
+// TestObjectJSON test that objects keep field order in JSON
+func TestObjectJSON(t *testing.T) {
+	is := is.New(t)
+
+	o := Object{{Name: "z", Value: 1}, {Name: "a", Value: "two"}}
+	bytes, err := json.Marshal(o)
+	is.NoErr(err)
+	is.Equal(string(bytes), `{"z":1,"a":"two"}`)
+}
+
+// TestPolicyValidation test that bad policies are rejected
+func TestPolicyValidation(t *testing.T) {
+	is := is.New(t)
+
+	p, err := DefaultPolicy()
+	is.NoErr(err)
+	is.Equal(p.DefaultRole, "public")
+
+	_, err = ParsePolicy([]byte(`{"defaultRole": "nobody", "roles": {}}`), ".json")
+	is.True(err != nil)
+
+	_, err = ParsePolicy([]byte(`{"defaultRole": "a", "roles": {"a": {"fields": {"x": {"action": "last"}}}}}`), ".json")
+	is.True(err != nil)
+
+	_, err = ParsePolicy([]byte(`{"defaultRole": "a", "roles": {"a": {"fields": {"x": {"action": "shred"}}}}}`), ".json")
+	is.True(err != nil)
+}
@@ -0,0 +1,180 @@
+// Package metrics collects Prometheus metrics for HTTP, GRPC and NATS traffic
+// and for calls to upstream APIs, and serves them for scraping at /metrics.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Registry registry holding all app metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	grpcHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "GRPC calls completed by service, method and status code.",
+	}, []string{"service", "method", "code"})
+
+	grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "GRPC call latency by service and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "method"})
+
+	natsMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nats_messages_total",
+		Help: "NATS messages by direction (published or received).",
+	}, []string{"direction"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_requests_total",
+		Help: "Upstream response cache lookups by cache and result (hit, stale, miss, shared or error).",
+	}, []string{"cache", "result"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upstream_request_duration_seconds",
+		Help:    "Latency of calls to upstream APIs by upstream and outcome.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"upstream", "outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		grpcHandled,
+		grpcDuration,
+		natsMessages,
+		cacheRequests,
+		upstreamDuration,
+	)
+}
+
+// Handler get an HTTP handler serving metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder response writer that keeps the status code written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush pass flushes through for handlers that stream
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware mux middleware recording requests against the name of the
+// matched route
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		route := "unnamed"
+		if current := mux.CurrentRoute(r); current != nil && current.GetName() != "" {
+			route = current.GetName()
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// splitMethod split a full GRPC method name such as /pkg.Service/Method
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+
+	return "unknown", fullMethod
+}
+
+// UnaryServerInterceptor GRPC interceptor recording unary calls
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	service, method := splitMethod(info.FullMethod)
+	grpcHandled.WithLabelValues(service, method, status.Code(err).String()).Inc()
+	grpcDuration.WithLabelValues(service, method).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// StreamServerInterceptor GRPC interceptor recording streaming calls, from
+// the start of the stream to its end
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+
+	service, method := splitMethod(info.FullMethod)
+	grpcHandled.WithLabelValues(service, method, status.Code(err).String()).Inc()
+	grpcDuration.WithLabelValues(service, method).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// NATSPublished count a published NATS message
+func NATSPublished() {
+	natsMessages.WithLabelValues("published").Inc()
+}
+
+// NATSReceived count a received NATS message
+func NATSReceived() {
+	natsMessages.WithLabelValues("received").Inc()
+}
+
+// ObserveUpstream record the latency of a call to an upstream API started at
+// start, with an outcome based on err
+func ObserveUpstream(upstream string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	upstreamDuration.WithLabelValues(upstream, outcome).Observe(time.Since(start).Seconds())
+}
+
+// CacheResult count a lookup in a response cache
+func CacheResult(cache, result string) {
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// CounterFunc register a counter whose value is read from f when scraped
+func CounterFunc(name, help string, f func() float64) {
+	Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, f))
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMiddleware test HTTP requests are recorded against route names
+func TestMiddleware(t *testing.T) {
+	is := is.New(t)
+
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/teapot", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}).Name("Teapot")
+	r.Handle("/metrics", Handler()).Name("Metrics")
+
+	for i := 0; i < 3; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/teapot", nil))
+	}
+	is.Equal(testutil.ToFloat64(httpRequests.WithLabelValues("Teapot", http.MethodGet, "418")), float64(3))
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	is.Equal(res.Code, http.StatusOK)
+	body := res.Body.String()
+	is.True(strings.Contains(body, `http_requests_total{code="418",method="GET",route="Teapot"} 3`))
+	is.True(strings.Contains(body, `http_request_duration_seconds_bucket{method="GET",route="Teapot"`))
+}
+
+// TestUnaryServerInterceptor test GRPC calls are recorded by method and code
+func TestUnaryServerInterceptor(t *testing.T) {
+	is := is.New(t)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpcpass.XKCDService/GetXKCD"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no such comic")
+	}
+
+	_, err := UnaryServerInterceptor(context.Background(), nil, info, handler)
+	is.Equal(status.Code(err), codes.NotFound)
+	is.Equal(testutil.ToFloat64(grpcHandled.WithLabelValues("grpcpass.XKCDService", "GetXKCD", "NotFound")), float64(1))
+}
+
+// TestStreamServerInterceptor test GRPC streams are recorded by method and code
+func TestStreamServerInterceptor(t *testing.T) {
+	is := is.New(t)
+
+	info := &grpc.StreamServerInfo{FullMethod: "/grpcpass.XKCDService/ListXKCD", IsServerStream: true}
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		return nil
+	}
+
+	is.NoErr(StreamServerInterceptor(nil, nil, info, handler))
+	is.Equal(testutil.ToFloat64(grpcHandled.WithLabelValues("grpcpass.XKCDService", "ListXKCD", "OK")), float64(1))
+}
+
+// TestCounters test NATS and upstream metrics
+func TestCounters(t *testing.T) {
+	is := is.New(t)
+
+	NATSPublished()
+	NATSPublished()
+	NATSReceived()
+	is.Equal(testutil.ToFloat64(natsMessages.WithLabelValues("published")), float64(2))
+	is.Equal(testutil.ToFloat64(natsMessages.WithLabelValues("received")), float64(1))
+
+	ObserveUpstream("plos", time.Now(), nil)
+	ObserveUpstream("plos", time.Now(), errors.New("timeout"))
+	is.Equal(testutil.CollectAndCount(upstreamDuration), 2)
+}
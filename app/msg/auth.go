@@ -0,0 +1,151 @@
+package msg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/imarsman/nanovms/app/creds"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"gopkg.in/yaml.v2"
+)
+
+// appSubjects subjects the app's own user publishes and subscribes to. Request
+// replies go to inboxes and NATS Streaming, which also connects as the app,
+// uses _STAN subjects.
+func appSubjects() []string {
+	return []string{subject("search.>"), "_INBOX.>", "_STAN.>"}
+}
+
+// User an NKey user of the embedded server and the subjects it may use
+type User struct {
+	NKey      string   `json:"nkey" yaml:"nkey"`           // public key, starting with U
+	Publish   []string `json:"publish" yaml:"publish"`     // subjects allowed, all if empty
+	Subscribe []string `json:"subscribe" yaml:"subscribe"` // subjects allowed, all if empty
+}
+
+// userList the layout of a users file
+type userList struct {
+	Users []User `json:"users" yaml:"users"`
+}
+
+// LoadUsers read NKey users from a YAML or JSON file
+func LoadUsers(path string) ([]User, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseUsers(bytes, filepath.Ext(path))
+}
+
+// ParseUsers parse and validate users in the format given by a file extension
+func ParseUsers(input []byte, ext string) ([]User, error) {
+	list := userList{}
+
+	var err error
+	switch strings.ToLower(ext) {
+	case ".json":
+		err = json.Unmarshal(input, &list)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(input, &list)
+	default:
+		return nil, fmt.Errorf("unsupported users file type %s", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse NATS users: %v", err)
+	}
+
+	if len(list.Users) == 0 {
+		return nil, fmt.Errorf("no NATS users defined")
+	}
+	for _, u := range list.Users {
+		if nkeys.IsValidPublicUserKey(u.NKey) == false {
+			return nil, fmt.Errorf("%q is not a public NKey for a user", u.NKey)
+		}
+	}
+
+	return list.Users, nil
+}
+
+// appUser get the public key and signer for the embedded seed the app
+// connects with
+func appUser() (string, nkeys.KeyPair, error) {
+	kp, err := nkeys.FromSeed([]byte(strings.TrimSpace(nkeyUserSeed)))
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot read NKey seed: %v", err)
+	}
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return pub, kp, nil
+}
+
+// serverUsers get the users for the server, from the users file if one is
+// configured or else the embedded public key limited to the app's subjects.
+// The app's own user has to be one of them.
+func serverUsers() ([]*server.NkeyUser, error) {
+	users := []User{{
+		NKey:      strings.TrimSpace(nkeyUserPub),
+		Publish:   appSubjects(),
+		Subscribe: appSubjects(),
+	}}
+	if conf.NATS.UsersFile != "" {
+		var err error
+		users, err = LoadUsers(conf.NATS.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pub, _, err := appUser()
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	nkeyUsers := make([]*server.NkeyUser, 0, len(users))
+	for _, u := range users {
+		if u.NKey == pub {
+			found = true
+		}
+		nu := server.NkeyUser{Nkey: u.NKey, Permissions: &server.Permissions{}}
+		if len(u.Publish) > 0 {
+			nu.Permissions.Publish = &server.SubjectPermission{Allow: u.Publish}
+		}
+		if len(u.Subscribe) > 0 {
+			nu.Permissions.Subscribe = &server.SubjectPermission{Allow: u.Subscribe}
+		}
+		nkeyUsers = append(nkeyUsers, &nu)
+	}
+	if found == false {
+		return nil, fmt.Errorf("no NATS user for the app's key %s", pub)
+	}
+
+	return nkeyUsers, nil
+}
+
+// clientOptions get the options to authenticate with the embedded server, or
+// in the cloud with the credentials for the deployment's server
+func clientOptions() ([]nats.Option, error) {
+	if conf.Cloud {
+		return []nats.Option{nats.UserCredentials(conf.NATS.RemoteCreds)}, nil
+	}
+
+	pub, kp, err := appUser()
+	if err != nil {
+		return nil, err
+	}
+	options := []nats.Option{nats.Nkey(pub, kp.Sign)}
+	if conf.NATS.TLS {
+		options = append(options, nats.Secure(creds.ClientTLSConfig()))
+	}
+
+	return options, nil
+}
@@ -0,0 +1,426 @@
+package msg
+
+import (
+	"container/list"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/index"
+	"github.com/imarsman/nanovms/app/metrics"
+	"github.com/imarsman/nanovms/app/outbound"
+)
+
+// SearchBackend a source of articles for searches
+type SearchBackend interface {
+	// Search get the page of results for a query starting at the zero based
+	// offset start
+	Search(ctx context.Context, query *SearchQuery, start int) (*ResultSet, error)
+}
+
+// pageSize results in a page for backends that choose it, matching PLOS
+const pageSize = 10
+
+// publicationTime layout of Result.PublicationDate as fetched
+const publicationTime = "2006-01-02T15:04:05Z"
+
+//go:embed corpus/articles.json
+var corpus embed.FS
+
+// https://www.crossref.org/blog/dois-and-matching-regular-expressions/
+// ^10.\d{4,9}/[-._;()/:A-Z0-9]+$
+var doiPattern = regexp.MustCompile(`^10\.\d{4,9}/[-\._;\(\)\/\:a-zA-Z0-9]+$`)
+
+// isDOI whether a search is a DOI rather than search terms
+func isDOI(search string) bool {
+	return doiPattern.MatchString(search)
+}
+
+// backend the backend used by search workers
+var backend SearchBackend = &plosBackend{}
+
+// SetBackend set the backend used by search workers
+func SetBackend(b SearchBackend) {
+	backend = b
+}
+
+// NewBackend get the search backend set in the configuration
+func NewBackend(c *config.Config) (SearchBackend, error) {
+	if c.Search.Backend == config.SearchCrossref {
+		return &crossrefBackend{}, nil
+	}
+
+	articles, err := LoadCorpus(c.Search.Corpus)
+	if err != nil {
+		return nil, err
+	}
+	local := NewLocalBackend(articles)
+	local.learnLimit = c.Search.Learned
+
+	switch c.Search.Backend {
+	case config.SearchPLOS:
+		return &plosBackend{local: local}, nil
+	case config.SearchLocal:
+		return local, nil
+	}
+
+	return nil, fmt.Errorf("unknown search backend %q", c.Search.Backend)
+}
+
+// plosBackend searches the PLOS Solr API. Results are added to the local
+// backend, if there is one, and it is searched instead when PLOS fails.
+type plosBackend struct {
+	local *LocalBackend
+}
+
+func (b *plosBackend) Search(ctx context.Context, query *SearchQuery, start int) (*ResultSet, error) {
+	rs, err := b.search(ctx, query, start)
+	if err != nil {
+		// Nothing is waiting for the result if the context is done
+		if b.local == nil || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("PLOS search failed, searching local index: %v", err)
+		return b.local.Search(ctx, query, start)
+	}
+
+	if b.local != nil {
+		b.local.Learn(rs.Docs...)
+	}
+
+	return rs, nil
+}
+
+// search search PLOS
+func (b *plosBackend) search(ctx context.Context, query *SearchQuery, start int) (*ResultSet, error) {
+	results, err := queryAPI(ctx, query, start)
+	if err != nil {
+		return nil, err
+	}
+
+	response := Response{}
+	err = json.Unmarshal(results, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.ResultSet == nil {
+		return nil, fmt.Errorf("no results in response from %s", conf.Upstream.PLOS)
+	}
+
+	return response.ResultSet, nil
+}
+
+// LoadCorpus read articles as a JSON array of results, or the built in sample
+// articles if path is empty
+func LoadCorpus(path string) ([]*Result, error) {
+	var bytes []byte
+	var err error
+	if path == "" {
+		bytes, err = corpus.ReadFile("corpus/articles.json")
+	} else {
+		bytes, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var articles []*Result
+	if err := json.Unmarshal(bytes, &articles); err != nil {
+		return nil, fmt.Errorf("cannot parse article corpus: %v", err)
+	}
+
+	return articles, nil
+}
+
+// fieldBoosts weight of matches in each indexed field of an article
+var fieldBoosts = map[string]float64{
+	"title":    2,
+	"abstract": 1,
+	"author":   1,
+	"journal":  0.5,
+}
+
+// LocalBackend searches articles in an index held in memory, so searches
+// work offline. Articles can be added as they are found elsewhere.
+type LocalBackend struct {
+	mu         sync.RWMutex
+	index      *index.Index
+	articles   map[string]Result
+	learned    *list.List // IDs of learned articles, most recent first
+	learnedAt  map[string]*list.Element
+	learnLimit int // learned articles kept
+}
+
+// NewLocalBackend get a backend searching the given articles
+func NewLocalBackend(articles []*Result) *LocalBackend {
+	b := LocalBackend{}
+	b.index = index.New(fieldBoosts)
+	b.articles = make(map[string]Result)
+	b.learned = list.New()
+	b.learnedAt = make(map[string]*list.Element)
+	b.Add(articles...)
+
+	return &b
+}
+
+// Add index articles, replacing any with the same ID
+func (b *LocalBackend) Add(articles ...*Result) {
+	b.mu.Lock()
+	docs := b.keep(articles)
+	b.mu.Unlock()
+
+	b.index.Add(docs...)
+}
+
+// Learn index articles found elsewhere. Only the most recently learned are
+// kept, and articles added with Add are left as they are.
+func (b *LocalBackend) Learn(articles ...*Result) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var fresh []*Result
+	for _, a := range articles {
+		if el, ok := b.learnedAt[a.ID]; ok {
+			b.learned.MoveToFront(el)
+		} else if _, ok := b.articles[a.ID]; ok {
+			continue
+		} else {
+			b.learnedAt[a.ID] = b.learned.PushFront(a.ID)
+		}
+		fresh = append(fresh, a)
+	}
+
+	for b.learned.Len() > b.learnLimit {
+		id := b.learned.Remove(b.learned.Back()).(string)
+		delete(b.learnedAt, id)
+		delete(b.articles, id)
+		b.index.Remove(id)
+	}
+
+	kept := fresh[:0]
+	for _, a := range fresh {
+		if _, ok := b.learnedAt[a.ID]; ok {
+			kept = append(kept, a)
+		}
+	}
+	b.index.Add(b.keep(kept)...)
+}
+
+// keep hold copies of articles, with the lock held, and get them as
+// documents to index
+func (b *LocalBackend) keep(articles []*Result) []index.Document {
+	docs := make([]index.Document, 0, len(articles))
+	for _, a := range articles {
+		// Keep a copy so later changes to results for display leave it alone
+		b.articles[a.ID] = *a
+		docs = append(docs, index.Document{ID: a.ID, Fields: map[string]string{
+			"title":    a.Title,
+			"abstract": strings.Join(a.Abstract, " "),
+			"author":   strings.Join(a.Author, ", "),
+			"journal":  a.Journal,
+		}})
+	}
+
+	return docs
+}
+
+// Len number of articles held
+func (b *LocalBackend) Len() int {
+	return b.index.Len()
+}
+
+// Search find articles matching a query, ranked by BM25 with title matches
+// counting most. Terms without a field match the title, abstract, authors or
+// journal.
+func (b *LocalBackend) Search(ctx context.Context, query *SearchQuery, start int) (*ResultSet, error) {
+	b.mu.RLock()
+	scores := b.match(query.root)
+	b.mu.RUnlock()
+
+	return b.page(index.Rank(scores), start), nil
+}
+
+// match get the scores of articles matching a clause, with the lock held
+func (b *LocalBackend) match(c clause) map[string]float64 {
+	switch c := c.(type) {
+	case *termClause:
+		// Terms of only stop words do not narrow the search
+		if len(index.Tokenize(c.text)) == 0 {
+			return b.all()
+		}
+		return b.index.Match(c.field, c.text)
+	case *doiClause:
+		scores := make(map[string]float64)
+		if _, ok := b.articles[c.doi]; ok {
+			scores[c.doi] = 0
+		}
+		return scores
+	case *rangeClause:
+		scores := make(map[string]float64)
+		for id, a := range b.articles {
+			t, err := time.Parse(publicationTime, a.PublicationDate)
+			if err == nil && c.includes(t) {
+				scores[id] = 0
+			}
+		}
+		return scores
+	case *notClause:
+		scores := b.all()
+		for id := range b.match(c.clause) {
+			delete(scores, id)
+		}
+		return scores
+	case *boolClause:
+		scores := b.match(c.clauses[0])
+		for _, sub := range c.clauses[1:] {
+			matched := b.match(sub)
+			if c.op == "OR" {
+				for id, score := range matched {
+					scores[id] += score
+				}
+				continue
+			}
+			for id := range scores {
+				if score, ok := matched[id]; ok {
+					scores[id] += score
+				} else {
+					delete(scores, id)
+				}
+			}
+		}
+		return scores
+	}
+
+	return map[string]float64{}
+}
+
+// all get every article with no score, with the lock held
+func (b *LocalBackend) all() map[string]float64 {
+	scores := make(map[string]float64, len(b.articles))
+	for id := range b.articles {
+		scores[id] = 0
+	}
+	return scores
+}
+
+// page get the result set for a page of hits, with equal scores newest
+// first
+func (b *LocalBackend) page(hits []index.Hit, start int) *ResultSet {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return b.articles[hits[i].ID].PublicationDate > b.articles[hits[j].ID].PublicationDate
+	})
+
+	rs := ResultSet{NumFound: len(hits), Start: start, Docs: []*Result{}}
+	for i := start; i < len(hits) && i < start+pageSize; i++ {
+		r := b.articles[hits[i].ID]
+		rs.Docs = append(rs.Docs, &r)
+	}
+
+	return &rs
+}
+
+// crossrefBackend resolves DOIs with the Crossref works API. It does not do
+// term searches.
+type crossrefBackend struct{}
+
+// crossrefWork the parts of a Crossref work record used for results
+type crossrefWork struct {
+	Message struct {
+		DOI            string   `json:"DOI"`
+		Title          []string `json:"title"`
+		Abstract       string   `json:"abstract"`
+		ContainerTitle []string `json:"container-title"`
+		Author         []struct {
+			Given  string `json:"given"`
+			Family string `json:"family"`
+		} `json:"author"`
+		Issued struct {
+			DateParts [][]int `json:"date-parts"`
+		} `json:"issued"`
+	} `json:"message"`
+}
+
+// jatsTag JATS namespace prefixes in Crossref abstracts
+var jatsTag = regexp.MustCompile(`(</?)jats:`)
+
+func (b *crossrefBackend) Search(ctx context.Context, query *SearchQuery, start int) (*ResultSet, error) {
+	doi, ok := query.DOI()
+	if ok == false {
+		return nil, errors.New("only DOI lookups are supported by the Crossref backend")
+	}
+
+	rs := ResultSet{Start: start, Docs: []*Result{}}
+	// A DOI has one result
+	if start > 0 {
+		rs.NumFound = 1
+		return &rs, nil
+	}
+
+	u := conf.Upstream.Crossref + "/works/" + (&url.URL{Path: doi}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	called := time.Now()
+	resp, err := outbound.Client().Do(req)
+	metrics.ObserveUpstream("crossref", called, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &rs, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("crossref returned %s", resp.Status)
+	}
+
+	work := crossrefWork{}
+	if err := json.NewDecoder(resp.Body).Decode(&work); err != nil {
+		return nil, err
+	}
+
+	m := work.Message
+	r := Result{ID: m.DOI}
+	if len(m.Title) > 0 {
+		r.Title = m.Title[0]
+	}
+	if m.Abstract != "" {
+		r.Abstract = []string{jatsTag.ReplaceAllString(m.Abstract, "$1")}
+	}
+	if len(m.ContainerTitle) > 0 {
+		r.Journal = m.ContainerTitle[0]
+	}
+	for _, a := range m.Author {
+		r.Author = append(r.Author, strings.TrimSpace(a.Given+" "+a.Family))
+	}
+	if len(m.Issued.DateParts) > 0 && len(m.Issued.DateParts[0]) > 0 {
+		parts := append(m.Issued.DateParts[0], 1, 1)
+		r.PublicationDate = time.Date(parts[0], time.Month(parts[1]), parts[2], 0, 0, 0, 0, time.UTC).Format(publicationTime)
+	}
+
+	rs.NumFound = 1
+	rs.Docs = append(rs.Docs, &r)
+
+	return &rs, nil
+}
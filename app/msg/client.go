@@ -0,0 +1,182 @@
+package msg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrNotConnected the client has no working connection to the NATS server
+var ErrNotConnected = errors.New("not connected to the NATS server")
+
+// Client a long-lived connection to the NATS server in use, shared by all
+// searches. The connection is retried and re-established in the background,
+// with requests failing with ErrNotConnected while it is down.
+type Client struct {
+	mu      sync.Mutex
+	nc      *nats.Conn
+	stopped bool
+	closed  chan struct{}
+	history history
+}
+
+var client = NewClient()
+
+// statusNames names of connection states for reporting
+var statusNames = map[nats.Status]string{
+	nats.DISCONNECTED:  "disconnected",
+	nats.CONNECTED:     "connected",
+	nats.CLOSED:        "closed",
+	nats.RECONNECTING:  "reconnecting",
+	nats.CONNECTING:    "connecting",
+	nats.DRAINING_SUBS: "draining subscriptions",
+	nats.DRAINING_PUBS: "draining publishers",
+}
+
+// NewClient get a new client. It connects when started.
+func NewClient() *Client {
+	c := Client{}
+	c.closed = make(chan struct{})
+
+	return &c
+}
+
+// DefaultClient get the client used by QueryNATS, CheckConnection and History
+func DefaultClient() *Client {
+	return client
+}
+
+// connect get a connection that retries the first connect and reconnects
+// forever, closing closed when the connection is finally closed
+func connect(name string, closed chan struct{}) (*nats.Conn, error) {
+	auth, err := clientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	return nats.Connect(serverURL(), append(auth,
+		nats.Name(name),
+		nats.Timeout(10*time.Second),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("%s disconnected from NATS: %v", name, err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("%s reconnected to NATS at %s", name, nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(*nats.Conn) { close(closed) }),
+	)...)
+}
+
+// drain drain a connection and wait for it to close until the context is
+// done. A connection that is down has nothing to drain and is just closed.
+func drain(ctx context.Context, nc *nats.Conn, closed chan struct{}) error {
+	if nc.IsConnected() == false {
+		nc.Close()
+		return nil
+	}
+
+	if err := nc.Drain(); err != nil {
+		nc.Close()
+		return err
+	}
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		nc.Close()
+		return ctx.Err()
+	}
+}
+
+// Name name of the client for lifecycle reporting
+func (c *Client) Name() string {
+	return "NATS client"
+}
+
+// Start connect and block until the connection is closed by Stop
+func (c *Client) Start() error {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return nil
+	}
+	nc, err := connect(c.Name(), c.closed)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.nc = nc
+	c.mu.Unlock()
+
+	// There is no streaming server in the cloud
+	if conf.Cloud == false {
+		go c.history.run(nc, c.closed)
+	}
+	<-c.closed
+
+	return nil
+}
+
+// Stop drain the connection, letting requests in flight finish, then close
+// it
+func (c *Client) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	c.stopped = true
+	nc := c.nc
+	c.mu.Unlock()
+	if nc == nil {
+		return nil
+	}
+
+	c.history.close()
+
+	return drain(ctx, nc, c.closed)
+}
+
+// Status state of the connection, such as connected or reconnecting
+func (c *Client) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nc == nil {
+		return "not started"
+	}
+
+	return statusNames[c.nc.Status()]
+}
+
+// conn get the connection if it is usable
+func (c *Client) conn() (*nats.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nc == nil || c.nc.IsConnected() == false {
+		return nil, ErrNotConnected
+	}
+
+	return c.nc, nil
+}
+
+// Check check that the connection is up and the server answers within the
+// context's deadline
+func (c *Client) Check(ctx context.Context) error {
+	nc, err := c.conn()
+	if err != nil {
+		return fmt.Errorf("%w (%s)", err, c.Status())
+	}
+
+	timeout := 10 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	return nc.FlushTimeout(timeout)
+}
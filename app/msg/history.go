@@ -0,0 +1,232 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/nats-io/stan.go"
+)
+
+// HistoryChannel streaming channel searches and their results are kept on
+const HistoryChannel = "search.history"
+
+// maxHistory searches replayed from the channel and kept in memory for
+// display, newest first
+const maxHistory = 50
+
+// replayWait time to wait for the last message of the channel when working
+// out where to replay from. An empty channel has none.
+const replayWait = 500 * time.Millisecond
+
+// ErrNoHistory search history is not available, such as in the cloud where
+// there is no streaming server
+var ErrNoHistory = errors.New("search history is not available")
+
+// HistoryEntry a search and the results it got
+type HistoryEntry struct {
+	Time       time.Time  `json:"time"`
+	SearchTerm string     `json:"searchTerm"`
+	Start      int        `json:"start"`
+	Results    *ResultSet `json:"results"`
+}
+
+// history a streaming connection that records searches and replays the
+// channel from the beginning, so a new instance sees searches made before it
+// started
+type history struct {
+	mu      sync.Mutex
+	sc      stan.Conn
+	entries []HistoryEntry
+}
+
+// run connect to the streaming server over nc and keep the history up to
+// date, connecting again when the connection is lost, until closed is closed
+func (h *history) run(nc *nats.Conn, closed chan struct{}) {
+	for {
+		lost := make(chan struct{})
+		sc, err := stan.Connect(conf.NATS.ClusterID, "nanovms-"+nuid.Next(),
+			stan.NatsConn(nc),
+			stan.SetConnectionLostHandler(func(_ stan.Conn, err error) {
+				log.Printf("Lost NATS Streaming connection: %v", err)
+				close(lost)
+			}),
+		)
+		if err == nil {
+			// Replay the end of the channel, then follow it
+			h.mu.Lock()
+			h.entries = nil
+			h.mu.Unlock()
+			var start stan.SubscriptionOption
+			start, err = replayStart(sc)
+			if err == nil {
+				_, err = sc.Subscribe(HistoryChannel, h.add, start)
+			}
+			if err != nil {
+				sc.Close()
+			}
+		}
+		if err != nil {
+			select {
+			case <-closed:
+				return
+			case <-time.After(2 * time.Second):
+				continue
+			}
+		}
+
+		h.mu.Lock()
+		h.sc = sc
+		h.mu.Unlock()
+
+		select {
+		case <-closed:
+			h.close()
+			return
+		case <-lost:
+			h.mu.Lock()
+			h.sc = nil
+			h.mu.Unlock()
+		}
+	}
+}
+
+// replayStart get the position to replay the channel from so that only the
+// last maxHistory searches are delivered, however many the channel keeps
+func replayStart(sc stan.Conn) (stan.SubscriptionOption, error) {
+	last := make(chan uint64, 1)
+	sub, err := sc.Subscribe(HistoryChannel, func(m *stan.Msg) {
+		select {
+		case last <- m.Sequence:
+		default:
+		}
+	}, stan.StartWithLastReceived())
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	select {
+	case seq := <-last:
+		if seq > maxHistory {
+			return stan.StartAtSequence(seq - maxHistory + 1), nil
+		}
+	case <-time.After(replayWait):
+	}
+
+	return stan.DeliverAllAvailable(), nil
+}
+
+// close close the streaming connection if there is one
+func (h *history) close() {
+	h.mu.Lock()
+	sc := h.sc
+	h.sc = nil
+	h.mu.Unlock()
+	if sc != nil {
+		sc.Close()
+	}
+}
+
+// add keep an entry delivered from the channel
+func (h *history) add(m *stan.Msg) {
+	entry := HistoryEntry{}
+	if err := json.Unmarshal(m.Data, &entry); err != nil {
+		log.Printf("Skipping search history message %d: %v", m.Sequence, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+}
+
+// record publish a search and its JSON result set to the channel. Only the
+// first result is kept, as that is all that is shown. Searches made while
+// there is no streaming connection, and searches that failed, are not
+// recorded.
+func (h *history) record(search string, start int, result []byte) {
+	h.mu.Lock()
+	sc := h.sc
+	h.mu.Unlock()
+	if sc == nil {
+		return
+	}
+
+	entry := HistoryEntry{Time: time.Now().UTC(), SearchTerm: search, Start: start}
+	if err := json.Unmarshal(result, &entry.Results); err != nil || entry.Results.Error {
+		return
+	}
+	if len(entry.Results.Docs) > 1 {
+		entry.Results.Docs = entry.Results.Docs[:1]
+	}
+	for _, doc := range entry.Results.Docs {
+		doc.Abstract = nil
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return
+	}
+
+	_, err = sc.PublishAsync(HistoryChannel, data, func(_ string, err error) {
+		if err != nil {
+			log.Printf("Search history not stored: %v", err)
+		}
+	})
+	if err != nil {
+		log.Printf("Search history not stored: %v", err)
+	}
+}
+
+// list get the entries, newest first
+func (h *history) list() ([]HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sc == nil && len(h.entries) == 0 {
+		return nil, ErrNoHistory
+	}
+
+	entries := make([]HistoryEntry, len(h.entries))
+	for i, e := range h.entries {
+		entries[len(h.entries)-1-i] = e
+	}
+
+	return entries, nil
+}
+
+// History get recent searches, newest first
+func History() ([]HistoryEntry, error) {
+	return client.history.list()
+}
+
+// HistoryToHTML get the recent searches as HTML
+func HistoryToHTML() (string, error) {
+	entries, err := History()
+	data := struct {
+		Entries      []HistoryEntry
+		ErrorMessage string
+	}{Entries: entries}
+	if err != nil {
+		data.ErrorMessage = err.Error()
+	}
+
+	t := templates.Lookup("history.html")
+	if t == nil {
+		return "", fmt.Errorf("problem getting template for %s", "history.html")
+	}
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -2,20 +2,25 @@ package msg
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io/fs"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
-	"text/template"
 	"time"
 
+	"github.com/imarsman/nanovms/app/cache"
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/creds"
+	"github.com/imarsman/nanovms/app/metrics"
+	"github.com/imarsman/nanovms/app/outbound"
 	"github.com/nats-io/nats-server/v2/server"
 	stand "github.com/nats-io/nats-streaming-server/server"
 	"github.com/nats-io/nats.go"
@@ -30,6 +35,7 @@ const ( // various content types
 //go:embed dynamic/*
 var dynamic embed.FS
 
+// The app connects as this user. Make a new pair with
 // go get github.com/nats-io/nkeys/nk
 // https://github.com/nats-io/nkeys/blob/master/nk/README.md
 
@@ -47,6 +53,10 @@ var routeMatch *regexp.Regexp    // template route regex
 
 // var natsConn *nats.Conn
 var natsServer *server.Server
+var conf = config.Default()
+
+// searchCache PLOS responses by URL
+var searchCache = cache.FromConfig("plos", conf)
 
 // http://api.plos.org/solr/examples/
 // http://api.plos.org/search?q=title:covid
@@ -96,6 +106,7 @@ func NewPayload() *Payload {
 type Query struct {
 	SearchTerm string
 	Next       int
+	Deadline   time.Time // when the requester stops waiting, if it has a deadline
 }
 
 // NewQuery make a new query
@@ -107,15 +118,61 @@ func NewQuery(searchTerm string, next int) *Query {
 	return &q
 }
 
-// NATServer get reference to NATS server
-func NATServer() *server.Server {
-	return natsServer
+// NATServer get reference to NATS server, creating it using the
+// configuration on the first call. The configuration is also used for client
+// connections and upstream search calls.
+func NATServer(c *config.Config) (*server.Server, error) {
+	conf = c
+	if natsServer != nil {
+		return natsServer, nil
+	}
+
+	snopts, err := serverOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	// Now run the server with the streaming and streaming/nats options.
+	natsServer, err = server.NewServer(snopts)
+	if err != nil {
+		return nil, err
+	}
+
+	return natsServer, nil
+}
+
+// serverOptions get the options for the embedded server from the
+// configuration
+func serverOptions() (*server.Options, error) {
+	// https://sourcegraph.com/github.com/nats-io/nats-server@6da5d2f4907a03c8ba26fc8b6ca2aed903ac80f8/-/blob/main.go
+	// Now we want to setup the monitoring port for NATS Streaming.
+	// We still need NATS Options to do so, so create NATS Options
+	// using the NewNATSOptions() from the streaming server package.
+	snopts := stand.NewNATSOptions()
+	snopts.Port = conf.NATS.Port
+	snopts.HTTPPort = conf.NATS.HTTPPort
+
+	// Only known NKey users can connect, limited to their subjects
+	var err error
+	snopts.Nkeys, err = serverUsers()
+	if err != nil {
+		return nil, err
+	}
+	if conf.NATS.TLS {
+		snopts.TLSConfig = creds.ServerTLSConfig()
+	}
+
+	return snopts, nil
 }
 
 // HeadingIsh type regexp for abstracts
 // Not elegant but it works
 var HeadingIsh *regexp.Regexp = regexp.MustCompile(`(?:^|\<\/p\>)\s*([\w\d\/\s]+)(?:<p>)`)
 
+// abstractTags tags without attributes kept in abstracts once they are
+// escaped
+var abstractTags = regexp.MustCompile(`&lt;(/?)(p|i|b|em|strong|sub|sup)&gt;`)
+
 var funcMap = template.FuncMap{
 	"StringsJoin": strings.Join,
 	"StringsTrim": strings.TrimSpace,
@@ -132,9 +189,11 @@ var funcMap = template.FuncMap{
 		}
 		return a
 	},
-	"Headingish": func(a string) string {
+	// Abstracts come from upstream, so only simple formatting is kept
+	"Headingish": func(a string) template.HTML {
+		a = abstractTags.ReplaceAllString(template.HTMLEscapeString(a), "<$1$2>")
 		a = HeadingIsh.ReplaceAllString(a, "<p><strong>$1</strong></p>")
-		return a
+		return template.HTML(a)
 	},
 }
 
@@ -161,20 +220,6 @@ func init() {
 		log.Println("Problems with regular expression:", err)
 		os.Exit(-1)
 	}
-
-	// https://sourcegraph.com/github.com/nats-io/nats-server@6da5d2f4907a03c8ba26fc8b6ca2aed903ac80f8/-/blob/main.go
-	// Now we want to setup the monitoring port for NATS Streaming.
-	// We still need NATS Options to do so, so create NATS Options
-	// using the NewNATSOptions() from the streaming server package.
-	snopts := stand.NewNATSOptions()
-	snopts.Port = nats.DefaultPort
-	snopts.HTTPPort = 8223
-
-	// Now run the server with the streaming and streaming/nats options.
-	natsServer, err = server.NewServer(snopts)
-	if err != nil {
-		panic(err)
-	}
 }
 
 // getError simple error output
@@ -192,52 +237,83 @@ func getError(search string, errMsg string) []byte {
 	return output
 }
 
-// Get a local connection or one to a demo for nats.io
-func getConnection(isInCloud bool) (*nats.Conn, error) {
-	if isInCloud {
-		nc, err := nats.Connect("nats://demo.nats.io:4222", nats.Timeout(10*time.Second))
-		if err != nil {
-			return nil, err
-		}
-		return nc, nil
+// serverURL the local NATS server or, in the cloud, the deployment's server
+func serverURL() string {
+	if conf.Cloud {
+		return conf.NATS.RemoteURL
 	}
 	// "nats://0.0.0.0:4222"
-	nc, err := nats.Connect("nats://0.0.0.0:4222", nats.Timeout(10*time.Second))
-	if err != nil {
-		return nil, err
-	}
-	return nc, nil
+	return conf.NATS.URL
 }
 
-// QueryNATS query a nats server
-func QueryNATS(search string, next int, isInCloud bool) ([]byte, error) {
-	// Get a connection
-	nc, err := getConnection(isInCloud)
+// CheckConnection check the shared connection to the NATS server currently
+// in use, reporting its state if it is down
+func CheckConnection(ctx context.Context) error {
+	return client.Check(ctx)
+}
 
+// QueryNATS send a search to the search workers and wait for the JSON result
+// set they reply with, for at most requestTimeout. The context's deadline is
+// passed on to the worker. ErrNotConnected is returned if the shared
+// connection is down and the context's error if it is cancelled.
+func QueryNATS(ctx context.Context, search string, next int) ([]byte, error) {
 	// Get escaped query
 	search = url.QueryEscape(search)
 
-	// To make things easier set up a JSON encoded connection
-	ec, err := nats.NewEncodedConn(nc, nats.JSON_ENCODER)
+	nc, err := client.conn()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer ec.Close()
 
-	// Create a unique subject name for replies.
-	uniqueReplyTo := nats.NewInbox()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
 
-	// Subscribe to a unique subject
-	sub, err := nc.SubscribeSync(uniqueReplyTo)
+	q := NewQuery(search, next)
+	q.Deadline, _ = ctx.Deadline()
+	data, err := json.Marshal(q)
 	if err != nil {
-		return getError(search, err.Error()), nil
+		return nil, err
 	}
 
-	// Get the data to publish
-	rs, err := fetchSearch(search, next)
+	// Any one worker in the queue group replies
+	metrics.NATSPublished()
+	msg, err := nc.RequestWithContext(ctx, subject(SearchSubject), data)
+	if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+	if err == nats.ErrNoResponders {
+		return getError(search, "No search workers are available"), nil
+	}
+	if err == nats.ErrConnectionClosed || err == nats.ErrConnectionDraining {
+		return nil, ErrNotConnected
+	}
 	if err != nil {
 		return getError(search, err.Error()), nil
 	}
+	metrics.NATSReceived()
+	client.history.record(search, next, msg.Data)
+
+	return msg.Data, nil
+}
+
+// runSearch run an escaped search on the search backend and get the JSON
+// result set, or an error result set if it fails or nothing is found
+func runSearch(ctx context.Context, search string, next int) []byte {
+	text, err := url.QueryUnescape(search)
+	if err != nil {
+		text = search
+	}
+
+	query, err := ParseQuery(strings.TrimSpace(text))
+	if err != nil {
+		return getError(search, err.Error())
+	}
+
+	rs, err := backend.Search(ctx, query, next)
+	if err != nil {
+		return getError(search, err.Error())
+	}
+	rs.SearchTerm = search
 	rs.Next = rs.Start + len(rs.Docs)
 	for _, r := range rs.Docs {
 		// if r.Abstract != "" {
@@ -245,79 +321,47 @@ func QueryNATS(search string, next int, isInCloud bool) ([]byte, error) {
 		// 	r.Abstract = headingIsh.ReplaceAllString(r.Abstract)
 		// }
 
-		t, err := time.Parse("2006-01-02T15:04:05Z", r.PublicationDate)
-		if err != nil {
+		// The page shows the first abstract
+		if len(r.Abstract) == 0 {
+			r.Abstract = []string{""}
+		}
 
+		t, err := time.Parse(publicationTime, r.PublicationDate)
+		if err != nil {
+			continue
 		}
 		r.PublicationDate = t.Format("2006-01-02")
 	}
 
 	if len(rs.Docs) == 0 {
-		return getError(search, "Nothing found for search \""+search+"\""), nil
+		return getError(search, "Nothing found for search \""+search+"\"")
 	}
 
-	// Publish the resulting object, which will be turned into JSON
-	ec.Publish(uniqueReplyTo, rs)
-
-	// Wait for a message - blocking
-	msg, err := sub.NextMsg(5 * time.Second)
-	if err != nil {
-		return getError(search, err.Error()), nil
-	}
-
-	return msg.Data, nil
-}
-
-func fetchSearch(search string, next int) (*ResultSet, error) {
-	results, err := queryAPI(search, next)
-	if err != nil {
-		return &ResultSet{}, err
-	}
-
-	response := Response{}
-
-	err = json.Unmarshal(results, &response)
+	output, err := json.Marshal(rs)
 	if err != nil {
-		return nil, err
+		return getError(search, err.Error())
 	}
 
-	response.ResultSet.SearchTerm = search
-	response.ResultSet.Next = response.ResultSet.Start + len(response.ResultSet.Docs)
-
-	return response.ResultSet, nil
+	return output
 }
 
 // queryAPI query the PLOS JSON api
-func queryAPI(search string, start int) ([]byte, error) {
-	search = strings.TrimSpace(search)
-	search, _ = url.QueryUnescape(search)
-	var u string
-	u = "http://api.plos.org/search?"
-
-	// https://www.crossref.org/blog/dois-and-matching-regular-expressions/
-	// ^10.\d{4,9}/[-._;()/:A-Z0-9]+$
-	isLinkSearch, _ := regexp.MatchString(`^10\.\d{4,9}/[-\._;\(\)\/\:a-zA-Z0-9]+$`, search)
-	// isLinkSearch, _ := regexp.MatchString(`^\d+\.\d+\/journal\.[^\.]+\.\d+$`, search)
-	// fmt.Println("search", search, "matched", isLinkSearch)
-
-	if isLinkSearch {
-		u = u + "q=id:\"" + fmt.Sprintf("%v", search) + "\"&fl=id,title,abstract_primary_display,journal,publication_date,author&start=" + fmt.Sprintf("%d", start)
-	} else {
-		search = url.QueryEscape(search)
-		u = u + "q=title:" + fmt.Sprintf("%v", search) + "&fl=id,title,abstract_primary_display,journal,publication_date,author&start=" + fmt.Sprintf("%d", start)
-	}
+func queryAPI(ctx context.Context, query *SearchQuery, start int) ([]byte, error) {
+	u := conf.Upstream.PLOS + "?q=" + url.QueryEscape(query.Solr()) +
+		"&fl=id,title,abstract_primary_display,journal,publication_date,author&start=" + fmt.Sprintf("%d", start)
 
-	resp, err := http.Get(u)
-	if err != nil {
-		return []byte{}, err
-	}
+	v, err := searchCache.Get(ctx, u, func(ctx context.Context) (interface{}, error) {
+		called := time.Now()
+		bytes, err := outbound.Get(ctx, u)
+		metrics.ObserveUpstream("plos", called, err)
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+		return bytes, err
+	})
 	if err != nil {
 		return []byte{}, err
 	}
 
-	return bytes, nil
+	return v.([]byte), nil
 }
 
 // ToHTML process template to HTML
@@ -328,17 +372,14 @@ func ToHTML(rs *ResultSet, isErr bool) (string, error) {
 	if isErr {
 		page = "error.html"
 	}
+	// HTML templates can not be cloned once run, and need not be
 	t := templates.Lookup(page)
-	if t != nil {
-		// Not sure clone is needed here
-		t, err := t.Clone()
-		if err != nil {
-			return "", fmt.Errorf("problem getting template for %s", page)
-		}
-		t.Funcs(funcMap).ExecuteTemplate(buf, page, rs)
-	} else {
+	if t == nil {
 		return "", fmt.Errorf("problem getting template for %s", page)
 	}
+	if err := t.Execute(buf, rs); err != nil {
+		return "", err
+	}
 
 	return buf.String(), nil
 }
@@ -1,21 +1,34 @@
 package msg
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/creds"
 	"github.com/matryer/is"
 	"github.com/nats-io/nats-server/v2/server"
-	stand "github.com/nats-io/nats-streaming-server/server"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 func NewNATSServer(t *testing.T) (*server.Server, func()) {
-	// https://sourcegraph.com/github.com/nats-io/nats-server@6da5d2f4907a03c8ba26fc8b6ca2aed903ac80f8/-/blob/main.go
-	// Now we want to setup the monitoring port for NATS Streaming.
-	// We still need NATS Options to do so, so create NATS Options
-	// using the NewNATSOptions() from the streaming server package.
-	snopts := stand.NewNATSOptions()
+	// Use the app's options so that its NKey user can connect
+	snopts, err := serverOptions()
+	if err != nil {
+		panic(err)
+	}
 	snopts.Port = nats.DefaultPort
 	snopts.HTTPPort = 8223
 
@@ -30,11 +43,32 @@ func NewNATSServer(t *testing.T) (*server.Server, func()) {
 	}
 }
 
+// startClient start a new shared client and wait for it to connect, getting
+// a function to stop it
+func startClient(t *testing.T) func() {
+	client = NewClient()
+	go client.Start()
+	for try := 0; client.Status() != "connected"; try++ {
+		if try == 50 {
+			t.Fatal("client did not connect:", client.Status())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client.Stop(ctx)
+	}
+}
+
 func TestCall(t *testing.T) {
 	is := is.New(t)
 	is.True(true == true)
 
-	_, err := queryAPI("Covid", 0)
+	q, err := ParseQuery("Covid")
+	is.NoErr(err)
+	_, err = queryAPI(context.Background(), q, 0)
 	is.NoErr(err)
 
 	// t.Log(string(results))
@@ -47,8 +81,9 @@ func TestMessage(t *testing.T) {
 
 	t.Log("address", server.Addr())
 	defer shutdown()
+	defer startClient(t)()
 
-	result, err := QueryNATS("Covid", 0, false)
+	result, err := QueryNATS(context.Background(), "Covid", 0)
 	is.NoErr(err)
 
 	t.Logf("Got message %+v", string(result))
@@ -61,8 +96,9 @@ func TestToHTML(t *testing.T) {
 
 	t.Log("address", server.Addr())
 	defer shutdown()
+	defer startClient(t)()
 
-	result, err := QueryNATS("Covid", 0, false)
+	result, err := QueryNATS(context.Background(), "Covid", 0)
 	is.NoErr(err)
 
 	// t.Log("Query results", string(result))
@@ -75,3 +111,516 @@ func TestToHTML(t *testing.T) {
 
 	t.Log(html)
 }
+
+// TestSearchWorker test searches answered by workers over a local server and
+// a fake PLOS
+func TestSearchWorker(t *testing.T) {
+	is := is.New(t)
+
+	abandoned := make(chan struct{})
+	// Closed once three searches are at PLOS at the same time
+	together := make(chan struct{})
+	var mu sync.Mutex
+	waiting := 0
+	plos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, "together") {
+			mu.Lock()
+			waiting++
+			if waiting == 3 {
+				close(together)
+			}
+			mu.Unlock()
+			select {
+			case <-together:
+			case <-time.After(2 * time.Second):
+				mu.Lock()
+				waiting--
+				mu.Unlock()
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if strings.Contains(r.URL.RawQuery, "slow") {
+			select {
+			case <-r.Context().Done():
+				close(abandoned)
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		fmt.Fprint(w, `{"response": {"numFound": 1, "start": 0, "docs": [
+			{"id": "10.1371/journal.pone.0000001", "title": "A study", "publication_date": "2020-01-02T00:00:00Z"}]}}`)
+	}))
+	defer plos.Close()
+
+	opts, err := serverOptions()
+	is.NoErr(err)
+	opts.Port = server.RANDOM_PORT
+	opts.HTTPPort = 0
+	ns, err := server.NewServer(opts)
+	is.NoErr(err)
+	go ns.Start()
+	defer ns.Shutdown()
+	is.True(ns.ReadyForConnections(5 * time.Second))
+
+	c := config.Default()
+	c.NATS.URL = ns.ClientURL()
+	c.Upstream.PLOS = plos.URL
+	// Enough for one worker to take every concurrent search below
+	c.Search.Concurrency = 3
+	previous := conf
+	conf = c
+	defer func() { conf = previous }()
+
+	// Without a connection searches fail
+	client = NewClient()
+	_, err = QueryNATS(context.Background(), "study", 0)
+	is.Equal(err, ErrNotConnected)
+	is.True(CheckConnection(context.Background()) != nil)
+
+	defer startClient(t)()
+	is.NoErr(CheckConnection(context.Background()))
+
+	// Without workers the error is in the result set
+	result, err := QueryNATS(context.Background(), "study", 0)
+	is.NoErr(err)
+	rs := ResultSet{}
+	is.NoErr(json.Unmarshal(result, &rs))
+	is.True(rs.Error)
+
+	workers := []*SearchWorker{NewSearchWorker(), NewSearchWorker()}
+	for _, w := range workers {
+		go w.Start()
+	}
+	defer func() {
+		for _, w := range workers {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			is.NoErr(w.Stop(ctx))
+			cancel()
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		var rs ResultSet
+		// Workers subscribe once they have connected
+		for try := 0; try < 50; try++ {
+			result, err := QueryNATS(context.Background(), "study", 0)
+			is.NoErr(err)
+			rs = ResultSet{}
+			is.NoErr(json.Unmarshal(result, &rs))
+			if rs.Error == false {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		is.Equal(rs.Error, false)
+		is.Equal(len(rs.Docs), 1)
+		is.Equal(rs.Docs[0].PublicationDate, "2020-01-02")
+	}
+
+	// Workers answer several searches at once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			QueryNATS(context.Background(), fmt.Sprintf("together%d", i), 0)
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case <-together:
+	default:
+		t.Fatal("searches were not answered at the same time")
+	}
+
+	// The requester's deadline reaches the worker's call to PLOS
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	result, err = QueryNATS(ctx, "slow", 0)
+	is.NoErr(err)
+	rs = ResultSet{}
+	is.NoErr(json.Unmarshal(result, &rs))
+	is.True(rs.Error)
+	select {
+	case <-abandoned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("PLOS request was not cancelled")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = QueryNATS(ctx, "study", 0)
+	is.True(errors.Is(err, context.Canceled))
+
+	// Losing the server is reported rather than waited on
+	ns.Shutdown()
+	for try := 0; client.Status() == "connected" && try < 50; try++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	is.Equal(client.Status(), "reconnecting")
+	_, err = QueryNATS(context.Background(), "study", 0)
+	is.Equal(err, ErrNotConnected)
+	is.True(CheckConnection(context.Background()) != nil)
+}
+
+// TestAuth test that only NKey users connect, over TLS, with their
+// permissions
+func TestAuth(t *testing.T) {
+	is := is.New(t)
+
+	c := config.Default()
+	c.NATS.TLS = true
+	c.NATS.SubjectPrefix = "deploy1"
+	previous := conf
+	conf = c
+	defer func() { conf = previous }()
+
+	opts, err := serverOptions()
+	is.NoErr(err)
+	opts.Port = server.RANDOM_PORT
+	opts.HTTPPort = 0
+	ns, err := server.NewServer(opts)
+	is.NoErr(err)
+	go ns.Start()
+	defer ns.Shutdown()
+	is.True(ns.ReadyForConnections(5 * time.Second))
+	c.NATS.URL = ns.ClientURL()
+
+	// No key, or no TLS, no connection
+	_, err = nats.Connect(c.NATS.URL, nats.Secure(creds.ClientTLSConfig()))
+	is.True(err != nil)
+	auth, err := clientOptions()
+	is.NoErr(err)
+	_, err = nats.Connect(c.NATS.URL, auth[0])
+	is.True(err != nil)
+
+	nc, err := nats.Connect(c.NATS.URL, auth...)
+	is.NoErr(err)
+	defer nc.Close()
+	_, err = nc.SubscribeSync(subject(SearchSubject))
+	is.NoErr(err)
+	is.NoErr(nc.Flush())
+	is.Equal(subject(SearchSubject), "deploy1.search.plos")
+
+	// Subjects outside the app's, such as searches without its prefix, are
+	// refused
+	_, err = nc.SubscribeSync(SearchSubject)
+	is.NoErr(err)
+	nc.Flush()
+	is.True(nc.LastError() != nil)
+
+	// A users file has to include the app's user
+	kp, err := nkeys.CreateUser()
+	is.NoErr(err)
+	other, err := kp.PublicKey()
+	is.NoErr(err)
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	is.NoErr(ioutil.WriteFile(path, []byte("users:\n  - nkey: "+other+"\n"), 0600))
+	c.NATS.UsersFile = path
+	_, err = serverUsers()
+	is.True(err != nil)
+
+	_, err = ParseUsers([]byte(`{"users": [{"nkey": "nope"}]}`), ".json")
+	is.True(err != nil)
+}
+
+// TestHistory test that searches are kept on the streaming channel and
+// replayed to clients that connect later
+func TestHistory(t *testing.T) {
+	is := is.New(t)
+
+	plos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"response": {"numFound": 1, "start": 0, "docs": [
+			{"id": "10.1371/journal.pone.0000001", "title": "A study of mites"}]}}`)
+	}))
+	defer plos.Close()
+
+	c := config.Default()
+	c.NATS.StoreDir = t.TempDir()
+	c.Upstream.PLOS = plos.URL
+	previous := conf
+	conf = c
+	defer func() { conf = previous }()
+
+	opts, err := serverOptions()
+	is.NoErr(err)
+	opts.Port = server.RANDOM_PORT
+	opts.HTTPPort = 0
+	ns, err := server.NewServer(opts)
+	is.NoErr(err)
+	go ns.Start()
+	defer ns.Shutdown()
+	is.True(ns.ReadyForConnections(5 * time.Second))
+	c.NATS.URL = ns.ClientURL()
+
+	stop := func(c interface{ Stop(context.Context) error }) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Stop(ctx)
+	}
+	streaming := NewStreamingServer()
+	go streaming.Start()
+	defer stop(streaming)
+	worker := NewSearchWorker()
+	go worker.Start()
+	defer stop(worker)
+
+	// waitFor wait for the history to have n entries
+	waitFor := func(n int) []HistoryEntry {
+		var entries []HistoryEntry
+		for try := 0; try < 100; try++ {
+			entries, _ = History()
+			if len(entries) == n {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return entries
+	}
+
+	stopClient := startClient(t)
+	is.Equal(len(waitFor(0)), 0)
+	for try := 0; try < 50; try++ {
+		if _, err := History(); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, term := range []string{"mites", "ticks", "published:<img/src=x/onerror=alert(1)>"} {
+		_, err = QueryNATS(context.Background(), term, 0)
+		is.NoErr(err)
+	}
+	entries := waitFor(2)
+	is.Equal(len(entries), 2)
+	is.Equal(entries[0].SearchTerm, "ticks")
+	is.Equal(entries[1].Results.Docs[0].Title, "A study of mites")
+	stopClient()
+
+	// A new client gets the searches made before it connected
+	defer startClient(t)()
+	entries = waitFor(2)
+	is.Equal(len(entries), 2)
+	is.Equal(entries[1].SearchTerm, "mites")
+
+	html, err := HistoryToHTML()
+	is.NoErr(err)
+	is.True(strings.Contains(html, `data-search="mites"`))
+	is.True(strings.Contains(html, "onerror") == false) // failed search not kept
+}
+
+// TestHistoryEscaped test that history from the channel is escaped
+func TestHistoryEscaped(t *testing.T) {
+	is := is.New(t)
+
+	previous := client.history.entries
+	defer func() { client.history.entries = previous }()
+	client.history.entries = []HistoryEntry{{
+		SearchTerm: url.QueryEscape("<script>alert(1)</script>"),
+		Results: &ResultSet{NumFound: 1, Docs: []*Result{
+			{ID: `10.1/x"><b>`, Title: "<img src=x onerror=alert(2)>"},
+		}},
+	}, {
+		SearchTerm: "old",
+		Results:    &ResultSet{Error: true, ErrorMessage: "<script>alert(3)</script>"},
+	}}
+
+	html, err := HistoryToHTML()
+	is.NoErr(err)
+	is.True(strings.Contains(html, "<script>") == false)
+	is.True(strings.Contains(html, "<img") == false)
+	is.True(strings.Contains(html, `"><b>`) == false)
+	is.True(strings.Contains(html, "&lt;script&gt;alert(3)"))
+}
+
+// search parse a query and search a backend with it
+func search(b SearchBackend, text string, start int) (*ResultSet, error) {
+	q, err := ParseQuery(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Search(context.Background(), q, start)
+}
+
+// TestParseQuery test parsing queries and their Solr translation
+func TestParseQuery(t *testing.T) {
+	is := is.New(t)
+
+	for text, solr := range map[string]string{
+		"covid":                                 "title:covid",
+		"dust mite":                             "title:dust AND title:mite",
+		`author:"Jane Smith" OR journal:PLOS`:   `author:"Jane Smith" OR journal:PLOS`,
+		"(sleep OR memory) NOT abstract:mice":   "(title:sleep OR title:memory) AND (*:* NOT abstract:mice)",
+		"published:2019..2021":                  "publication_date:[2019-01-01T00:00:00Z TO 2022-01-01T00:00:00Z}",
+		"published:2020-06.. covid-19":          `publication_date:[2020-06-01T00:00:00Z TO *] AND title:covid\-19`,
+		"10.1371/journal.pone.0238819":          `id:"10.1371/journal.pone.0238819"`,
+		"Title:bees AND published:..2018-03-04": "title:bees AND publication_date:[* TO 2018-03-05T00:00:00Z}",
+	} {
+		q, err := ParseQuery(text)
+		is.NoErr(err)
+		is.Equal(q.Solr(), solr)
+	}
+
+	// Nesting up to the limit is fine
+	_, err := ParseQuery(strings.Repeat("(", maxQueryDepth) + "sleep" + strings.Repeat(")", maxQueryDepth))
+	is.NoErr(err)
+
+	for _, text := range []string{"", "(sleep", "sleep)", `"dust mite`, "colour:red", "author:", "sleep AND",
+		"sleep OR OR memory", "published:2021..2019", "published:last-year", "NOT",
+		strings.Repeat("(", 10000) + "sleep" + strings.Repeat(")", 10000), strings.Repeat("NOT ", 10000) + "sleep"} {
+		_, err := ParseQuery(text)
+		is.True(err != nil)
+		t.Log(err)
+	}
+
+	// Errors do not repeat what was searched for, and are escaped as HTML
+	for _, text := range []string{"published:<img/src=x/onerror=alert(1)>", "<b>:x", "a OR OR <b>"} {
+		_, err := ParseQuery(text)
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), "<") == false)
+
+		html, err := ToHTML(&ResultSet{SearchTerm: url.QueryEscape(text), Error: true, ErrorMessage: "<b>" + err.Error()}, false)
+		is.NoErr(err)
+		is.True(strings.Contains(html, "<b>") == false)
+		is.True(strings.Contains(html, "<img") == false)
+	}
+}
+
+// TestBackends test the local and Crossref search backends
+func TestBackends(t *testing.T) {
+	is := is.New(t)
+
+	articles, err := LoadCorpus("")
+	is.NoErr(err)
+	local := NewLocalBackend(articles)
+
+	// Stemming finds "mite" as well as "mites"
+	rs, err := search(local, "mites", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 4)
+	is.True(strings.Contains(strings.ToLower(rs.Docs[0].Title), "mite"))
+
+	rs, err = search(local, "covid vaccination", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 1)
+
+	rs, err = search(local, `"dust mite"`, 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 1)
+	is.Equal(rs.Docs[0].ID, "10.5555/sample.0002")
+
+	rs, err = search(local, "mites NOT dust", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 3)
+
+	rs, err = search(local, `author:Lindqvist OR "dust mite"`, 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 3)
+
+	rs, err = search(local, "mite published:2020", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 1)
+	is.Equal(rs.Docs[0].ID, "10.5555/sample.0002")
+
+	rs, err = search(local, "10.5555/sample.0006", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 1)
+	is.Equal(rs.Docs[0].Journal, "Sample Neuroscience")
+
+	crossref := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/works/10.1371/journal.pone.0238819" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"message": {"DOI": "10.1371/journal.pone.0238819", "title": ["An article"],
+			"abstract": "<jats:p>Text</jats:p>", "container-title": ["PLOS ONE"],
+			"author": [{"given": "Ada", "family": "Lovelace"}], "issued": {"date-parts": [[2020, 9, 4]]}}}`)
+	}))
+	defer crossref.Close()
+
+	c := config.Default()
+	c.Upstream.Crossref = crossref.URL
+	c.Search.Backend = config.SearchCrossref
+	previous := conf
+	conf = c
+	defer func() { conf = previous }()
+	b, err := NewBackend(c)
+	is.NoErr(err)
+
+	rs, err = search(b, "10.1371/journal.pone.0238819", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 1)
+	is.Equal(rs.Docs[0].Abstract[0], "<p>Text</p>")
+	is.Equal(rs.Docs[0].Author, []string{"Ada Lovelace"})
+	is.Equal(rs.Docs[0].PublicationDate, "2020-09-04T00:00:00Z")
+
+	rs, err = search(b, "10.1371/journal.pone.0000000", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 0)
+
+	_, err = search(b, "mites", 0)
+	is.True(err != nil)
+
+	// PLOS results are added to the local index, which is searched when PLOS
+	// is unavailable
+	plos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"response": {"numFound": 1, "start": 0, "docs": [{"id": "10.1371/journal.pone.0000001",
+			"title": "Ticks and tick-borne disease", "abstract_primary_display": ["About ticks"],
+			"journal": "PLOS ONE", "publication_date": "2021-01-01T00:00:00Z"}]}}`)
+	}))
+	c.Upstream.PLOS = plos.URL
+	c.Search.Backend = config.SearchPLOS
+	b, err = NewBackend(c)
+	is.NoErr(err)
+
+	rs, err = search(b, "ticks", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 1)
+	plos.Close()
+
+	rs, err = search(b, "tick", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 1)
+	is.Equal(rs.Docs[0].ID, "10.1371/journal.pone.0000001")
+
+	// Only the most recently learned results are kept, and never in place of
+	// the corpus
+	learning := NewLocalBackend(articles)
+	learning.learnLimit = 2
+	learning.Learn(&Result{ID: "a", Title: "Ticks"}, &Result{ID: "b", Title: "Fleas"})
+	learning.Learn(&Result{ID: "a", Title: "Ticks"}, &Result{ID: "c", Title: "Lice"})
+	learning.Learn(&Result{ID: "10.5555/sample.0002", Title: "Replaced"})
+	is.Equal(learning.Len(), len(articles)+2)
+	rs, err = search(learning, "fleas", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 0)
+	rs, err = search(learning, "ticks OR lice", 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 2)
+	rs, err = search(learning, `"dust mite"`, 0)
+	is.NoErr(err)
+	is.Equal(rs.NumFound, 1)
+
+	// Results are formatted the same whatever the backend
+	SetBackend(local)
+	defer SetBackend(&plosBackend{})
+	result := ResultSet{}
+	is.NoErr(json.Unmarshal(runSearch(context.Background(), "dust+mite", 0), &result))
+	is.Equal(result.Error, false)
+	is.Equal(result.Docs[0].PublicationDate, "2020-06-02")
+	is.Equal(result.Next, 1)
+}
+
+// TestSearchDeadline test that workers do not wait longer than requestTimeout
+// whatever the requester asks for
+func TestSearchDeadline(t *testing.T) {
+	is := is.New(t)
+
+	limit := time.Now().Add(requestTimeout)
+	is.True(searchDeadline(Query{}).Sub(limit) < time.Second)
+	is.True(searchDeadline(Query{Deadline: limit.Add(time.Hour)}).Sub(limit) < time.Second)
+
+	soon := time.Now().Add(time.Second)
+	is.Equal(searchDeadline(Query{Deadline: soon}), soon)
+}
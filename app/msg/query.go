@@ -0,0 +1,493 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Query fields. Terms without a field search the default fields of the
+// backend.
+const (
+	fieldTitle     = "title"
+	fieldAuthor    = "author"
+	fieldJournal   = "journal"
+	fieldAbstract  = "abstract"
+	fieldPublished = "published"
+)
+
+// queryFields fields that can prefix a term
+var queryFields = []string{fieldTitle, fieldAuthor, fieldJournal, fieldAbstract, fieldPublished}
+
+// solrFields PLOS Solr fields by query field. Terms without a field search
+// titles, as searches always have.
+var solrFields = map[string]string{
+	"":            "title",
+	fieldTitle:    "title",
+	fieldAuthor:   "author",
+	fieldJournal:  "journal",
+	fieldAbstract: "abstract",
+}
+
+// solrSpecial characters escaped in Solr terms
+const solrSpecial = `+-&|!(){}[]^"~*?:\/`
+
+// SearchQuery a parsed search. Terms are combined with AND, OR and NOT, with
+// AND implied between terms, and can be grouped with parentheses. A term is a
+// word, a "quoted phrase", either of those with a field prefix such as
+// author: or a published: date range like 2019..2021. A DOI on its own finds
+// that article.
+type SearchQuery struct {
+	Text string
+	root clause
+}
+
+// clause a part of a parsed query
+type clause interface {
+	solr() string
+}
+
+// termClause a word or phrase, in a field or in the backend's default fields
+type termClause struct {
+	field  string
+	text   string
+	phrase bool
+}
+
+// doiClause an article by DOI
+type doiClause struct {
+	doi string
+}
+
+// rangeClause publication dates from the start of from up to but not
+// including to. Zero times leave that end open.
+type rangeClause struct {
+	from time.Time
+	to   time.Time
+}
+
+// boolClause clauses that must all match for AND or any match for OR
+type boolClause struct {
+	op      string
+	clauses []clause
+}
+
+// notClause a clause that must not match
+type notClause struct {
+	clause clause
+}
+
+// QueryError a problem parsing a query and the zero based position in the
+// query where it was found
+type QueryError struct {
+	Position int
+	Message  string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position+1)
+}
+
+// ParseQuery parse a search query
+func ParseQuery(text string) (*SearchQuery, error) {
+	tokens, err := lex(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, &QueryError{Position: 0, Message: "Empty search"}
+	}
+
+	p := parser{tokens: tokens, end: len([]rune(text))}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, &QueryError{Position: t.pos, Message: "Unexpected " + t.describe()}
+	}
+
+	return &SearchQuery{Text: text, root: root}, nil
+}
+
+// DOI the DOI searched for when the query is only a DOI
+func (q *SearchQuery) DOI() (string, bool) {
+	if c, ok := q.root.(*doiClause); ok {
+		return c.doi, true
+	}
+	return "", false
+}
+
+// Solr the query in Solr syntax
+func (q *SearchQuery) Solr() string {
+	return q.root.solr()
+}
+
+func (c *termClause) solr() string {
+	if c.phrase {
+		return solrFields[c.field] + `:"` + strings.ReplaceAll(strings.ReplaceAll(c.text, `\`, `\\`), `"`, `\"`) + `"`
+	}
+
+	var sb strings.Builder
+	for _, r := range c.text {
+		if strings.ContainsRune(solrSpecial, r) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+
+	return solrFields[c.field] + ":" + sb.String()
+}
+
+func (c *doiClause) solr() string {
+	return `id:"` + c.doi + `"`
+}
+
+func (c *rangeClause) solr() string {
+	from, to, closing := "*", "*", "]"
+	if c.from.IsZero() == false {
+		from = c.from.Format(publicationTime)
+	}
+	if c.to.IsZero() == false {
+		to, closing = c.to.Format(publicationTime), "}"
+	}
+
+	return "publication_date:[" + from + " TO " + to + closing
+}
+
+func (c *boolClause) solr() string {
+	parts := make([]string, 0, len(c.clauses))
+	for _, sub := range c.clauses {
+		if _, ok := sub.(*boolClause); ok {
+			parts = append(parts, "("+sub.solr()+")")
+			continue
+		}
+		parts = append(parts, sub.solr())
+	}
+
+	return strings.Join(parts, " "+c.op+" ")
+}
+
+// Solr only applies a negation to something, so it is taken from everything
+func (c *notClause) solr() string {
+	return "(*:* NOT " + c.clause.solr() + ")"
+}
+
+// includes whether a time is in the range
+func (c *rangeClause) includes(t time.Time) bool {
+	if c.from.IsZero() == false && t.Before(c.from) {
+		return false
+	}
+	if c.to.IsZero() == false && t.Before(c.to) == false {
+		return false
+	}
+	return true
+}
+
+// token kinds
+const (
+	tokenWord = iota
+	tokenPhrase
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+// tokenNames descriptions of tokens for errors, which do not repeat the query
+// as it may be shown back as HTML
+var tokenNames = map[int]string{
+	tokenWord:   "word",
+	tokenPhrase: "phrase",
+	tokenAnd:    "AND",
+	tokenOr:     "OR",
+	tokenNot:    "NOT",
+	tokenOpen:   "(",
+	tokenClose:  ")",
+}
+
+// token a lexed part of a query
+type token struct {
+	kind  int
+	field string
+	text  string
+	pos   int
+}
+
+// describe get the kind of a token for errors
+func (t *token) describe() string {
+	return tokenNames[t.kind]
+}
+
+// lex split a query into tokens
+func lex(text string) ([]token, error) {
+	var tokens []token
+	runes := []rune(text)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen, text: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose, text: ")", pos: i})
+			i++
+		case r == '"':
+			phrase, next, err := lexPhrase(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenPhrase, text: phrase, pos: i})
+			i = next
+		default:
+			start := i
+			for i < len(runes) && unicode.IsSpace(runes[i]) == false && strings.ContainsRune(`()"`, runes[i]) == false {
+				i++
+			}
+			word := string(runes[start:i])
+
+			switch word {
+			case "AND":
+				tokens = append(tokens, token{kind: tokenAnd, text: word, pos: start})
+				continue
+			case "OR":
+				tokens = append(tokens, token{kind: tokenOr, text: word, pos: start})
+				continue
+			case "NOT":
+				tokens = append(tokens, token{kind: tokenNot, text: word, pos: start})
+				continue
+			}
+
+			t := token{kind: tokenWord, text: word, pos: start}
+			if colon := strings.Index(word, ":"); colon > 0 && isDOI(word) == false {
+				t.field, t.text = strings.ToLower(word[:colon]), word[colon+1:]
+				if knownField(t.field) == false {
+					return nil, &QueryError{Position: start, Message: "Unknown field, use one of " +
+						strings.Join(queryFields, ", ")}
+				}
+				// A field can be followed by a phrase
+				if t.text == "" && i < len(runes) && runes[i] == '"' {
+					phrase, next, err := lexPhrase(runes, i)
+					if err != nil {
+						return nil, err
+					}
+					t.kind, t.text, i = tokenPhrase, phrase, next
+				}
+				if t.text == "" {
+					return nil, &QueryError{Position: start, Message: fmt.Sprintf("Nothing to search for in %s", t.field)}
+				}
+			}
+			tokens = append(tokens, t)
+		}
+	}
+
+	return tokens, nil
+}
+
+// lexPhrase get the phrase in quotes starting at runes[start] and the
+// position after the closing quote
+func lexPhrase(runes []rune, start int) (string, int, error) {
+	for i := start + 1; i < len(runes); i++ {
+		if runes[i] == '"' {
+			return string(runes[start+1 : i]), i + 1, nil
+		}
+	}
+
+	return "", 0, &QueryError{Position: start, Message: "Unclosed quote"}
+}
+
+// knownField whether a field can prefix a term
+func knownField(field string) bool {
+	for _, f := range queryFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// maxQueryDepth groups and NOTs that can be nested in a query, so that the
+// parser and the clauses it builds do not recurse without bound
+const maxQueryDepth = 32
+
+// parser a recursive descent parser over query tokens. OR binds less
+// tightly than AND, which binds less tightly than NOT.
+type parser struct {
+	tokens []token
+	next   int
+	end    int
+	depth  int // groups and NOTs being parsed
+}
+
+// peek get the next token without consuming it, or nil at the end
+func (p *parser) peek() *token {
+	if p.next < len(p.tokens) {
+		return &p.tokens[p.next]
+	}
+	return nil
+}
+
+// or parse clauses separated by OR
+func (p *parser) or() (clause, error) {
+	c, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	clauses := []clause{c}
+	for t := p.peek(); t != nil && t.kind == tokenOr; t = p.peek() {
+		p.next++
+		c, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, c)
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+
+	return &boolClause{op: "OR", clauses: clauses}, nil
+}
+
+// and parse clauses separated by AND or nothing
+func (p *parser) and() (clause, error) {
+	c, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	clauses := []clause{c}
+	for t := p.peek(); t != nil && t.kind != tokenOr && t.kind != tokenClose; t = p.peek() {
+		if t.kind == tokenAnd {
+			p.next++
+		}
+		c, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, c)
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+
+	return &boolClause{op: "AND", clauses: clauses}, nil
+}
+
+// unary parse a term, a group in parentheses or a negated clause
+func (p *parser) unary() (clause, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, &QueryError{Position: p.end, Message: "Missing search term"}
+	}
+	p.next++
+
+	if t.kind == tokenNot || t.kind == tokenOpen {
+		if p.depth == maxQueryDepth {
+			return nil, &QueryError{Position: t.pos, Message: "Search is nested too deeply"}
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+	}
+
+	switch t.kind {
+	case tokenNot:
+		c, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &notClause{clause: c}, nil
+	case tokenOpen:
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.peek(); closing == nil || closing.kind != tokenClose {
+			return nil, &QueryError{Position: t.pos, Message: "Unclosed parenthesis"}
+		}
+		p.next++
+		return c, nil
+	case tokenWord, tokenPhrase:
+		return term(t)
+	}
+
+	return nil, &QueryError{Position: t.pos, Message: "Expected a search term, not " + t.describe()}
+}
+
+// term get the clause for a word or phrase token
+func term(t *token) (clause, error) {
+	switch {
+	case t.field == fieldPublished:
+		return parseRange(t)
+	case t.field == "" && t.kind == tokenWord && isDOI(t.text):
+		return &doiClause{doi: t.text}, nil
+	}
+
+	return &termClause{field: t.field, text: t.text, phrase: t.kind == tokenPhrase}, nil
+}
+
+// parseRange parse a published: range of years or dates, from..to, with
+// either end optional, or a single year or date
+func parseRange(t *token) (clause, error) {
+	from, to := t.text, t.text
+	if dots := strings.Index(t.text, ".."); dots >= 0 {
+		from, to = t.text[:dots], t.text[dots+2:]
+	}
+
+	c := rangeClause{}
+	var err error
+	if from != "" {
+		c.from, _, err = parseDate(from)
+		if err != nil {
+			return nil, &QueryError{Position: t.pos, Message: err.Error()}
+		}
+	}
+	if to != "" {
+		start, length, err := parseDate(to)
+		if err != nil {
+			return nil, &QueryError{Position: t.pos, Message: err.Error()}
+		}
+		c.to = start.AddDate(length[0], length[1], length[2])
+	}
+	if c.from.IsZero() && c.to.IsZero() {
+		return nil, &QueryError{Position: t.pos, Message: "Published range needs a start or an end"}
+	}
+	if c.to.IsZero() == false && c.to.After(c.from) == false {
+		return nil, &QueryError{Position: t.pos, Message: "Published range ends before it starts"}
+	}
+
+	return &c, nil
+}
+
+// dateLayouts layouts for published dates with the years, months and days
+// each covers
+var dateLayouts = []struct {
+	layout string
+	length [3]int
+}{
+	{"2006", [3]int{1, 0, 0}},
+	{"2006-01", [3]int{0, 1, 0}},
+	{"2006-01-02", [3]int{0, 0, 1}},
+}
+
+// parseDate parse a year, month or day and get its start and length
+func parseDate(value string) (time.Time, [3]int, error) {
+	for _, d := range dateLayouts {
+		if len(value) != len(d.layout) {
+			continue
+		}
+		t, err := time.Parse(d.layout, value)
+		if err == nil {
+			return t, d.length, nil
+		}
+	}
+
+	return time.Time{}, [3]int{}, errors.New("Published date is not a year, year-month or year-month-day")
+}
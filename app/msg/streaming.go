@@ -0,0 +1,122 @@
+package msg
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// maxStoredMessages messages kept per streaming channel, oldest dropped first
+const maxStoredMessages = 1000
+
+// StreamingServer a NATS Streaming server using the core NATS server for
+// transport and keeping channels in a file store, so that they survive
+// restarts
+type StreamingServer struct {
+	mu      sync.Mutex
+	server  *stand.StanServer
+	stopped bool
+	done    chan struct{}
+}
+
+// NewStreamingServer get a new streaming server. It runs when started.
+func NewStreamingServer() *StreamingServer {
+	s := StreamingServer{}
+	s.done = make(chan struct{})
+
+	return &s
+}
+
+// streamingOptions get the options for the streaming server from the
+// configuration. It connects to the core server as the app's user.
+func streamingOptions() (*stand.Options, error) {
+	opts := stand.GetDefaultOptions()
+	opts.ID = conf.NATS.ClusterID
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = conf.NATS.StoreDir
+	opts.MaxMsgs = maxStoredMessages
+	opts.NATSServerURL = conf.NATS.URL
+
+	var err error
+	opts.NATSClientOpts, err = clientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// Name name of the server for lifecycle reporting
+func (s *StreamingServer) Name() string {
+	return "NATS Streaming server"
+}
+
+// Start run the server once the core server accepts connections, blocking
+// until it is stopped
+func (s *StreamingServer) Start() error {
+	opts, err := streamingOptions()
+	if err != nil {
+		return err
+	}
+
+	var lastErr string
+	for {
+		server, err := stand.RunServerWithOpts(opts, nil)
+		if err == nil {
+			s.mu.Lock()
+			s.server = server
+			stopped := s.stopped
+			s.mu.Unlock()
+			if stopped {
+				server.Shutdown()
+				return nil
+			}
+			break
+		}
+		if err.Error() != lastErr {
+			log.Printf("NATS Streaming server waiting to start: %v", err)
+			lastErr = err.Error()
+		}
+
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+	<-s.done
+
+	return nil
+}
+
+// Stop shut down the server, closing the store
+func (s *StreamingServer) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopped = true
+	server := s.server
+	s.mu.Unlock()
+	close(s.done)
+	if server == nil {
+		return nil
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(shutdown)
+	}()
+	select {
+	case <-shutdown:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
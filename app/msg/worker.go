@@ -0,0 +1,176 @@
+package msg
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/imarsman/nanovms/app/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// SearchSubject subject search requests are sent on, after the
+	// deployment's subject prefix if it has one
+	SearchSubject = "search.plos"
+	// SearchQueue queue group search workers share, so that each request is
+	// handled by only one of them
+	SearchQueue = "search.workers"
+)
+
+// requestTimeout how long to wait for a search worker to reply. This covers
+// the PLOS call made by the worker.
+const requestTimeout = 15 * time.Second
+
+// SearchWorker a subscriber that answers search requests by calling PLOS. Any
+// number of workers can run across instances, with requests spread between
+// them by the queue group. Each worker answers up to conf.Search.Concurrency
+// searches at once; further requests wait in its subscription.
+type SearchWorker struct {
+	mu      sync.Mutex
+	nc      *nats.Conn
+	sub     *nats.Subscription
+	stopped bool
+	closed  chan struct{}
+	slots   chan struct{}  // one for each search being answered
+	running sync.WaitGroup // searches taken from the subscription
+}
+
+// NewSearchWorker get a new search worker. It connects when started.
+func NewSearchWorker() *SearchWorker {
+	w := SearchWorker{}
+	w.closed = make(chan struct{})
+	w.slots = make(chan struct{}, conf.Search.Concurrency)
+
+	return &w
+}
+
+// Name name of the worker for lifecycle reporting
+func (w *SearchWorker) Name() string {
+	return "NATS search worker"
+}
+
+// Start connect and handle search requests until stopped. The connection is
+// retried in the background so the worker can start before the NATS server.
+func (w *SearchWorker) Start() error {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return nil
+	}
+	nc, err := connect(w.Name(), w.closed)
+	if err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	w.nc = nc
+	sub, err := nc.QueueSubscribe(subject(SearchSubject), SearchQueue, w.handle)
+	if err != nil {
+		w.mu.Unlock()
+		nc.Close()
+		return err
+	}
+	w.sub = sub
+	w.mu.Unlock()
+	<-w.closed
+
+	return nil
+}
+
+// Stop drain the subscription so requests already received are answered,
+// then close the connection
+func (w *SearchWorker) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	w.stopped = true
+	nc, sub := w.nc, w.sub
+	w.mu.Unlock()
+	if nc == nil {
+		return nil
+	}
+
+	// Searches are answered outside the subscription's callback, so the
+	// connection has to stay open until they are done
+	if sub != nil && nc.IsConnected() && sub.Drain() == nil {
+		if err := w.finish(ctx, sub); err != nil {
+			nc.Close()
+			return err
+		}
+	}
+
+	return drain(ctx, nc, w.closed)
+}
+
+// finish wait until a draining subscription has handed over its last request
+// and every search taken has been answered
+func (w *SearchWorker) finish(ctx context.Context, sub *nats.Subscription) error {
+	answered := make(chan struct{})
+	go func() {
+		// The subscription is removed once its last callback has returned
+		for sub.IsValid() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.running.Wait()
+		close(answered)
+	}()
+
+	select {
+	case <-answered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handle answer a search request in its own goroutine once a slot is free.
+// Waiting for a slot holds up the subscription, so requests beyond the
+// worker's concurrency stay queued rather than piling up in goroutines.
+func (w *SearchWorker) handle(m *nats.Msg) {
+	w.running.Add(1)
+	w.slots <- struct{}{}
+	go func() {
+		defer func() {
+			<-w.slots
+			w.running.Done()
+		}()
+		handleSearch(m)
+	}()
+}
+
+// handleSearch answer a search request with a JSON result set
+func handleSearch(m *nats.Msg) {
+	metrics.NATSReceived()
+
+	q := Query{}
+	if err := json.Unmarshal(m.Data, &q); err != nil {
+		m.Respond(getError("", "invalid search request: "+err.Error()))
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), searchDeadline(q))
+	defer cancel()
+
+	if err := m.Respond(runSearch(ctx, q.SearchTerm, q.Next)); err == nil {
+		metrics.NATSPublished()
+	}
+}
+
+// subject get a subject after the deployment's subject prefix, if it has one
+func subject(name string) string {
+	if conf.NATS.SubjectPrefix == "" {
+		return name
+	}
+
+	return conf.NATS.SubjectPrefix + "." + name
+}
+
+// searchDeadline when to give up on a search: when the requester stops
+// waiting, but no later than requestTimeout from now whatever it asked for
+func searchDeadline(q Query) time.Time {
+	deadline := time.Now().Add(requestTimeout)
+	if q.Deadline.IsZero() == false && q.Deadline.Before(deadline) {
+		deadline = q.Deadline
+	}
+
+	return deadline
+}
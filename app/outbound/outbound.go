@@ -0,0 +1,367 @@
+// Package outbound is the HTTP client for calls from the app to upstream APIs.
+// Each request has a timeout, which can be set per host. Idempotent requests
+// that fail with a network error or a retryable status are retried with
+// exponential backoff and jitter. A circuit breaker per host opens after
+// repeated failures so that calls fail fast until the host has had time to
+// recover, then lets one trial request through to test it.
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/imarsman/nanovms/app/config"
+)
+
+// Backoff between retries, doubled for each attempt up to maxBackoff
+const (
+	baseBackoff = 200 * time.Millisecond
+	maxBackoff  = 5 * time.Second
+)
+
+// maxBody largest response body read by Get
+const maxBody = 16 << 20
+
+// ErrCircuitOpen returned without calling a host whose circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// StatusError a response with a status code other than 2xx
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %s", e.URL, e.Status)
+}
+
+// Breaker states
+const (
+	StateClosed   = "closed"    // requests go through
+	StateOpen     = "open"      // requests fail fast
+	StateHalfOpen = "half-open" // one trial request goes through
+)
+
+// breaker a circuit breaker for one host
+type breaker struct {
+	state    string
+	failures int       // consecutive failures while closed
+	opened   time.Time // when the breaker last opened
+	trial    bool      // a trial request is running while half-open
+}
+
+// Transport an http.RoundTripper adding timeouts, retries and circuit
+// breakers to another. It is safe for concurrent use.
+type Transport struct {
+	mu       sync.Mutex
+	base     http.RoundTripper
+	timeout  time.Duration
+	timeouts map[string]time.Duration // by host
+	retries  int
+	failures int // consecutive failures opening a breaker
+	cooldown time.Duration
+	breakers map[string]*breaker
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+// NewTransport get a transport wrapping base with the outbound settings in c
+func NewTransport(base http.RoundTripper, c *config.Config) *Transport {
+	t := Transport{}
+	t.base = base
+	t.breakers = make(map[string]*breaker)
+	t.now = time.Now
+	t.sleep = sleep
+	t.configure(c)
+
+	return &t
+}
+
+// configure apply the outbound settings in c
+func (t *Transport) configure(c *config.Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.timeout = c.Outbound.Timeout.Duration
+	t.timeouts = make(map[string]time.Duration)
+	for host, d := range c.Outbound.HostTimeouts {
+		t.timeouts[host] = d.Duration
+	}
+	t.retries = c.Outbound.Retries
+	t.failures = c.Outbound.BreakerFailures
+	t.cooldown = c.Outbound.BreakerCooldown.Duration
+}
+
+// transport the transport used by the shared client
+var transport = NewTransport(http.DefaultTransport, config.Default())
+
+// client the shared client for calls to upstream APIs
+var client = &http.Client{Transport: transport}
+
+// Configure apply the outbound settings in c to the shared client
+func Configure(c *config.Config) {
+	transport.configure(c)
+}
+
+// Client get the shared client for calls to upstream APIs
+func Client() *http.Client {
+	return client
+}
+
+// State get the state of the circuit breaker for a host, with its port if
+// the URLs called have one
+func State(host string) string {
+	return transport.State(host)
+}
+
+// Get get the body of a URL with the shared client. Responses with a status
+// other than 2xx are a *StatusError.
+func Get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBody))
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxBody))
+}
+
+// State get the state of the circuit breaker for a host
+func (t *Transport) State(host string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if b, ok := t.breakers[host]; ok {
+		return b.state
+	}
+	return StateClosed
+}
+
+// RoundTrip make a request, retrying idempotent requests that fail with a
+// network error or a retryable status. Retryable statuses are returned as is
+// once retries run out.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	timeout := t.timeout
+	if d, ok := t.timeouts[req.URL.Hostname()]; ok {
+		timeout = d
+	}
+	retries := t.retries
+	t.mu.Unlock()
+
+	// A body can only be sent again if it can be got again
+	if idempotent(req) == false || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		// The caller's request is left as it is, so retries send a copy
+		try := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			try = req.Clone(req.Context())
+			try.Body = body
+		}
+
+		resp, err := t.attempt(try, timeout)
+		if attempt >= retries || retryable(resp, err) == false {
+			return resp, err
+		}
+
+		delay := backoff(attempt, resp)
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBody))
+			resp.Body.Close()
+		}
+		if err := t.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// attempt make one request through the host's circuit breaker
+func (t *Transport) attempt(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	host := req.URL.Host
+	if err := t.allow(host); err != nil {
+		return nil, fmt.Errorf("%s: %w", host, err)
+	}
+
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), timeout)
+	}
+	resp, err := t.base.RoundTrip(req.Clone(ctx))
+	// Requests given up by the caller say nothing about the host
+	if req.Context().Err() != nil {
+		t.release(host)
+	} else {
+		t.record(host, failed(resp, err))
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout covers reading the body, so cancel once it is closed
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// allow check whether a request to a host can go through its breaker
+func (t *Transport) allow(host string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.breakers[host]
+	if ok == false {
+		b = &breaker{state: StateClosed}
+		t.breakers[host] = b
+	}
+
+	switch b.state {
+	case StateOpen:
+		if t.now().Sub(b.opened) < t.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = StateHalfOpen
+		b.trial = true
+	case StateHalfOpen:
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+	}
+
+	return nil
+}
+
+// record update a host's breaker with the outcome of a request
+func (t *Transport) record(host string, failure bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.breakers[host]
+	switch {
+	case failure == false:
+		if b.state != StateClosed {
+			log.Printf("Circuit breaker for %s closed", host)
+		}
+		b.state, b.failures, b.trial = StateClosed, 0, false
+	case b.state == StateHalfOpen:
+		b.state, b.opened, b.trial = StateOpen, t.now(), false
+		log.Printf("Circuit breaker for %s opened again after a failed trial request", host)
+	default:
+		b.failures++
+		if t.failures > 0 && b.failures >= t.failures {
+			b.state, b.opened = StateOpen, t.now()
+			log.Printf("Circuit breaker for %s opened after %d failures", host, b.failures)
+		}
+	}
+}
+
+// release end a request to a host without recording an outcome, letting
+// another trial request through if the breaker is half-open
+func (t *Transport) release(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.breakers[host].trial = false
+}
+
+// cancelBody a response body that cancels the request context when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// idempotent whether a request can safely be made again
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// failed whether a request failed in a way that counts against its host
+func failed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// retryable whether a failed request is worth making again
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, ErrCircuitOpen) == false && errors.Is(err, context.Canceled) == false
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff get the delay before a retry, using a Retry-After header in seconds
+// if the response has one. Otherwise the delay is random, up to a limit that
+// doubles with each attempt (full jitter).
+func backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			if d := time.Duration(seconds) * time.Second; d < maxBackoff {
+				return d
+			}
+			return maxBackoff
+		}
+	}
+
+	limit := baseBackoff << uint(attempt)
+	if limit > maxBackoff || limit <= 0 {
+		limit = maxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// sleep wait for a time or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
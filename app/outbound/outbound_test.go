@@ -0,0 +1,170 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/matryer/is"
+)
+
+// newTestTransport get a transport that does not wait between retries
+func newTestTransport(c *config.Config) *Transport {
+	t := NewTransport(http.DefaultTransport, c)
+	t.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+
+	return t
+}
+
+// TestRetry test that idempotent requests are retried and others are not
+func TestRetry(t *testing.T) {
+	is := is.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTestTransport(config.Default())}
+
+	resp, err := client.Get(server.URL)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(atomic.LoadInt32(&calls), int32(3))
+
+	// Retries with a body send copies of the request
+	atomic.StoreInt32(&calls, 0)
+	req, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("{}"))
+	is.NoErr(err)
+	body := req.Body
+	resp, err = client.Do(req)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(atomic.LoadInt32(&calls), int32(3))
+	is.Equal(req.Body, body)
+
+	atomic.StoreInt32(&calls, 0)
+	resp, err = client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusServiceUnavailable)
+	is.Equal(atomic.LoadInt32(&calls), int32(1))
+}
+
+// TestBreaker test that a breaker opens after repeated failures, fails fast
+// while open and closes after a successful trial request
+func TestBreaker(t *testing.T) {
+	is := is.New(t)
+
+	var calls int32
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	c := config.Default()
+	c.Outbound.Retries = 0
+	c.Outbound.BreakerFailures = 3
+	transport := newTestTransport(c)
+	now := time.Now()
+	transport.now = func() time.Time { return now }
+	client := &http.Client{Transport: transport}
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		is.NoErr(err)
+		resp.Body.Close()
+	}
+	is.Equal(transport.State(host), StateOpen)
+
+	_, err := client.Get(server.URL)
+	is.True(errors.Is(err, ErrCircuitOpen))
+	is.Equal(atomic.LoadInt32(&calls), int32(3))
+
+	// A failed trial opens the breaker again
+	now = now.Add(c.Outbound.BreakerCooldown.Duration)
+	resp, err := client.Get(server.URL)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(transport.State(host), StateOpen)
+
+	// A trial given up by the caller decides nothing
+	now = now.Add(c.Outbound.BreakerCooldown.Duration)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	is.NoErr(err)
+	_, err = client.Do(req)
+	is.True(errors.Is(err, context.Canceled))
+	is.Equal(transport.State(host), StateHalfOpen)
+
+	atomic.StoreInt32(&healthy, 1)
+	resp, err = client.Get(server.URL)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(transport.State(host), StateClosed)
+}
+
+// TestTimeout test per host timeouts, which cover reading the body
+func TestTimeout(t *testing.T) {
+	is := is.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	c := config.Default()
+	c.Outbound.Retries = 0
+	c.Outbound.HostTimeouts = config.HostDurations{u.Hostname(): {Duration: 100 * time.Millisecond}}
+	Configure(c)
+	defer Configure(config.Default())
+
+	start := time.Now()
+	_, err := Get(context.Background(), server.URL)
+	is.True(err != nil)
+	is.True(time.Since(start) < time.Second)
+}
+
+// TestGetStatus test that responses other than 2xx are errors
+func TestGetStatus(t *testing.T) {
+	is := is.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>down for maintenance</html>", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := Get(context.Background(), server.URL)
+	statusErr := &StatusError{}
+	is.True(errors.As(err, &statusErr))
+	is.Equal(statusErr.StatusCode, http.StatusNotFound)
+}
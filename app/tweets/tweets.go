@@ -10,6 +10,10 @@ import (
 	"time"
 
 	twitter "github.com/g8rswimmer/go-twitter/v2"
+	"github.com/imarsman/nanovms/app/cache"
+	"github.com/imarsman/nanovms/app/config"
+	"github.com/imarsman/nanovms/app/metrics"
+	"github.com/imarsman/nanovms/app/outbound"
 	"github.com/imarsman/nanovms/app/stack"
 )
 
@@ -21,6 +25,12 @@ var token string
 var tweetStack *stack.Stack
 var mu *sync.Mutex
 
+// searchQuery recent tweets searched for
+const searchQuery = "linux"
+
+// searchCache IDs of tweets found by search query
+var searchCache = cache.FromConfig("twitter", config.Default())
+
 // TweetData summary tweet data for client
 type TweetData struct {
 	TweetID    string `json:"tweetid"`    // tweet id for client lookup
@@ -83,20 +93,26 @@ func init() {
 
 	tweetStack = stack.NewStack()
 	// rand.Seed(time.Now().UnixNano())
+	Configure(config.Default())
+}
+
+// Configure set up the Twitter client using the configuration
+func Configure(c *config.Config) {
 	client = &twitter.Client{
 		Authorizer: authorize{
 			Token: token,
 		},
-		Client: http.DefaultClient,
-		Host:   "https://api.twitter.com",
+		Client: outbound.Client(),
+		Host:   c.Upstream.Twitter,
 	}
 }
 
 // curl "https://api.twitter.com/2/tweets/search/recent?query=text=#kittens&max_results=10" -H "Authorization: Bearer "
 
 // GetTweetData get a new TweetData item. Fetch 10 at a time and cache them,
-// giving out one at a time until the cache stack is empty, then reload.
-func GetTweetData() (*TweetData, error) {
+// giving out one at a time until the cache stack is empty, then reload. A
+// reload gives up when the context is done.
+func GetTweetData(ctx context.Context) (*TweetData, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -119,15 +135,29 @@ func GetTweetData() (*TweetData, error) {
 		MaxResults:  50,
 	}
 
-	recentSearchResponse, err := client.TweetRecentSearch(context.Background(), "linux", opts)
+	v, err := searchCache.Get(ctx, searchQuery, func(ctx context.Context) (interface{}, error) {
+		start := time.Now()
+		recentSearchResponse, err := client.TweetRecentSearch(ctx, searchQuery, opts)
+		metrics.ObserveUpstream("twitter", start, err)
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]string, 0, len(recentSearchResponse.Raw.Tweets))
+		for _, t := range recentSearchResponse.Raw.Tweets {
+			ids = append(ids, t.ID)
+		}
+		return ids, nil
+	})
 	if err != nil {
 		return TweetDataError(), fmt.Errorf("tweet lookup error: %v", err)
 	}
+	ids := v.([]string)
 
 	// Avoid going out of bounds
 	max := 50
-	if len(recentSearchResponse.Raw.Tweets) < 50 {
-		max = len(recentSearchResponse.Raw.Tweets)
+	if len(ids) < 50 {
+		max = len(ids)
 	}
 	chosen := make(map[int]int)
 	count := 0
@@ -143,10 +173,9 @@ func GetTweetData() (*TweetData, error) {
 		} else {
 			// Avoid going out of bounds
 			if count < 20 && count < max {
-				v := recentSearchResponse.Raw.Tweets[offset]
 				count++
 				if count < 10 {
-					tweetStack.Push(v.ID)
+					tweetStack.Push(ids[offset])
 				} else {
 					break
 				}
@@ -156,7 +185,7 @@ func GetTweetData() (*TweetData, error) {
 		}
 	}
 
-	v, err := tweetStack.Front()
+	v, err = tweetStack.Front()
 	if err != nil {
 		return TweetDataError(), err
 	}
@@ -1,6 +1,7 @@
 package tweets
 
 import (
+	"context"
 	"testing"
 
 	"github.com/matryer/is"
@@ -10,7 +11,7 @@ func TestSearch(t *testing.T) {
 	is := is.New(t)
 
 	for i := 0; i < 20; i++ {
-		results, err := GetTweetData()
+		results, err := GetTweetData(context.Background())
 		is.NoErr(err)
 		t.Log(results)
 	}
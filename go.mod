@@ -11,9 +11,16 @@ require (
 	github.com/nats-io/nats-server/v2 v2.3.3
 	github.com/nats-io/nats-streaming-server v0.22.1
 	github.com/nats-io/nats.go v1.11.1-0.20210623165838-4b75fc59ae30
+	github.com/nats-io/nkeys v0.3.0
+	github.com/nats-io/nuid v1.0.1
+	github.com/nats-io/stan.go v0.10.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/prometheus/client_golang v1.11.0
 	github.com/tidwall/gjson v1.8.1
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.39.0
 	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.3.0
 )